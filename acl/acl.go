@@ -0,0 +1,317 @@
+// Package acl implements path-based access control lists. An ACL attached to
+// a database, document or collection grants permissions to users and groups,
+// and applies to everything below that path until a deeper ACL replaces it.
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Permission is the level of access a user has to a resource. Each level
+// includes the ones below it.
+type Permission int
+
+const (
+	// None denies all access.
+	None Permission = iota
+	// Read allows reading and subscribing.
+	Read
+	// Write allows creating, changing and deleting.
+	Write
+	// Admin allows changing the ACL.
+	Admin
+)
+
+// Everyone is the user name that matches every authenticated user.
+const Everyone = "*"
+
+// ParsePermission converts a permission name to a Permission
+// Input: Permission name (string)
+// Output: Permission, error if the name is unknown
+func ParsePermission(name string) (Permission, error) {
+	switch name {
+	case "none":
+		return None, nil
+	case "read":
+		return Read, nil
+	case "write":
+		return Write, nil
+	case "admin":
+		return Admin, nil
+	default:
+		return None, fmt.Errorf("unknown permission %q", name)
+	}
+}
+
+// String returns the name of the permission
+// Input: None
+// Output: Permission name (string)
+func (p Permission) String() string {
+	switch p {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case Admin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+// MarshalText encodes the permission as its name
+// Input: None
+// Output: Encoded name, error if any
+func (p Permission) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText decodes a permission from its name
+// Input: Encoded name ([]byte)
+// Output: Error if the name is unknown
+func (p *Permission) UnmarshalText(text []byte) error {
+	parsed, err := ParsePermission(string(text))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// ACL grants permissions on a resource to users and groups. The user
+// Everyone matches any authenticated user.
+type ACL struct {
+	Users  map[string]Permission `json:"users,omitempty"`
+	Groups map[string]Permission `json:"groups,omitempty"`
+}
+
+// file is the layout of the ACL file
+type file struct {
+	Groups map[string][]string `json:"groups"`
+	ACLs   map[string]ACL      `json:"acls"`
+}
+
+// Store holds the ACLs of all resources and the members of each group. A
+// store loaded from a file writes every change back to it.
+type Store struct {
+	mu     sync.RWMutex
+	path   string
+	groups map[string][]string
+	acls   map[string]ACL
+}
+
+// NewStore creates an empty store that is kept in memory only
+// Input: None
+// Output: Pointer to Store
+func NewStore() *Store {
+	return &Store{groups: make(map[string][]string), acls: make(map[string]ACL)}
+}
+
+// Load reads a store from the ACL file. A missing file starts an empty store
+// that is created on the first change.
+// Input: ACL file path (string)
+// Output: Pointer to Store, error if the file cannot be read
+func Load(path string) (*Store, error) {
+	store := NewStore()
+	store.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("acl file could not be read")
+	}
+	var contents file
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("acl file in incorrect format")
+	}
+	for resource, entry := range contents.ACLs {
+		normalized, err := Normalize(resource)
+		if err != nil {
+			return nil, err
+		}
+		store.acls[normalized] = entry
+	}
+	if contents.Groups != nil {
+		store.groups = contents.Groups
+	}
+	slog.Info("Loaded ACLs", "path", path, "acls", len(store.acls), "groups", len(store.groups))
+	return store, nil
+}
+
+// Normalize converts a resource path to the form ACLs are stored under,
+// without a trailing slash
+// Input: Resource path (string)
+// Output: Normalized path, error if it is not a /v1 path
+func Normalize(resource string) (string, error) {
+	resource = strings.TrimSuffix(resource, "/")
+	if !strings.HasPrefix(resource, "/v1/") || strings.Contains(resource, "//") {
+		return "", fmt.Errorf("bad resource path %q", resource)
+	}
+	return resource, nil
+}
+
+// save writes the store to its file, replacing it atomically. Must be
+// called with s.mu held.
+// Input: None
+// Output: Error if any
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	encoded, err := json.MarshalIndent(file{Groups: s.groups, ACLs: s.acls}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".acl-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write acl file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write acl file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write acl file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write acl file: %v", err)
+	}
+	return nil
+}
+
+// Get returns the ACL attached directly to a resource
+// Input: Resource path (string)
+// Output: ACL, boolean indicating if the resource has one
+func (s *Store) Get(resource string) (ACL, bool) {
+	resource, err := Normalize(resource)
+	if err != nil {
+		return ACL{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.acls[resource]
+	return entry, ok
+}
+
+// Set attaches an ACL to a resource, replacing any it had
+// Input: Resource path (string), ACL
+// Output: Error if the path is invalid or the store cannot be saved
+func (s *Store) Set(resource string, entry ACL) error {
+	resource, err := Normalize(resource)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acls[resource] = entry
+	return s.save()
+}
+
+// Delete removes the ACL attached directly to a resource, so it inherits
+// its parent's again
+// Input: Resource path (string)
+// Output: Boolean indicating if an ACL was removed, error if the store cannot be saved
+func (s *Store) Delete(resource string) (bool, error) {
+	resource, err := Normalize(resource)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.acls[resource]; !ok {
+		return false, nil
+	}
+	delete(s.acls, resource)
+	return true, s.save()
+}
+
+// RemoveTree removes the ACLs of a resource and everything below it, used
+// when the resource is deleted so a new one at the same path starts fresh
+// Input: Resource path (string)
+// Output: Error if the store cannot be saved
+func (s *Store) RemoveTree(resource string) error {
+	resource, err := Normalize(resource)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := false
+	for path := range s.acls {
+		if path == resource || strings.HasPrefix(path, resource+"/") {
+			delete(s.acls, path)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return s.save()
+}
+
+// Permission returns a user's permission on a resource, taken from the
+// nearest ACL on the resource or its ancestors. Resources with no ACL above
+// them are open to every user.
+// Input: Username (string), Resource path (string)
+// Output: Permission
+func (s *Store) Permission(user string, resource string) Permission {
+	resource, err := Normalize(resource)
+	if err != nil {
+		return None
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for path := resource; path != "/v1"; path = path[:strings.LastIndex(path, "/")] {
+		if entry, ok := s.acls[path]; ok {
+			return s.grant(user, entry)
+		}
+	}
+	return Admin
+}
+
+// Protected reports whether an ACL is attached to a resource or any of its
+// ancestors
+// Input: Resource path (string)
+// Output: Boolean
+func (s *Store) Protected(resource string) bool {
+	resource, err := Normalize(resource)
+	if err != nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for path := resource; path != "/v1"; path = path[:strings.LastIndex(path, "/")] {
+		if _, ok := s.acls[path]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// grant evaluates one ACL for a user, taking the highest permission given to
+// the user, to everyone, or to any of the user's groups. Must be called with
+// s.mu held.
+// Input: Username (string), ACL
+// Output: Permission
+func (s *Store) grant(user string, entry ACL) Permission {
+	permission := max(entry.Users[user], entry.Users[Everyone])
+	for group, groupPermission := range entry.Groups {
+		if groupPermission > permission && slices.Contains(s.groups[group], user) {
+			permission = groupPermission
+		}
+	}
+	return permission
+}
@@ -0,0 +1,116 @@
+package acl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPermission_OpenWithoutACL(t *testing.T) {
+	store := NewStore()
+	if p := store.Permission("alice", "/v1/db/doc"); p != Admin {
+		t.Errorf("Expected admin on unprotected resource, got %v", p)
+	}
+}
+
+func TestProtected(t *testing.T) {
+	store := NewStore()
+	store.Set("/v1/db/doc", ACL{Users: map[string]Permission{"alice": Admin}})
+	if !store.Protected("/v1/db/doc/col/") || !store.Protected("/v1/db/doc") {
+		t.Errorf("Expected the document and everything below it to be protected")
+	}
+	if store.Protected("/v1/db") || store.Protected("/v1/db/other") {
+		t.Errorf("Expected resources outside the ACL to be unprotected")
+	}
+}
+
+func TestPermission_Inherited(t *testing.T) {
+	store := NewStore()
+	store.Set("/v1/db", ACL{Users: map[string]Permission{"alice": Write, Everyone: Read}})
+
+	if p := store.Permission("alice", "/v1/db/doc/col/"); p != Write {
+		t.Errorf("Expected alice to inherit write, got %v", p)
+	}
+	if p := store.Permission("bob", "/v1/db/doc"); p != Read {
+		t.Errorf("Expected bob to inherit read, got %v", p)
+	}
+	if p := store.Permission("bob", "/v1/other"); p != Admin {
+		t.Errorf("Expected other databases to stay open, got %v", p)
+	}
+}
+
+func TestPermission_NearestACLWins(t *testing.T) {
+	store := NewStore()
+	store.Set("/v1/db", ACL{Users: map[string]Permission{Everyone: Write}})
+	store.Set("/v1/db/secret", ACL{Users: map[string]Permission{"alice": Admin}})
+
+	if p := store.Permission("bob", "/v1/db/secret/col/doc"); p != None {
+		t.Errorf("Expected bob to be denied below the deeper ACL, got %v", p)
+	}
+	if p := store.Permission("bob", "/v1/db/public"); p != Write {
+		t.Errorf("Expected bob to keep write elsewhere, got %v", p)
+	}
+
+	store.Delete("/v1/db/secret")
+	if p := store.Permission("bob", "/v1/db/secret"); p != Write {
+		t.Errorf("Expected the parent ACL to apply after delete, got %v", p)
+	}
+}
+
+func TestPermission_Groups(t *testing.T) {
+	store := NewStore()
+	store.groups["editors"] = []string{"carol"}
+	store.Set("/v1/db", ACL{
+		Users:  map[string]Permission{Everyone: Read},
+		Groups: map[string]Permission{"editors": Write},
+	})
+
+	if p := store.Permission("carol", "/v1/db/doc"); p != Write {
+		t.Errorf("Expected carol to get write from her group, got %v", p)
+	}
+	if p := store.Permission("dave", "/v1/db/doc"); p != Read {
+		t.Errorf("Expected dave to get read, got %v", p)
+	}
+}
+
+func TestRemoveTree(t *testing.T) {
+	store := NewStore()
+	store.Set("/v1/db", ACL{Users: map[string]Permission{"alice": Admin}})
+	store.Set("/v1/db/doc", ACL{Users: map[string]Permission{"alice": Admin}})
+	store.Set("/v1/dbx", ACL{Users: map[string]Permission{"alice": Admin}})
+
+	store.RemoveTree("/v1/db")
+	if _, ok := store.Get("/v1/db/doc"); ok {
+		t.Errorf("Expected ACLs below the deleted resource to be removed")
+	}
+	if _, ok := store.Get("/v1/dbx"); !ok {
+		t.Errorf("Expected ACLs of sibling resources to be kept")
+	}
+}
+
+func TestLoadAndSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	os.WriteFile(path, []byte(`{"groups": {"eng": ["alice"]}, "acls": {"/v1/db/": {"groups": {"eng": "write"}}}}`), 0600)
+
+	store, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if p := store.Permission("alice", "/v1/db/doc"); p != Write {
+		t.Errorf("Expected alice to get write, got %v", p)
+	}
+
+	store.Set("/v1/db/doc", ACL{Users: map[string]Permission{"bob": Read}})
+	reloaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if p := reloaded.Permission("bob", "/v1/db/doc"); p != Read {
+		t.Errorf("Expected saved ACL to be reloaded, got %v", p)
+	}
+
+	os.WriteFile(path, []byte(`{"acls": {"/v1/db": {"users": {"bob": "owner"}}}}`), 0600)
+	if _, err := Load(path); err == nil {
+		t.Errorf("Expected an error for an unknown permission")
+	}
+}
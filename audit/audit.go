@@ -0,0 +1,176 @@
+// Package audit writes a tamper-evident log of changes as JSON lines. Each
+// entry carries the hash of the entry before it, so editing, removing or
+// reordering entries breaks the chain and is caught by Verify.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is one audited request
+type Entry struct {
+	Time        time.Time `json:"time"`
+	Username    string    `json:"username"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Status      int       `json:"status"`
+	StatusClass string    `json:"statusClass"`
+	ContentHash string    `json:"contentHash,omitempty"`
+	PrevHash    string    `json:"prevHash"`
+	Hash        string    `json:"hash,omitempty"`
+}
+
+// ErrBrokenChain is returned by Verify when an entry does not match its hash
+// or does not follow the entry before it
+var ErrBrokenChain = errors.New("audit log hash chain is broken")
+
+// Log appends entries to an audit file. A nil Log discards entries.
+type Log struct {
+	mu       sync.Mutex
+	file     *os.File
+	lastHash string
+}
+
+// HashContent returns the hex SHA-256 of request content, or an empty string
+// if there is no content
+// Input: Content ([]byte)
+// Output: Hash (string)
+func HashContent(content []byte) string {
+	if len(content) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// entryHash computes the chained hash of an entry, covering every field
+// except the hash itself
+// Input: Entry
+// Output: Hash (string), error if the entry cannot be encoded
+func entryHash(entry Entry) (string, error) {
+	entry.Hash = ""
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Open opens the audit file at the given path for appending, creating it if
+// needed, and continues the hash chain from its last entry
+// Input: Path (string)
+// Output: Log, error if the file cannot be opened or is not a valid audit log
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log could not be opened")
+	}
+	lastHash, _, err := readChain(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Log{file: file, lastHash: lastHash}, nil
+}
+
+// Record fills in the entry's time and hashes and appends it to the log
+// Input: Entry
+// Output: error if the entry could not be written
+func (l *Log) Record(entry Entry) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	entry.PrevHash = l.lastHash
+	hash, err := entryHash(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(encoded, '\n')); err != nil {
+		return err
+	}
+	l.lastHash = hash
+	return nil
+}
+
+// Close flushes the audit file to disk and closes it
+// Input: None
+// Output: error if the file could not be synced or closed
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// Verify checks the hash chain of the audit file at the given path
+// Input: Path (string)
+// Output: Number of entries checked, error wrapping ErrBrokenChain with the
+// line of the first bad entry
+func Verify(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	_, count, err := readChain(file)
+	return count, err
+}
+
+// readChain reads every entry from the start of the file, checking that each
+// one matches its hash and follows the one before it
+// Input: File (io.ReadSeeker)
+// Output: Hash of the last entry, number of entries, error if the chain is broken
+func readChain(file io.ReadSeeker) (string, int, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	lastHash := ""
+	count := 0
+	for scanner.Scan() {
+		count++
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return "", count, fmt.Errorf("%w: line %d is not an entry", ErrBrokenChain, count)
+		}
+		hash, err := entryHash(entry)
+		if err != nil || hash != entry.Hash || entry.PrevHash != lastHash {
+			return "", count, fmt.Errorf("%w at line %d", ErrBrokenChain, count)
+		}
+		lastHash = entry.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return "", count, err
+	}
+	return lastHash, count, nil
+}
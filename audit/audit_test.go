@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Record(Entry{Username: "alice", Method: "PUT", Path: "/v1/db", Status: 201, StatusClass: "Created"})
+	log.Record(Entry{Username: "alice", Method: "DELETE", Path: "/v1/db", Status: 204, StatusClass: "Deleted"})
+	log.Close()
+
+	// Reopening continues the chain
+	log, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Record(Entry{Username: "bob", Method: "PUT", Path: "/v1/other", ContentHash: HashContent([]byte("{}"))})
+	log.Close()
+
+	count, err := Verify(path)
+	if err != nil || count != 3 {
+		t.Fatalf("Verify = %d, %v, want 3 entries", count, err)
+	}
+}
+
+func TestVerify_DetectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, _ := Open(path)
+	log.Record(Entry{Username: "alice", Method: "PUT", Path: "/v1/db"})
+	log.Record(Entry{Username: "alice", Method: "PUT", Path: "/v1/db/doc"})
+	log.Close()
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	// Changing an entry
+	edited := strings.Replace(string(data), `"username":"alice"`, `"username":"mallory"`, 1)
+	os.WriteFile(path, []byte(edited), 0600)
+	if _, err := Verify(path); !errors.Is(err, ErrBrokenChain) {
+		t.Errorf("Verify after edit = %v, want ErrBrokenChain", err)
+	}
+
+	// Removing an entry
+	os.WriteFile(path, []byte(lines[1]+"\n"), 0600)
+	if _, err := Verify(path); !errors.Is(err, ErrBrokenChain) {
+		t.Errorf("Verify after removal = %v, want ErrBrokenChain", err)
+	}
+	if _, err := Open(path); !errors.Is(err, ErrBrokenChain) {
+		t.Errorf("Open of broken log = %v, want ErrBrokenChain", err)
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var log *Log
+	if err := log.Record(Entry{}); err != nil {
+		t.Error(err)
+	}
+	if err := log.Close(); err != nil {
+		t.Error(err)
+	}
+}
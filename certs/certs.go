@@ -0,0 +1,173 @@
+// Package certs serves TLS certificates that are reloaded when their files
+// are rotated, and builds the TLS configuration of the server, including
+// HTTP/2 and optional client certificate verification.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client certificate modes
+const (
+	ClientAuthNone     = "none"     // client certificates are not requested
+	ClientAuthOptional = "optional" // verified if given
+	ClientAuthRequire  = "require"  // every connection must present one
+)
+
+// checkInterval is how often the certificate files are checked for changes
+const checkInterval = time.Second
+
+// fileState identifies a version of a file
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Reloader holds a certificate and its key, and loads them again when the
+// files change so rotated certificates are picked up without a restart
+type Reloader struct {
+	certFile string
+	keyFile  string
+	now      func() time.Time
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certState   fileState
+	keyState    fileState
+	lastChecked time.Time
+}
+
+// NewReloader loads a certificate and key from PEM files.
+// Input: Certificate file (string), Key file (string)
+// Output: Reloader, error if the pair cannot be loaded
+func NewReloader(certFile string, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, now: time.Now}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// stat returns the state of a file
+// Input: Path (string)
+// Output: fileState, error if the file cannot be read
+func stat(path string) (fileState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// load reads the certificate and key. The lock must be held, or the
+// reloader not yet shared.
+// Input: None
+// Output: Error if the pair cannot be loaded
+func (r *Reloader) load() error {
+	certState, err := stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("certificate: %w", err)
+	}
+	keyState, err := stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("certificate key: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("certificate: %w", err)
+	}
+
+	r.cert = &cert
+	r.certState = certState
+	r.keyState = keyState
+	r.lastChecked = r.now()
+	return nil
+}
+
+// Reload loads the certificate and key if either file has changed. If the
+// new files cannot be loaded, for example because only one of them has been
+// replaced so far, the current certificate is kept.
+// Input: None
+// Output: Error if changed files cannot be loaded
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reloadIfChanged()
+}
+
+// reloadIfChanged is Reload with the lock held
+// Input: None
+// Output: Error if changed files cannot be loaded
+func (r *Reloader) reloadIfChanged() error {
+	r.lastChecked = r.now()
+	certState, certErr := stat(r.certFile)
+	keyState, keyErr := stat(r.keyFile)
+	if certErr == nil && keyErr == nil && certState == r.certState && keyState == r.keyState {
+		return nil
+	}
+
+	previous := r.cert
+	if err := r.load(); err != nil {
+		r.cert = previous
+		return err
+	}
+	slog.Info("Reloaded TLS certificate", "cert", r.certFile, "notAfter", r.cert.Leaf.NotAfter)
+	return nil
+}
+
+// GetCertificate returns the current certificate, checking the files for
+// changes at most once every checkInterval. It is used as
+// tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.now().Sub(r.lastChecked) >= checkInterval {
+		if err := r.reloadIfChanged(); err != nil {
+			slog.Error("Failed to reload TLS certificate, keeping the current one", "cert", r.certFile, "error", err)
+		}
+	}
+	return r.cert, nil
+}
+
+// ServerConfig builds the TLS configuration of the server: TLS 1.2 or
+// later, HTTP/2 with a fallback to HTTP/1.1, certificates from the reloader
+// and, unless the mode is ClientAuthNone, client certificates verified
+// against the CAs in clientCAFile.
+// Input: Reloader, Client CA file (string), Client certificate mode (string)
+// Output: TLS configuration, error if the CAs cannot be loaded or the mode is unknown
+func ServerConfig(reloader *Reloader, clientCAFile string, clientAuth string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	switch clientAuth {
+	case ClientAuthNone, "":
+		return config, nil
+	case ClientAuthOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client certificate mode %q", clientAuth)
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("client CA: no certificates found in %s", clientCAFile)
+	}
+	config.ClientCAs = pool
+	return config, nil
+}
@@ -0,0 +1,176 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issued is a certificate with its key, in PEM and parsed forms
+type issued struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// issue creates a certificate signed by parent, or self-signed if nil
+func issue(t *testing.T, serial int64, commonName string, parent *issued, isCA bool) issued {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return issued{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// write saves a certificate and key to the given files
+func write(t *testing.T, c issued, certFile string, keyFile string) {
+	if err := os.WriteFile(certFile, c.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, c.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	write(t, issue(t, 1, "first", nil, false), certFile, keyFile)
+
+	reloader, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := time.Now()
+	reloader.now = func() time.Time { return clock }
+
+	current := func() string {
+		cert, _ := reloader.GetCertificate(nil)
+		return cert.Leaf.Subject.CommonName
+	}
+	if current() != "first" {
+		t.Fatalf("Expected the first certificate, got %s", current())
+	}
+
+	// Rotated files are picked up on the next check
+	write(t, issue(t, 2, "second", nil, false), certFile, keyFile)
+	os.Chtimes(certFile, clock.Add(time.Minute), clock.Add(time.Minute))
+	if current() != "first" {
+		t.Errorf("Expected no check before the interval has passed")
+	}
+	clock = clock.Add(checkInterval)
+	if current() != "second" {
+		t.Errorf("Expected the rotated certificate, got %s", current())
+	}
+
+	// A half-rotated pair keeps the current certificate
+	os.WriteFile(certFile, issue(t, 3, "third", nil, false).certPEM, 0600)
+	os.Chtimes(certFile, clock.Add(2*time.Minute), clock.Add(2*time.Minute))
+	clock = clock.Add(checkInterval)
+	if current() != "second" {
+		t.Errorf("Expected a mismatched pair to be ignored, got %s", current())
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Errorf("Expected Reload to report the mismatched pair")
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, 1, "owldb CA", nil, true)
+	serverCert := issue(t, 2, "localhost", &ca, false)
+	client := issue(t, 3, "Brad", &ca, false)
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	write(t, serverCert, certFile, keyFile)
+	os.WriteFile(caFile, ca.certPEM, 0600)
+
+	if _, err := ServerConfig(nil, caFile, "sometimes"); err == nil {
+		t.Errorf("Expected an unknown client certificate mode to fail")
+	}
+	reloader, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ServerConfig(reloader, caFile, ClientAuthRequire)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{TLSConfig: config, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+	})}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+	url := "https://" + listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientPair, _ := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	httpClient := &http.Client{Transport: &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientPair}},
+	}}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, got %s", resp.Proto)
+	}
+	if string(body) != "Brad" {
+		t.Errorf("Expected the verified client certificate, got %q", body)
+	}
+
+	// Connections without a client certificate are refused
+	httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if resp, err := httpClient.Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected a connection without a client certificate to fail")
+	}
+}
@@ -0,0 +1,545 @@
+// Package config reads the server configuration from a JSON file and from
+// command line flags, with flags overriding values from the file, and checks
+// it before the server starts.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/certs"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/handlers"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/ratelimit"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/storage"
+)
+
+// Auth modes
+const (
+	AuthTokens = "tokens" // tokens are stored by the server
+	AuthJWT    = "jwt"    // tokens are signed JWTs
+)
+
+// redacted replaces secret values in the effective configuration
+const redacted = "[redacted]"
+
+// Config is the server configuration
+type Config struct {
+	Port    int    `json:"port"`
+	Schema  string `json:"schema"`
+	Tokens  string `json:"tokens"`
+	Users   string `json:"users,omitempty"`
+	DataDir string `json:"dataDir,omitempty"`
+	ACLs    string `json:"acls,omitempty"`
+	Audit   string `json:"audit,omitempty"`
+	// File holding the bearer token that may scrape /metrics
+	MetricsToken string `json:"metricsToken,omitempty"`
+	// How long shutdown waits for requests in progress before closing
+	// their connections
+	DrainTimeout Duration `json:"drainTimeout"`
+	TLS          TLS      `json:"tls"`
+	CORS         CORS     `json:"cors"`
+	Auth         Auth     `json:"auth"`
+	Limits       Limits   `json:"limits"`
+	Log          Log      `json:"log"`
+}
+
+// TLS is the certificate and key the server uses to serve HTTPS, and how
+// clients may authenticate with certificates of their own
+type TLS struct {
+	Cert        string            `json:"cert,omitempty"`
+	Key         string            `json:"key,omitempty"`
+	ClientCA    string            `json:"clientCA,omitempty"`
+	ClientAuth  string            `json:"clientAuth"`
+	ClientUsers map[string]string `json:"clientUsers,omitempty"`
+}
+
+// CORS lists the origins browsers may make requests from, "*" for any
+type CORS struct {
+	Origins []string `json:"origins"`
+}
+
+// Auth is how tokens are issued and how long they last
+type Auth struct {
+	Mode       string   `json:"mode"`
+	JWTKey     string   `json:"jwtKey,omitempty"`
+	SessionTTL Duration `json:"sessionTTL"`
+	StaticTTL  Duration `json:"staticTTL"`
+	// Let anyone log in without a password when there is no users file
+	InsecureLogin bool `json:"insecureLogin"`
+}
+
+// Limits are the size and rate limits on requests
+type Limits struct {
+	MaxBody    BodyLimits `json:"maxBody,omitempty"`
+	MaxDocSize int        `json:"maxDocSize"`
+	MaxDepth   int        `json:"maxDepth"`
+	Rates      Rates      `json:"rates"`
+}
+
+// Rates are rate limits by route class, as rate or rate:burst
+type Rates struct {
+	Reads         string `json:"reads,omitempty"`
+	Writes        string `json:"writes,omitempty"`
+	Subscriptions string `json:"subscriptions,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+}
+
+// Log is where and how the server logs
+type Log struct {
+	Level           string   `json:"level"`
+	Format          string   `json:"format"`
+	Color           bool     `json:"color"`
+	File            string   `json:"file,omitempty"`
+	MaxSize         int64    `json:"maxSize"`
+	MaxAge          Duration `json:"maxAge"`
+	Backups         int      `json:"backups"`
+	SampleFirst     int      `json:"sampleFirst"`
+	SampleEvery     int      `json:"sampleEvery"`
+	SampleInterval  Duration `json:"sampleInterval"`
+	AccessLog       string   `json:"accessLog,omitempty"`
+	AccessLogFormat string   `json:"accessLogFormat"`
+}
+
+// Duration is a time.Duration written in JSON as a string such as "24h"
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads a duration written as a string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("duration must be a string such as \"24h\"")
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, use a string such as \"24h\"", text)
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// BodyLimits are the largest request bodies in bytes by method, with "*"
+// for every method without its own limit
+type BodyLimits map[string]int64
+
+// String returns the limits in the form accepted by Set
+func (b BodyLimits) String() string {
+	entries := make([]string, 0, len(b))
+	for _, method := range slices.Sorted(maps.Keys(b)) {
+		if method == handlers.AllMethods {
+			entries = append([]string{strconv.FormatInt(b[method], 10)}, entries...)
+		} else {
+			entries = append(entries, method+"="+strconv.FormatInt(b[method], 10))
+		}
+	}
+	return strings.Join(entries, ",")
+}
+
+// Set replaces the limits with ones written as for handlers.ParseBodyLimits
+func (b *BodyLimits) Set(limits string) error {
+	parsed, err := handlers.ParseBodyLimits(limits)
+	if err != nil {
+		return err
+	}
+	*b = parsed
+	return nil
+}
+
+// Default returns the configuration used for anything not set in the file
+// or by flags
+// Input: None
+// Output: Config
+func Default() Config {
+	return Config{
+		Port:         3318,
+		DrainTimeout: Duration{5 * time.Second},
+		TLS:          TLS{ClientAuth: certs.ClientAuthNone},
+		CORS:         CORS{Origins: []string{"*"}},
+		Auth: Auth{
+			Mode:       AuthTokens,
+			SessionTTL: Duration{handlers.DefaultSessionLifetime},
+		},
+		Limits: Limits{MaxDepth: handlers.DefaultMaxDepth},
+		Log: Log{
+			Level:           "info",
+			Format:          "text",
+			SampleFirst:     10,
+			SampleEvery:     100,
+			SampleInterval:  Duration{time.Second},
+			AccessLogFormat: handlers.AccessLogCombined,
+		},
+	}
+}
+
+// Load reads a configuration file. Anything the file leaves out keeps its
+// default, and fields the server does not know are rejected so typos do not
+// go unnoticed.
+// Input: Path (string)
+// Output: Config, error naming the file and position of any problem
+func Load(path string) (Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("config file: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) {
+			// The offset is just past the character that could not be parsed
+			line, column := position(data, syntaxErr.Offset-1)
+			return cfg, fmt.Errorf("%s:%d:%d: %v", path, line, column, syntaxErr)
+		} else if errors.As(err, &typeErr) {
+			line, column := position(data, typeErr.Offset)
+			return cfg, fmt.Errorf("%s:%d:%d: %s must be of type %s, got %s", path, line, column, typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return cfg, fmt.Errorf("%s: %s", path, strings.TrimPrefix(err.Error(), "json: "))
+	}
+	if decoder.More() {
+		return cfg, fmt.Errorf("%s: unexpected data after the configuration object", path)
+	}
+	return cfg, nil
+}
+
+// position converts an offset into data to a line and column, from 1
+// Input: Data ([]byte), Offset (int64)
+// Output: Line (int), Column (int)
+func position(data []byte, offset int64) (int, int) {
+	offset = min(offset, int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// RegisterFlags defines a flag for each setting that can be given on the
+// command line, stored into cfg with its current values as defaults
+// Input: Flag set
+// Output: None
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&cfg.Port, "p", cfg.Port, "port for the server to listen to")
+	fs.StringVar(&cfg.Schema, "s", cfg.Schema, "file that contains JSON schema for validating documents")
+	fs.StringVar(&cfg.Tokens, "t", cfg.Tokens, "file that contains a JSON object mapping usernames to tokens")
+	fs.StringVar(&cfg.Users, "u", cfg.Users, "file that contains the users who log in with a password")
+	fs.StringVar(&cfg.DataDir, "d", cfg.DataDir, "directory where login sessions are saved across restarts")
+	fs.StringVar(&cfg.ACLs, "acl", cfg.ACLs, "file that contains groups and resource ACLs, defaults to acls.json in the data directory")
+	fs.StringVar(&cfg.Audit, "audit", cfg.Audit, "file where every change is recorded in a hash chained audit log")
+	fs.StringVar(&cfg.MetricsToken, "metrics-token", cfg.MetricsToken, "file that contains a bearer token that may scrape /metrics without being an admin")
+	fs.DurationVar(&cfg.DrainTimeout.Duration, "drain-timeout", cfg.DrainTimeout.Duration, "how long shutdown waits for requests in progress to finish")
+	fs.StringVar(&cfg.TLS.Cert, "cert", cfg.TLS.Cert, "certificate file for serving HTTPS, reloaded when it changes")
+	fs.StringVar(&cfg.TLS.Key, "key", cfg.TLS.Key, "key file of the certificate, reloaded when it changes")
+	fs.StringVar(&cfg.TLS.ClientCA, "client-ca", cfg.TLS.ClientCA, "file of CA certificates that client certificates are verified against")
+	fs.StringVar(&cfg.TLS.ClientAuth, "client-auth", cfg.TLS.ClientAuth, "client certificates: none, optional or require")
+	fs.Var(commaList{&cfg.CORS.Origins}, "cors-origins", "origins allowed to make requests from browsers, separated by commas, * for any")
+
+	fs.StringVar(&cfg.Auth.Mode, "auth-mode", cfg.Auth.Mode, "how tokens are issued: tokens or jwt")
+	fs.Var(jwtKeyFlag{cfg}, "jwt-key", "file that contains the key for issuing signed JWTs instead of stored tokens")
+	fs.DurationVar(&cfg.Auth.SessionTTL.Duration, "session-ttl", cfg.Auth.SessionTTL.Duration, "lifetime of tokens issued by login")
+	fs.DurationVar(&cfg.Auth.StaticTTL.Duration, "static-ttl", cfg.Auth.StaticTTL.Duration, "lifetime of tokens from the token file, 0 to never expire")
+	fs.BoolVar(&cfg.Auth.InsecureLogin, "insecure-login", cfg.Auth.InsecureLogin, "without a users file, let anyone log in with just a username")
+
+	fs.StringVar(&cfg.Limits.Rates.Reads, "rate-reads", cfg.Limits.Rates.Reads, "reads per second per user, as rate or rate:burst")
+	fs.StringVar(&cfg.Limits.Rates.Writes, "rate-writes", cfg.Limits.Rates.Writes, "writes per second per user, as rate or rate:burst")
+	fs.StringVar(&cfg.Limits.Rates.Subscriptions, "rate-subscriptions", cfg.Limits.Rates.Subscriptions, "subscriptions per second per user, as rate or rate:burst")
+	fs.StringVar(&cfg.Limits.Rates.Auth, "rate-auth", cfg.Limits.Rates.Auth, "auth requests per second per client address, as rate or rate:burst")
+	fs.Var(&cfg.Limits.MaxBody, "max-body", "largest request body in bytes, as bytes for every method or METHOD=bytes entries separated by commas")
+	fs.IntVar(&cfg.Limits.MaxDocSize, "max-doc-size", cfg.Limits.MaxDocSize, "largest document in bytes, 0 for no limit beyond the body limit")
+	fs.IntVar(&cfg.Limits.MaxDepth, "max-depth", cfg.Limits.MaxDepth, "deepest nesting of objects and arrays allowed in documents")
+
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "lowest level logged: debug, info, warn or error")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "log output format: text or json")
+	fs.BoolVar(&cfg.Log.Color, "log-color", cfg.Log.Color, "colorize text logs by level")
+	fs.StringVar(&cfg.Log.File, "log-file", cfg.Log.File, "file to write logs to instead of standard error")
+	fs.Int64Var(&cfg.Log.MaxSize, "log-max-size", cfg.Log.MaxSize, "rotate the log file before it grows past this many bytes, 0 for no limit")
+	fs.DurationVar(&cfg.Log.MaxAge.Duration, "log-max-age", cfg.Log.MaxAge.Duration, "rotate the log file once it is this old, 0 for no limit")
+	fs.IntVar(&cfg.Log.Backups, "log-backups", cfg.Log.Backups, "rotated log files to keep, 0 to keep all")
+	fs.IntVar(&cfg.Log.SampleFirst, "log-sample-first", cfg.Log.SampleFirst, "debug messages logged per message each interval before sampling")
+	fs.IntVar(&cfg.Log.SampleEvery, "log-sample-every", cfg.Log.SampleEvery, "after the first, log every this many debug messages, 0 to drop them; both 0 logs everything")
+	fs.DurationVar(&cfg.Log.SampleInterval.Duration, "log-sample-interval", cfg.Log.SampleInterval.Duration, "how often debug message sampling starts over")
+	fs.StringVar(&cfg.Log.AccessLog, "access-log", cfg.Log.AccessLog, "file to write a line per request to, - for standard output, rotated like -log-file")
+	fs.StringVar(&cfg.Log.AccessLogFormat, "access-log-format", cfg.Log.AccessLogFormat, "access log format: combined or json")
+}
+
+// Override applies the flags that were set on the command line to cfg, so
+// they take precedence over the configuration file
+// Input: Parsed flag set, Names of flags that are not settings (...string)
+// Output: Error if a flag value does not apply
+func (cfg *Config) Override(parsed *flag.FlagSet, skip ...string) error {
+	settings := flag.NewFlagSet("config", flag.ContinueOnError)
+	cfg.RegisterFlags(settings)
+
+	var err error
+	parsed.Visit(func(f *flag.Flag) {
+		if err != nil || slices.Contains(skip, f.Name) {
+			return
+		}
+		if setErr := settings.Set(f.Name, f.Value.String()); setErr != nil {
+			err = fmt.Errorf("-%s: %w", f.Name, setErr)
+		}
+	})
+	return err
+}
+
+// commaList is a flag holding a list written with commas between entries
+type commaList struct {
+	list *[]string
+}
+
+// String returns the list with commas between entries
+func (c commaList) String() string {
+	if c.list == nil {
+		return ""
+	}
+	return strings.Join(*c.list, ",")
+}
+
+// Set replaces the list
+func (c commaList) Set(value string) error {
+	*c.list = nil
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			*c.list = append(*c.list, entry)
+		}
+	}
+	return nil
+}
+
+// jwtKeyFlag is the -jwt-key flag, which also switches to JWT auth mode
+type jwtKeyFlag struct {
+	cfg *Config
+}
+
+// String returns the key file
+func (j jwtKeyFlag) String() string {
+	if j.cfg == nil {
+		return ""
+	}
+	return j.cfg.Auth.JWTKey
+}
+
+// Set sets the key file and switches to JWT auth mode
+func (j jwtKeyFlag) Set(path string) error {
+	j.cfg.Auth.JWTKey = path
+	if path != "" {
+		j.cfg.Auth.Mode = AuthJWT
+	}
+	return nil
+}
+
+// Validate checks the configuration, reporting every problem found rather
+// than only the first
+// Input: None
+// Output: Error listing the problems, nil if there are none
+func (cfg Config) Validate() error {
+	var errs []error
+	problem := func(field string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+	requireFile := func(field string, path string, required bool) {
+		if path == "" {
+			if required {
+				problem(field, "required")
+			}
+			return
+		}
+		if info, err := os.Stat(path); err != nil {
+			problem(field, "cannot read %q: %v", path, errors.Unwrap(err))
+		} else if info.IsDir() {
+			problem(field, "%q is a directory, not a file", path)
+		}
+	}
+
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		problem("port", "must be between 1 and 65535, got %d", cfg.Port)
+	}
+	requireFile("schema", cfg.Schema, true)
+	requireFile("tokens", cfg.Tokens, true)
+	requireFile("users", cfg.Users, false)
+	requireFile("metricsToken", cfg.MetricsToken, false)
+	if info, err := os.Stat(cfg.DataDir); cfg.DataDir != "" && err == nil && !info.IsDir() {
+		problem("dataDir", "%q is a file, not a directory", cfg.DataDir)
+	}
+	if cfg.DrainTimeout.Duration <= 0 {
+		problem("drainTimeout", "must be positive")
+	}
+
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		problem("tls", "cert and key must be given together")
+	}
+	requireFile("tls.cert", cfg.TLS.Cert, false)
+	requireFile("tls.key", cfg.TLS.Key, false)
+	switch cfg.TLS.ClientAuth {
+	case certs.ClientAuthNone:
+		if len(cfg.TLS.ClientUsers) > 0 {
+			problem("tls.clientUsers", "only used when tls.clientAuth is %q or %q", certs.ClientAuthOptional, certs.ClientAuthRequire)
+		}
+	case certs.ClientAuthOptional, certs.ClientAuthRequire:
+		if cfg.TLS.Cert == "" {
+			problem("tls.clientAuth", "requires tls.cert and tls.key")
+		}
+		requireFile("tls.clientCA", cfg.TLS.ClientCA, true)
+	default:
+		problem("tls.clientAuth", "must be %q, %q or %q, got %q", certs.ClientAuthNone, certs.ClientAuthOptional, certs.ClientAuthRequire, cfg.TLS.ClientAuth)
+	}
+
+	for _, origin := range cfg.CORS.Origins {
+		parsed, err := url.Parse(origin)
+		if origin != "*" && (err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || (parsed.Path != "" && parsed.Path != "/")) {
+			problem("cors.origins", "%q is not * or an origin such as https://example.com", origin)
+		}
+	}
+
+	switch cfg.Auth.Mode {
+	case AuthTokens:
+		if cfg.Auth.JWTKey != "" {
+			problem("auth.jwtKey", "only used when auth.mode is %q", AuthJWT)
+		}
+	case AuthJWT:
+		requireFile("auth.jwtKey", cfg.Auth.JWTKey, true)
+	default:
+		problem("auth.mode", "must be %q or %q, got %q", AuthTokens, AuthJWT, cfg.Auth.Mode)
+	}
+	if cfg.Auth.SessionTTL.Duration <= 0 {
+		problem("auth.sessionTTL", "must be positive")
+	}
+	if cfg.Auth.StaticTTL.Duration < 0 {
+		problem("auth.staticTTL", "must not be negative")
+	}
+	if cfg.Auth.InsecureLogin && cfg.Users != "" {
+		problem("auth.insecureLogin", "only used when there is no users file")
+	}
+
+	for method, limit := range cfg.Limits.MaxBody {
+		if limit < 0 {
+			problem("limits.maxBody", "limit for %s must not be negative", method)
+		}
+	}
+	if cfg.Limits.MaxDocSize < 0 {
+		problem("limits.maxDocSize", "must not be negative")
+	}
+	if cfg.Limits.MaxDepth < 1 {
+		problem("limits.maxDepth", "must be at least 1")
+	}
+	for class, rate := range cfg.rates() {
+		if _, err := ratelimit.ParseLimit(rate); err != nil {
+			problem("limits.rates."+class, "%v, use rate or rate:burst such as \"10:20\"", err)
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		problem("log.level", "must be debug, info, warn or error, got %q", cfg.Log.Level)
+	}
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		problem("log.format", "must be \"text\" or \"json\", got %q", cfg.Log.Format)
+	}
+	if cfg.Log.MaxSize < 0 || cfg.Log.MaxAge.Duration < 0 || cfg.Log.Backups < 0 {
+		problem("log", "maxSize, maxAge and backups must not be negative")
+	}
+	if cfg.Log.SampleFirst < 0 || cfg.Log.SampleEvery < 0 || cfg.Log.SampleInterval.Duration <= 0 {
+		problem("log", "sampleFirst and sampleEvery must not be negative and sampleInterval must be positive")
+	}
+	if cfg.Log.AccessLogFormat != handlers.AccessLogCombined && cfg.Log.AccessLogFormat != handlers.AccessLogJSON {
+		problem("log.accessLogFormat", "must be %q or %q, got %q", handlers.AccessLogCombined, handlers.AccessLogJSON, cfg.Log.AccessLogFormat)
+	}
+
+	return errors.Join(errs...)
+}
+
+// rates returns the rate limits by route class name
+// Input: None
+// Output: Map from route class to rate limit (string)
+func (cfg Config) rates() map[string]string {
+	return map[string]string{
+		handlers.RouteReads:         cfg.Limits.Rates.Reads,
+		handlers.RouteWrites:        cfg.Limits.Rates.Writes,
+		handlers.RouteSubscriptions: cfg.Limits.Rates.Subscriptions,
+		handlers.RouteAuth:          cfg.Limits.Rates.Auth,
+	}
+}
+
+// Redacted returns a copy of the configuration that is safe to show, with
+// the locations of secret keys hidden
+// Input: None
+// Output: Config
+func (cfg Config) Redacted() Config {
+	if cfg.TLS.Key != "" {
+		cfg.TLS.Key = redacted
+	}
+	if cfg.Auth.JWTKey != "" {
+		cfg.Auth.JWTKey = redacted
+	}
+	if cfg.MetricsToken != "" {
+		cfg.MetricsToken = redacted
+	}
+	cfg.TLS.ClientUsers = maps.Clone(cfg.TLS.ClientUsers)
+	cfg.CORS.Origins = slices.Clone(cfg.CORS.Origins)
+	cfg.Limits.MaxBody = maps.Clone(cfg.Limits.MaxBody)
+	return cfg
+}
+
+// Options converts the configuration to the options of the handlers. Log
+// output is left to the caller, which owns the files.
+// Input: None
+// Output: Options, error if a rate limit is malformed
+func (cfg Config) Options() (handlers.Options, error) {
+	rateLimits := make(map[string]ratelimit.Limit)
+	for class, rate := range cfg.rates() {
+		limit, err := ratelimit.ParseLimit(rate)
+		if err != nil {
+			return handlers.Options{}, err
+		}
+		rateLimits[class] = limit
+	}
+
+	jwtKey := ""
+	if cfg.Auth.Mode == AuthJWT {
+		jwtKey = cfg.Auth.JWTKey
+	}
+
+	return handlers.Options{
+		SchemaFile: cfg.Schema,
+		TokenFile:  cfg.Tokens,
+		UsersFile:  cfg.Users,
+		DataDir:    cfg.DataDir,
+		ACLFile:    cfg.ACLs,
+		JWTKeyFile: jwtKey,
+		AuditFile:  cfg.Audit,
+
+		MetricsTokenFile: cfg.MetricsToken,
+
+		AccessLogFormat: cfg.Log.AccessLogFormat,
+		CORSOrigins:     slices.Clone(cfg.CORS.Origins),
+		EffectiveConfig: cfg.Redacted(),
+
+		ClientCertAuth:  cfg.TLS.ClientAuth == certs.ClientAuthOptional || cfg.TLS.ClientAuth == certs.ClientAuthRequire,
+		ClientCertUsers: maps.Clone(cfg.TLS.ClientUsers),
+
+		InsecureLogin:       cfg.Auth.InsecureLogin,
+		SessionLifetime:     cfg.Auth.SessionTTL.Duration,
+		StaticTokenLifetime: cfg.Auth.StaticTTL.Duration,
+		RateLimits:          rateLimits,
+		MaxBodySize:         maps.Clone(cfg.Limits.MaxBody),
+		DocumentLimits:      storage.DocumentLimits{MaxSize: cfg.Limits.MaxDocSize, MaxDepth: cfg.Limits.MaxDepth},
+	}, nil
+}
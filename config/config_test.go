@@ -0,0 +1,163 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes a file in a temporary directory and returns its path
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeFile(t, "owldb.json", `{
+		"port": 4000,
+		"schema": "schema.json",
+		"auth": {"sessionTTL": "30m"},
+		"limits": {"maxBody": {"*": 2048, "PATCH": 512}, "rates": {"writes": "5:10"}},
+		"log": {"format": "json"}
+	}`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 4000 || cfg.Schema != "schema.json" || cfg.Auth.SessionTTL.Duration != 30*time.Minute {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+	if cfg.Limits.MaxBody["PATCH"] != 512 || cfg.Limits.Rates.Writes != "5:10" || cfg.Log.Format != "json" {
+		t.Errorf("Unexpected limits or logging: %+v", cfg)
+	}
+	// Left out settings keep their defaults
+	if cfg.Log.Level != "info" || cfg.Limits.MaxDepth != Default().Limits.MaxDepth || cfg.Auth.Mode != AuthTokens {
+		t.Errorf("Expected defaults for missing settings: %+v", cfg)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := map[string]string{
+		`{"prot": 1}`:                       `unknown field "prot"`,
+		"{\n  \"port\": \"80\"\n}":          "owldb.json:2:",
+		"{\n  \"port\": 80,\n}":             ":3:1: invalid character",
+		`{"auth": {"sessionTTL": 60}}`:      `must be a string such as "24h"`,
+		`{"auth": {"sessionTTL": "1 day"}}`: `invalid duration "1 day"`,
+	}
+	for content, expected := range tests {
+		_, err := Load(writeFile(t, "owldb.json", content))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error containing %q for %s, got %v", expected, content, err)
+		}
+	}
+}
+
+func TestOverride(t *testing.T) {
+	// Flags are parsed into a separate config, as in main
+	flagConfig := Default()
+	fs := flag.NewFlagSet("owldb", flag.ContinueOnError)
+	configFile := fs.String("c", "", "")
+	flagConfig.RegisterFlags(fs)
+	err := fs.Parse([]string{"-c", "owldb.json", "-p", "5000", "-max-body", "100,PUT=200", "-jwt-key", "key.pem", "-cors-origins", "https://a.example, https://b.example"})
+	if err != nil || *configFile != "owldb.json" {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	cfg := Default()
+	cfg.Port = 4000
+	cfg.Schema = "schema.json"
+	if err := cfg.Override(fs, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 5000 || cfg.Schema != "schema.json" {
+		t.Errorf("Expected flags to override only what they set: %+v", cfg)
+	}
+	if cfg.Limits.MaxBody["*"] != 100 || cfg.Limits.MaxBody["PUT"] != 200 {
+		t.Errorf("Unexpected body limits: %v", cfg.Limits.MaxBody)
+	}
+	if cfg.Auth.Mode != AuthJWT || cfg.Auth.JWTKey != "key.pem" {
+		t.Errorf("Expected -jwt-key to switch to JWT mode: %+v", cfg.Auth)
+	}
+	if len(cfg.CORS.Origins) != 2 || cfg.CORS.Origins[1] != "https://b.example" {
+		t.Errorf("Unexpected CORS origins: %v", cfg.CORS.Origins)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Schema = writeFile(t, "schema.json", "{}")
+	cfg.Tokens = writeFile(t, "tokens.json", "{}")
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+
+	cfg.Port = 70000
+	cfg.Tokens = ""
+	cfg.TLS.Cert = cfg.Schema
+	cfg.CORS.Origins = []string{"app.example.com"}
+	cfg.Auth.Mode = AuthJWT
+	cfg.Limits.Rates.Reads = "fast"
+	cfg.Log.Format = "xml"
+	cfg.DrainTimeout = Duration{}
+	cfg.Users = cfg.Schema
+	cfg.Auth.InsecureLogin = true
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected invalid config")
+	}
+	for _, expected := range []string{"port:", "tokens: required", "tls: cert and key", "cors.origins:", "auth.jwtKey: required", "limits.rates.reads:", "log.format:", "drainTimeout:", "auth.insecureLogin:"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected a problem with %q, got:\n%v", expected, err)
+		}
+	}
+}
+
+func TestValidate_ClientAuth(t *testing.T) {
+	cfg := Default()
+	cfg.Schema = writeFile(t, "schema.json", "{}")
+	cfg.Tokens = writeFile(t, "tokens.json", "{}")
+	cfg.TLS.ClientUsers = map[string]string{"ci-runner": "ci"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "tls.clientUsers:") {
+		t.Errorf("Expected client users to need client certificates, got %v", err)
+	}
+
+	cfg.TLS.ClientAuth = "require"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "tls.clientAuth: requires tls.cert") || !strings.Contains(err.Error(), "tls.clientCA:") {
+		t.Errorf("Expected client certificates to need a certificate and CA, got %v", err)
+	}
+
+	cfg.TLS.Cert, cfg.TLS.Key = cfg.Schema, cfg.Schema
+	cfg.TLS.ClientCA = cfg.Schema
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+	opts, err := cfg.Options()
+	if err != nil || !opts.ClientCertAuth || opts.ClientCertUsers["ci-runner"] != "ci" {
+		t.Errorf("Expected client certificate options, got %+v, %v", opts, err)
+	}
+
+	cfg.TLS.ClientAuth = "sometimes"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "tls.clientAuth: must be") {
+		t.Errorf("Expected an unknown mode to be rejected, got %v", err)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Default()
+	cfg.TLS = TLS{Cert: "cert.pem", Key: "key.pem"}
+	cfg.Auth.JWTKey = "jwt.key"
+	cfg.MetricsToken = "metrics.token"
+	shown := cfg.Redacted()
+	if shown.TLS.Key != redacted || shown.Auth.JWTKey != redacted || shown.MetricsToken != redacted || shown.TLS.Cert != "cert.pem" {
+		t.Errorf("Unexpected redacted config: %+v", shown)
+	}
+	if cfg.TLS.Key != "key.pem" {
+		t.Errorf("Redacting should not change the original")
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/RICE-COMP318-FALL24/owldb-p1group35
 
-go 1.23.0
+go 1.24.0
 
 require github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
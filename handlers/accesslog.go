@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	AccessLogCombined = "combined" // Apache combined log format with extra fields
+	AccessLogJSON     = "json"     // One JSON object per line
+)
+
+// combinedTimeFormat is the timestamp format of the combined log format
+const combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessRecordKey is the context key of a request's accessRecord
+type accessRecordKey struct{}
+
+// accessRecord collects what the handlers learn about a request that the
+// access log middleware cannot see for itself
+type accessRecord struct {
+	mu           sync.Mutex
+	user         string
+	subscription bool
+}
+
+// accessEntry is one line of the access log in JSON format
+type accessEntry struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"requestID,omitempty"`
+	RemoteAddr   string    `json:"remoteAddr"`
+	User         string    `json:"user,omitempty"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Protocol     string    `json:"protocol"`
+	Status       int       `json:"status"`
+	Bytes        int64     `json:"bytes"`
+	Duration     float64   `json:"durationSeconds"`
+	Subscription bool      `json:"subscription"`
+	Referer      string    `json:"referer,omitempty"`
+	UserAgent    string    `json:"userAgent,omitempty"`
+}
+
+// accessRecorder remembers the status code and counts the bytes written to
+// a response
+type accessRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+// WriteHeader records the status code and writes it to the response
+// Input: Status code (int)
+// Output: None
+func (rec *accessRecorder) WriteHeader(code int) {
+	if rec.code == 0 {
+		rec.code = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// Write counts the bytes written to the response
+// Input: Bytes to write ([]byte)
+// Output: Bytes written (int), error if any
+func (rec *accessRecorder) Write(p []byte) (int, error) {
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends buffered data to the client, if the response supports it
+// Input: None
+// Output: None
+func (rec *accessRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over to the caller, as WebSocket upgrades
+// require. Bytes written afterwards are not counted.
+// Input: None
+// Output: Connection, buffered reader and writer, error if unsupported
+func (rec *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	if rec.code == 0 {
+		rec.code = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the response being recorded, for http.ResponseController
+// Input: None
+// Output: HTTP response writer
+func (rec *accessRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// noteUser records the authenticated user of a request for the access log
+// Input: HTTP request, Username (string)
+// Output: None
+func noteUser(r *http.Request, user string) {
+	if record, ok := r.Context().Value(accessRecordKey{}).(*accessRecord); ok {
+		record.mu.Lock()
+		record.user = user
+		record.mu.Unlock()
+	}
+}
+
+// noteSubscription records that a request is a long-lived subscription, so
+// its duration in the access log is the life of the subscription
+// Input: HTTP request
+// Output: None
+func noteSubscription(r *http.Request) {
+	if record, ok := r.Context().Value(accessRecordKey{}).(*accessRecord); ok {
+		record.mu.Lock()
+		record.subscription = true
+		record.mu.Unlock()
+	}
+}
+
+// WithAccessLog wraps a handler so a line is written to out for every
+// request once it completes, in the combined or JSON format. Requests should
+// already carry an ID, see WithRequestID. A nil writer disables the log.
+// Input: HTTP handler, Writer (io.Writer), Format (string)
+// Output: HTTP handler
+func WithAccessLog(next http.Handler, out io.Writer, format string) http.Handler {
+	if out == nil {
+		return next
+	}
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		record := &accessRecord{}
+		r = r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, record))
+		rec := &accessRecorder{ResponseWriter: w}
+
+		defer func() {
+			if rec.code == 0 {
+				rec.code = http.StatusOK
+			}
+			record.mu.Lock()
+			entry := accessEntry{
+				Time:         start,
+				RequestID:    requestID(r),
+				RemoteAddr:   r.RemoteAddr,
+				User:         record.user,
+				Method:       r.Method,
+				Path:         loggedURI(r.URL),
+				Protocol:     r.Proto,
+				Status:       rec.code,
+				Bytes:        rec.bytes,
+				Duration:     time.Since(start).Seconds(),
+				Subscription: record.subscription,
+				Referer:      r.Referer(),
+				UserAgent:    r.UserAgent(),
+			}
+			record.mu.Unlock()
+
+			line := formatAccessEntry(entry, format)
+			mu.Lock()
+			_, err := io.WriteString(out, line)
+			mu.Unlock()
+			if err != nil {
+				slog.Error("Failed to write access log", "error", err)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// formatAccessEntry formats an access log line, ending in a newline
+// Input: Access log entry, Format (string)
+// Output: Line (string)
+func formatAccessEntry(entry accessEntry, format string) string {
+	if format == AccessLogJSON {
+		encoded, _ := json.Marshal(entry)
+		return string(encoded) + "\n"
+	}
+
+	host, _, err := net.SplitHostPort(entry.RemoteAddr)
+	if err != nil {
+		host = entry.RemoteAddr
+	}
+	return fmt.Sprintf("%s - %s [%s] %s %d %d %s %s %.6f subscription=%t request_id=%s\n",
+		orDash(host), orDash(entry.User), entry.Time.Format(combinedTimeFormat),
+		quoteField(entry.Method+" "+entry.Path+" "+entry.Protocol), entry.Status, entry.Bytes,
+		quoteField(orDash(entry.Referer)), quoteField(orDash(entry.UserAgent)),
+		entry.Duration, entry.Subscription, orDash(entry.RequestID))
+}
+
+// loggedURI returns the path and query of a request URL for logs, with the
+// token query parameter that WebSocket clients may authenticate with
+// replaced, so bearer tokens are never written to disk
+// Input: Request URL
+// Output: Path and query (string)
+func loggedURI(u *url.URL) string {
+	query := u.Query()
+	if !query.Has("token") {
+		return u.RequestURI()
+	}
+	query.Set("token", "REDACTED")
+	return u.EscapedPath() + "?" + query.Encode()
+}
+
+// orDash returns "-" in place of an empty field, as the combined format does
+// Input: Field (string)
+// Output: Field or "-" (string)
+func orDash(field string) string {
+	if field == "" {
+		return "-"
+	}
+	return field
+}
+
+// quoteField quotes a field of the combined format, escaping quotes and
+// backslashes so a client cannot break up the line
+// Input: Field (string)
+// Output: Quoted field (string)
+func quoteField(field string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(field)
+	return `"` + escaped + `"`
+}
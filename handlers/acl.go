@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/acl"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/storage"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/subscription"
+)
+
+// errPermissionDenied is returned when an ACL does not allow a request
+var errPermissionDenied = errors.New("permission denied")
+
+// aclResponse describes the ACL attached to a resource
+type aclResponse struct {
+	Path string   `json:"path"`
+	ACL  *acl.ACL `json:"acl"`
+}
+
+// permission returns a user's permission on a resource. Admin users from
+// the users file have full access everywhere.
+// Input: Username (string), Resource path (string)
+// Output: Permission
+func (owldb *owldb) permission(user string, resource string) acl.Permission {
+	if owldb.credentials != nil && owldb.credentials.isAdmin(user) {
+		return acl.Admin
+	}
+	return owldb.acls.Permission(user, resource)
+}
+
+// access returns the permission a token grants on a resource: the user's
+// permission, limited by the token's scopes
+// Input: Token entry (authEntry), Resource path (string)
+// Output: Permission
+func (owldb *owldb) access(entry authEntry, resource string) acl.Permission {
+	return min(owldb.permission(entry.username, resource), scopeLimit(entry.scopes, resource))
+}
+
+// readableDocuments removes the documents a token may not read from the
+// result of a collection or database GET
+// Input: Token entry (authEntry), Result of a GET operation
+// Output: Filtered result
+func (owldb *owldb) readableDocuments(entry authEntry, result any) any {
+	docs, ok := result.([]storage.DocumentContent)
+	if !ok {
+		return result
+	}
+	readable := make([]storage.DocumentContent, 0, len(docs))
+	for _, doc := range docs {
+		if owldb.access(entry, doc.Path) >= acl.Read {
+			readable = append(readable, doc)
+		}
+	}
+	return readable
+}
+
+// eventFilter returns a check that only passes events for resources the
+// token may read, so subscriptions never reveal hidden documents
+// Input: Token entry (authEntry)
+// Output: Event filter function
+func (owldb *owldb) eventFilter(entry authEntry) func(subscription.Event) bool {
+	return func(event subscription.Event) bool {
+		return owldb.access(entry, event.Path) >= acl.Read
+	}
+}
+
+// canManage checks that a token may read or change the ACL or policy of a
+// resource. Under an ACL this takes admin permission. A resource no ACL
+// protects yet is open to everyone, so only its creator or an admin user
+// from the users file may change it, which keeps other users from locking
+// the creator out.
+// Input: Token entry (authEntry), Resource path (string), HTTP method (string)
+// Output: HTTP status code, error if the token may not
+func (owldb *owldb) canManage(entry authEntry, resource string, method string) (int, error) {
+	if owldb.access(entry, resource) < acl.Admin {
+		return http.StatusForbidden, errPermissionDenied
+	}
+	if method == "GET" || owldb.acls.Protected(resource) || (owldb.credentials != nil && owldb.credentials.isAdmin(entry.username)) {
+		return http.StatusOK, nil
+	}
+	path := strings.Split(strings.TrimSuffix(strings.TrimPrefix(resource, "/v1/"), "/"), "/")
+	creator, err := owldb.storage.Creator(path)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	if creator != entry.username {
+		return http.StatusForbidden, errPermissionDenied
+	}
+	return http.StatusOK, nil
+}
+
+// HandleACL reads (GET), replaces (PUT) or removes (DELETE) the ACL attached
+// to a resource, for requests on a /v1 path with mode=acl. The user needs
+// admin permission on the resource, see canManage.
+// Input: HTTP response writer, request and the request body
+// Output: None
+func (owldb *owldb) HandleACL(w http.ResponseWriter, r *http.Request, requestBody []byte) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		allowedMethods := "GET, PUT, DELETE"
+		w.Header().Set("Allow", allowedMethods)
+		w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	resource, err := acl.Normalize(r.URL.Path)
+	if err != nil {
+		encodederr, _ := json.Marshal("bad request path")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(encodederr)
+		return
+	}
+
+	authToken, err := owldb.bearerToken(r)
+	if err != nil {
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(encodederr)
+		return
+	}
+	entry, err := owldb.lookupToken(authToken)
+	if err != nil {
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(encodederr)
+		return
+	}
+	if !owldb.limitRequest(w, storageRouteClass(r.Method, false), entry.username) {
+		return
+	}
+	if statusCode, err := owldb.canManage(entry, resource, r.Method); err != nil {
+		slog.Warn("ACL change denied", "username", entry.username, "resource", resource, "error", err)
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(statusCode)
+		w.Write(encodederr)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		entry, ok := owldb.acls.Get(resource)
+		response := aclResponse{Path: resource}
+		if ok {
+			response.ACL = &entry
+		}
+		writeJSON(w, http.StatusOK, response)
+	case "PUT":
+		var entry acl.ACL
+		if err := json.Unmarshal(requestBody, &entry); err != nil {
+			encodederr, _ := json.Marshal("acl in incorrect format")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(encodederr)
+			return
+		}
+		if err := owldb.acls.Set(resource, entry); err != nil {
+			slog.Error("Failed to save ACL", "resource", resource, "error", err)
+			encodederr, _ := json.Marshal("failed to save acl")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(encodederr)
+			return
+		}
+		slog.Info("ACL updated", "resource", resource)
+		writeJSON(w, http.StatusOK, aclResponse{Path: resource, ACL: &entry})
+	case "DELETE":
+		removed, err := owldb.acls.Delete(resource)
+		if err != nil {
+			slog.Error("Failed to save ACL", "resource", resource, "error", err)
+			encodederr, _ := json.Marshal("failed to save acl")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(encodederr)
+			return
+		}
+		if !removed {
+			encodederr, _ := json.Marshal("resource has no acl")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(encodederr)
+			return
+		}
+		slog.Info("ACL removed", "resource", resource)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		encodederr, _ := json.Marshal("bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(encodederr)
+	}
+}
@@ -0,0 +1,404 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// userRequest is the body of a request creating or updating a password user
+type userRequest struct {
+	Password string `json:"password"`
+	Admin    bool   `json:"admin"`
+}
+
+// sessionInfo describes an active token without revealing it. The ID is the
+// token's hash.
+type sessionInfo struct {
+	ID        string     `json:"id"`
+	Username  string     `json:"username"`
+	Kind      string     `json:"kind"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Scopes    []string   `json:"scopes,omitempty"`
+}
+
+// serviceTokenRequest is the body of a request creating a service token
+type serviceTokenRequest struct {
+	Username string   `json:"username"`
+	Scopes   []string `json:"scopes"`
+	TTL      string   `json:"ttl"`
+}
+
+// serviceTokenResponse returns a new service token, the only time it is shown
+type serviceTokenResponse struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Scopes    []string  `json:"scopes"`
+}
+
+// writeJSON encodes a value as the JSON response body with the given status
+// Input: HTTP response writer, Status code (int), Value (any)
+// Output: None
+func writeJSON(w http.ResponseWriter, statusCode int, value any) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		slog.Error("Failed to encode response", "error", err)
+		encoded, _ = json.Marshal("failed to encode response")
+		statusCode = http.StatusInternalServerError
+	}
+	w.WriteHeader(statusCode)
+	w.Write(encoded)
+}
+
+// requireAdmin authorizes the request and checks that its user is an admin.
+// Service tokens issued for an admin also need the unrestricted admin scope,
+// so their scopes cannot be bypassed through the /admin endpoints.
+// Input: HTTP request
+// Output: Username, HTTP status code and error if the user is not an admin
+func (owldb *owldb) requireAdmin(r *http.Request) (string, int, error) {
+	authToken, err := owldb.bearerToken(r)
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	entry, err := owldb.lookupToken(authToken)
+	if err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	user := entry.username
+	if owldb.credentials == nil || !owldb.credentials.isAdmin(user) {
+		slog.Warn("Admin access denied", "username", user)
+		return "", http.StatusForbidden, fmt.Errorf("admin access required")
+	}
+	if entry.service && !adminScope(entry.scopes) {
+		slog.Warn("Admin access denied to service token without the admin scope", "username", user)
+		return "", http.StatusForbidden, fmt.Errorf("admin access required")
+	}
+	return user, http.StatusOK, nil
+}
+
+// revokeUserTokens invalidates every token issued to a user and ends their
+// subscriptions
+// Input: Username (string)
+// Output: Number of tokens revoked (int)
+func (owldb *owldb) revokeUserTokens(username string) int {
+	owldb.mu.Lock()
+	revoked := 0
+	for tokenHash, entry := range owldb.tokenToUser {
+		if entry.username == username {
+			delete(owldb.tokenToUser, tokenHash)
+			revoked++
+		}
+	}
+	if revoked > 0 {
+		owldb.saveSessions()
+	}
+	// JWTs are not stored, so revoke every one issued to the user so far
+	if owldb.jwtKey != nil {
+		owldb.revokeUserJWTs(username)
+	}
+	owldb.mu.Unlock()
+
+	// The count only covers stored tokens, so recheck for revoked JWTs too
+	if revoked > 0 || owldb.jwtKey != nil {
+		owldb.subscription.Recheck()
+	}
+	slog.Info("Revoked user tokens", "username", username, "count", revoked)
+	return revoked
+}
+
+// HandleAdminUsers manages the users who log in with a password.
+//
+//	GET    /admin/users         lists users
+//	PUT    /admin/users/<name>  creates a user or replaces their password
+//	DELETE /admin/users/<name>  removes a user and revokes their tokens
+//
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		allowedMethods := "GET, PUT, DELETE"
+		w.Header().Set("Allow", allowedMethods)
+		w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	admin, statusCode, err := owldb.requireAdmin(r)
+	if err != nil {
+		writeJSON(w, statusCode, err.Error())
+		return
+	}
+
+	username := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/users"), "/")
+
+	switch {
+	case r.Method == "GET" && username == "":
+		writeJSON(w, http.StatusOK, owldb.credentials.list())
+	case r.Method == "PUT" && username != "":
+		requestBody, err := owldb.readBody(w, r)
+		if err != nil {
+			writeJSON(w, bodyErrorStatus(err), err.Error())
+			return
+		}
+		var userReq userRequest
+		if err := json.Unmarshal(requestBody, &userReq); err != nil || userReq.Password == "" {
+			writeJSON(w, http.StatusBadRequest, "user request body must contain a password")
+			return
+		}
+		existed, err := owldb.credentials.setPassword(username, userReq.Password, userReq.Admin)
+		if err != nil {
+			slog.Error("Failed to save user", "username", username, "error", err)
+			writeJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		slog.Info("User saved", "username", username, "admin", userReq.Admin, "by", admin)
+		if existed {
+			writeJSON(w, http.StatusOK, userInfo{Username: username, Admin: userReq.Admin})
+		} else {
+			writeJSON(w, http.StatusCreated, userInfo{Username: username, Admin: userReq.Admin})
+		}
+	case r.Method == "DELETE" && username != "":
+		if err := owldb.credentials.remove(username); err != nil {
+			writeJSON(w, http.StatusNotFound, err.Error())
+			return
+		}
+		owldb.revokeUserTokens(username)
+		slog.Info("User removed", "username", username, "by", admin)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusBadRequest, "bad request")
+	}
+}
+
+// listSessions describes the unexpired tokens, optionally of one user only
+// Input: Username (string), empty for every user
+// Output: Slice of sessionInfo sorted by username
+func (owldb *owldb) listSessions(username string) []sessionInfo {
+	owldb.mu.RLock()
+	defer owldb.mu.RUnlock()
+
+	now := time.Now()
+	sessions := make([]sessionInfo, 0, len(owldb.tokenToUser))
+	for tokenHash, entry := range owldb.tokenToUser {
+		if entry.expired(now) || (username != "" && entry.username != username) {
+			continue
+		}
+		info := sessionInfo{ID: tokenHash, Username: entry.username, Kind: "login", Scopes: scopeStrings(entry.scopes)}
+		if entry.static {
+			info.Kind = "static"
+		} else if entry.service {
+			info.Kind = "service"
+		}
+		if !entry.expiration.IsZero() {
+			expiration := entry.expiration
+			info.ExpiresAt = &expiration
+		}
+		sessions = append(sessions, info)
+	}
+	slices.SortFunc(sessions, func(a, b sessionInfo) int {
+		if c := strings.Compare(a.Username, b.Username); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return sessions
+}
+
+// revokeSession invalidates a single token by its ID and ends its
+// subscriptions. In JWT mode an unknown ID is added to the revocation list if
+// it is the ID of a token this server could have issued that has not yet
+// expired.
+// Input: Session ID (string)
+// Output: Boolean indicating if the token existed or was added to the revocation list
+func (owldb *owldb) revokeSession(id string) bool {
+	owldb.mu.Lock()
+	_, exists := owldb.tokenToUser[id]
+	if exists {
+		delete(owldb.tokenToUser, id)
+		owldb.saveSessions()
+	} else if owldb.jwtKey != nil {
+		issued, err := parseJWTID(id)
+		now := time.Now()
+		if err == nil && !issued.After(now) && now.Before(issued.Add(owldb.maxJWTLifetime())) {
+			owldb.revokeJWT(id, issued.Add(owldb.maxJWTLifetime()))
+			exists = true
+		}
+	}
+	owldb.mu.Unlock()
+
+	if exists {
+		owldb.subscription.Recheck()
+	}
+	return exists
+}
+
+// createServiceToken issues a token for a service account, limited to the
+// given scopes
+// Input: Service token request
+// Output: serviceTokenResponse, error if the request is invalid
+func (owldb *owldb) createServiceToken(tokenReq serviceTokenRequest) (*serviceTokenResponse, error) {
+	if tokenReq.Username == "" {
+		return nil, fmt.Errorf("service token request must contain a username")
+	}
+	if len(tokenReq.Scopes) == 0 {
+		return nil, fmt.Errorf("service token request must contain at least one scope")
+	}
+	scopes, err := parseScopes(tokenReq.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	lifetime := owldb.sessionLifetime
+	if tokenReq.TTL != "" {
+		lifetime, err = time.ParseDuration(tokenReq.TTL)
+		if err != nil || lifetime <= 0 {
+			return nil, fmt.Errorf("invalid ttl %q", tokenReq.TTL)
+		}
+	}
+
+	if owldb.jwtKey != nil {
+		// Longer lived tokens could outlast their user's revocation
+		if lifetime > owldb.maxJWTLifetime() {
+			return nil, fmt.Errorf("ttl %q exceeds the maximum of %s", tokenReq.TTL, owldb.maxJWTLifetime())
+		}
+		owldb.mu.Lock()
+		token, id, expiration, err := owldb.issueJWT(tokenReq.Username, scopes, lifetime)
+		owldb.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return &serviceTokenResponse{ID: id, Token: token, ExpiresAt: expiration, Scopes: scopeStrings(scopes)}, nil
+	}
+
+	owldb.mu.Lock()
+	defer owldb.mu.Unlock()
+
+	token := generateToken()
+	_, tokenExists := owldb.tokenToUser[hashToken(token)]
+	for tokenExists {
+		token = generateToken()
+		_, tokenExists = owldb.tokenToUser[hashToken(token)]
+	}
+	expiration := time.Now().Add(lifetime)
+	owldb.tokenToUser[hashToken(token)] = authEntry{username: tokenReq.Username, expiration: expiration, service: true, scopes: scopes}
+	owldb.saveSessions()
+
+	return &serviceTokenResponse{ID: hashToken(token), Token: token, ExpiresAt: expiration, Scopes: scopeStrings(scopes)}, nil
+}
+
+// HandleAdminSessions manages active tokens.
+//
+//	GET    /admin/sessions[?user=<name>]  lists tokens, optionally of one user
+//	DELETE /admin/sessions/<id>           revokes one token
+//	DELETE /admin/sessions?user=<name>    revokes every token of a user
+//
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		allowedMethods := "GET, DELETE"
+		w.Header().Set("Allow", allowedMethods)
+		w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	admin, statusCode, err := owldb.requireAdmin(r)
+	if err != nil {
+		writeJSON(w, statusCode, err.Error())
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/sessions"), "/")
+	username := r.URL.Query().Get("user")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		writeJSON(w, http.StatusOK, owldb.listSessions(username))
+	case r.Method == "DELETE" && id != "":
+		if !owldb.revokeSession(id) {
+			writeJSON(w, http.StatusNotFound, "session not found")
+			return
+		}
+		slog.Info("Session revoked", "by", admin)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE" && username != "":
+		revoked := owldb.revokeUserTokens(username)
+		slog.Info("User sessions revoked", "username", username, "by", admin)
+		writeJSON(w, http.StatusOK, map[string]int{"revoked": revoked})
+	default:
+		writeJSON(w, http.StatusBadRequest, "bad request")
+	}
+}
+
+// HandleAdminTokens creates service tokens and reloads the token file.
+//
+//	POST /admin/tokens         creates a service token with the given scopes
+//	POST /admin/tokens/reload  reloads the token file given with -t
+//
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleAdminTokens(w http.ResponseWriter, r *http.Request) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "POST")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	admin, statusCode, err := owldb.requireAdmin(r)
+	if err != nil {
+		writeJSON(w, statusCode, err.Error())
+		return
+	}
+
+	action := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/tokens"), "/")
+
+	switch {
+	case r.Method == "POST" && action == "":
+		requestBody, err := owldb.readBody(w, r)
+		if err != nil {
+			writeJSON(w, bodyErrorStatus(err), err.Error())
+			return
+		}
+		var tokenReq serviceTokenRequest
+		if err := json.Unmarshal(requestBody, &tokenReq); err != nil {
+			writeJSON(w, http.StatusBadRequest, "service token request body in incorrect format")
+			return
+		}
+		tokenResp, err := owldb.createServiceToken(tokenReq)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		slog.Info("Service token created", "username", tokenReq.Username, "scopes", tokenResp.Scopes, "by", admin)
+		writeJSON(w, http.StatusCreated, tokenResp)
+	case r.Method == "POST" && action == "reload":
+		loaded, err := owldb.reloadTokenFile()
+		if err != nil {
+			slog.Error("Failed to reload token file", "error", err)
+			writeJSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		slog.Info("Token file reloaded", "by", admin)
+		writeJSON(w, http.StatusOK, map[string]int{"tokens": loaded})
+	default:
+		writeJSON(w, http.StatusBadRequest, "bad request")
+	}
+}
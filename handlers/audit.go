@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/audit"
+)
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+// WriteHeader records the status code and writes it to the response
+// Input: Status code (int)
+// Output: None
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.code = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// Flush sends buffered data to the client, if the response supports it
+// Input: None
+// Output: None
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the response being recorded, for http.ResponseController
+// Input: None
+// Output: HTTP response writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// isMutation reports whether requests with the given method change state
+// Input: HTTP method (string)
+// Output: Boolean
+func isMutation(method string) bool {
+	return method == "PUT" || method == "POST" || method == "PATCH" || method == "DELETE"
+}
+
+// auditUser returns the user authorized by the request's bearer token, or an
+// empty string if there is none
+// Input: HTTP request
+// Output: Username (string)
+func (owldb *owldb) auditUser(r *http.Request) string {
+	token, err := owldb.bearerToken(r)
+	if err != nil {
+		return ""
+	}
+	username, err := owldb.authorize(token)
+	if err != nil {
+		return ""
+	}
+	return username
+}
+
+// recordAudit appends a request to the audit log. Requests that never
+// reached storage are recorded with the text of their HTTP status as the
+// status class, as given by statusClassOf.
+// Input: Username, HTTP request, status code, storage status class, content
+// Output: None
+func (owldb *owldb) recordAudit(username string, r *http.Request, code int, statusClass string, content []byte) {
+	if owldb.audit == nil {
+		return
+	}
+	err := owldb.audit.Record(audit.Entry{
+		Username:    username,
+		Method:      r.Method,
+		Path:        loggedURI(r.URL),
+		Status:      code,
+		StatusClass: statusClassOf(code, statusClass),
+		ContentHash: audit.HashContent(content),
+	})
+	if err != nil {
+		slog.Error("Failed to write audit entry", "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+}
@@ -1,52 +1,116 @@
 package handlers
 
 import (
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
-	"math/rand"
 	"net/http"
 	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/jwt"
 )
 
+// authEntry is a valid token, stored in tokenToUser under the token's hash.
+// Static entries come from the token file and are not saved with sessions.
+// Service entries are tokens created by an admin, limited to their scopes.
+// In JWT mode entries are built from a verified token's claims instead of
+// being stored, and jwtID holds the token's ID.
+// A zero expiration means the token never expires.
 type authEntry struct {
 	username   string
 	expiration time.Time
+	static     bool
+	service    bool
+	scopes     []tokenScope
+	jwtID      string
+}
+
+// expired reports whether the token is no longer valid at the given time
+// Input: Current time (time.Time)
+// Output: True if the token has expired
+func (entry authEntry) expired(now time.Time) bool {
+	return !entry.expiration.IsZero() && now.After(entry.expiration)
 }
 
 // Login request structure
 type loginRequest struct {
-	Token string `json:"token"`
+	Token     string     `json:"token"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
 }
 
+// DefaultSessionLifetime is how long login tokens last when not configured
+const DefaultSessionLifetime = time.Hour
+
+// noExpiryRecheck is how often subscriptions using a token that never
+// expires check whether it has been revoked
+const noExpiryRecheck = time.Hour
+
 // generateToken generates a random token string
 // Input: None
-// Output: Randomly generated token string
+// Output: Cryptographically random token string
 func generateToken() string {
-	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	token := make([]byte, 16)
-	for i := range token {
-		token[i] = letters[rand.Intn(len(letters))]
-	}
-	return string(token)
+	return rand.Text() + rand.Text()
 }
 
 // authorize checks if the provided token is valid and not expired
 // Input: token string
 // Output: username if authorized, error if unauthorized
 func (owldb *owldb) authorize(token string) (string, error) {
+	entry, err := owldb.lookupToken(token)
+	if err != nil {
+		return "", err
+	}
+	return entry.username, nil
+}
+
+// lookupToken returns the entry of a valid, unexpired token
+// Input: token string
+// Output: authEntry if authorized, error if unauthorized
+func (owldb *owldb) lookupToken(token string) (authEntry, error) {
 	owldb.mu.RLock()
 	defer owldb.mu.RUnlock()
-	slog.Info("tokenToUser", "tokenToUser", owldb.tokenToUser)
-	user, ok := owldb.tokenToUser[token]
-	if !ok || time.Now().After(user.expiration) {
-		return "", fmt.Errorf("missing or invalid bearer token")
+	if owldb.jwtKey != nil && jwt.LooksLikeToken(token) {
+		return owldb.verifyJWT(token)
+	}
+	entry, ok := owldb.tokenToUser[hashToken(token)]
+	if !ok && owldb.clientCerts != nil {
+		entry, ok = owldb.clientCerts.lookup(hashToken(token))
+	}
+	if !ok || entry.expired(time.Now()) {
+		return authEntry{}, fmt.Errorf("missing or invalid bearer token")
 	}
-	return user.username, nil
+	return entry, nil
 }
 
-// login processes the login request and generates a bearer token for the user
+// tokenLifetime returns how long the provided token remains valid
+// Input: token string
+// Output: Remaining lifetime, zero if the token is missing or expired
+func (owldb *owldb) tokenLifetime(token string) time.Duration {
+	user, err := owldb.lookupToken(token)
+	if err != nil {
+		return 0
+	}
+	if user.expiration.IsZero() {
+		return noExpiryRecheck
+	}
+	return max(time.Until(user.expiration), 0)
+}
+
+// subscriberAuthorizer returns a check that fails once the provided token is
+// revoked or expires, used to stop delivering events to its subscriptions
+// Input: token string
+// Output: Authorization check function
+func (owldb *owldb) subscriberAuthorizer(token string) func() error {
+	return func() error {
+		_, err := owldb.authorize(token)
+		return err
+	}
+}
+
+// login processes the login request and generates a bearer token for the user.
+// When a users file is configured the password must match the stored hash.
 // Input: requestData in byte format
 // Output: loginRequest struct with generated token, or error
 func (owldb *owldb) login(requestData []byte) (*loginRequest, error) {
@@ -63,35 +127,134 @@ func (owldb *owldb) login(requestData []byte) (*loginRequest, error) {
 		return nil, fmt.Errorf(`"No username in request body"`)
 	}
 
+	if owldb.credentials == nil && !owldb.insecureLogin {
+		return nil, errLoginDisabled
+	}
+	if owldb.credentials != nil && !owldb.credentials.verify(username, userCredentials["password"]) {
+		slog.Warn("Login failed", "username", username)
+		return nil, errInvalidCredentials
+	}
+
+	if owldb.jwtKey != nil {
+		owldb.mu.Lock()
+		bearerToken, _, expirationTime, err := owldb.issueJWT(username, nil, owldb.sessionLifetime)
+		owldb.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return &loginRequest{Token: bearerToken, ExpiresAt: &expirationTime}, nil
+	}
+
 	owldb.mu.Lock()
 	defer owldb.mu.Unlock()
 
 	bearerToken := generateToken()
-	_, tokenExists := owldb.tokenToUser[bearerToken]
+	_, tokenExists := owldb.tokenToUser[hashToken(bearerToken)]
 	for tokenExists {
 		bearerToken = generateToken()
-		_, tokenExists = owldb.tokenToUser[bearerToken]
+		_, tokenExists = owldb.tokenToUser[hashToken(bearerToken)]
 	}
 
-	expirationTime := time.Now().Add(1 * time.Hour)
+	expirationTime := time.Now().Add(owldb.sessionLifetime)
 	tokenDetails := authEntry{username: username, expiration: expirationTime}
-	owldb.tokenToUser[bearerToken] = tokenDetails
+	owldb.tokenToUser[hashToken(bearerToken)] = tokenDetails
+	owldb.saveSessions()
 
-	loginResponse := loginRequest{Token: bearerToken}
+	loginResponse := loginRequest{Token: bearerToken, ExpiresAt: &expirationTime}
 	return &loginResponse, nil
 }
 
+// refresh extends the lifetime of a valid bearer token. Login tokens are
+// extended by the session lifetime; static tokens by the static token
+// lifetime, or not at all if they never expire.
+// Input: authToken string
+// Output: loginRequest struct with the token and its new expiry, or error
+func (owldb *owldb) refresh(authToken string) (*loginRequest, error) {
+	if owldb.jwtKey != nil && jwt.LooksLikeToken(authToken) {
+		return owldb.refreshJWT(authToken)
+	}
+
+	owldb.mu.Lock()
+	defer owldb.mu.Unlock()
+
+	tokenHash := hashToken(authToken)
+	entry, exists := owldb.tokenToUser[tokenHash]
+	if !exists || entry.expired(time.Now()) {
+		return nil, fmt.Errorf("missing or invalid bearer token")
+	}
+
+	if entry.service {
+		return nil, fmt.Errorf("service tokens cannot be refreshed")
+	} else if !entry.static {
+		entry.expiration = time.Now().Add(owldb.sessionLifetime)
+	} else if owldb.staticLifetime > 0 {
+		entry.expiration = time.Now().Add(owldb.staticLifetime)
+	}
+	owldb.tokenToUser[tokenHash] = entry
+	if !entry.static {
+		owldb.saveSessions()
+	}
+
+	refreshResponse := loginRequest{Token: authToken}
+	if !entry.expiration.IsZero() {
+		refreshResponse.ExpiresAt = &entry.expiration
+	}
+	return &refreshResponse, nil
+}
+
+// refreshJWT replaces a valid JWT with a new one for the same user, since a
+// signed token's expiry cannot change, and revokes the old token
+// Input: authToken string
+// Output: loginRequest struct with the new token and its expiry, or error
+func (owldb *owldb) refreshJWT(authToken string) (*loginRequest, error) {
+	owldb.mu.Lock()
+	defer owldb.mu.Unlock()
+
+	entry, err := owldb.verifyJWT(authToken)
+	if err != nil {
+		return nil, err
+	}
+	if entry.service {
+		return nil, fmt.Errorf("service tokens cannot be refreshed")
+	}
+	bearerToken, _, expirationTime, err := owldb.issueJWT(entry.username, nil, owldb.sessionLifetime)
+	if err != nil {
+		return nil, err
+	}
+	owldb.revokeJWT(entry.jwtID, entry.expiration)
+	return &loginRequest{Token: bearerToken, ExpiresAt: &expirationTime}, nil
+}
+
 // logout invalidates the provided bearer token
 // Input: authToken string
 // Output: error if the token is missing or invalid
 func (owldb *owldb) logout(authToken string) error {
+	if owldb.jwtKey != nil && jwt.LooksLikeToken(authToken) {
+		owldb.mu.Lock()
+		entry, err := owldb.verifyJWT(authToken)
+		if err == nil {
+			owldb.revokeJWT(entry.jwtID, entry.expiration)
+		}
+		owldb.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		owldb.subscription.Recheck()
+		return nil
+	}
+
 	owldb.mu.Lock()
-	defer owldb.mu.Unlock()
-	_, exists := owldb.tokenToUser[authToken]
+	_, exists := owldb.tokenToUser[hashToken(authToken)]
 	if !exists {
+		owldb.mu.Unlock()
 		return fmt.Errorf("missing or invalid bearer token")
 	}
-	delete(owldb.tokenToUser, authToken)
+	delete(owldb.tokenToUser, hashToken(authToken))
+	owldb.saveSessions()
+	owldb.mu.Unlock()
+
+	// End any subscriptions opened with the revoked token
+	owldb.subscription.Recheck()
 	return nil
 }
 
@@ -109,16 +272,43 @@ func processAuthField(authHeader string) (string, error) {
 // Input: HTTP response writer and request
 // Output: None
 func (owldb *owldb) HandleAuth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	owldb.allowOrigin(w, r)
 	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 	w.Header().Set("Content-Type", "application/json")
 
+	if r.Method != "OPTIONS" && !owldb.limitRequest(w, RouteAuth, clientAddress(r)) {
+		return
+	}
+
+	// Logins and logouts are counted and audited, logins as the user they
+	// authorize and logouts as the user they end the session of. Login bodies
+	// hold passwords, so their content is not hashed into the log.
+	var issuedToken string
+	var requestBody []byte
 	reqMethod := r.Method
-	requestBody, err := io.ReadAll(r.Body)
+	if isMutation(reqMethod) {
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		w = rec
+		auditUser := owldb.auditUser(r)
+		defer func() {
+			var auditContent []byte
+			if reqMethod != "POST" {
+				auditContent = requestBody
+			}
+			if issuedToken != "" {
+				auditUser, _ = owldb.authorize(issuedToken)
+			}
+			noteUser(r, auditUser)
+			owldb.recordAudit(auditUser, r, rec.code, "", auditContent)
+			owldb.observeAuth(reqMethod, rec.code)
+		}()
+	}
+
+	requestBody, err := owldb.readBody(w, r)
 	if err != nil {
-		slog.Error("Failed to read request body", "error", err)
-		encodederr, _ := json.Marshal("unable to read body")
-		w.WriteHeader(http.StatusBadRequest)
+		requestLogger(r).Error("Failed to read request body", "error", err)
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(bodyErrorStatus(err))
 		w.Write(encodederr)
 		return
 	}
@@ -126,16 +316,28 @@ func (owldb *owldb) HandleAuth(w http.ResponseWriter, r *http.Request) {
 	if reqMethod == "POST" {
 		// Handle login request
 		loginResponse, err := owldb.login(requestBody)
-		if err != nil {
+		if errors.Is(err, errInvalidCredentials) {
+			encodederr, _ := json.Marshal(err.Error())
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write(encodederr)
+			return
+		} else if errors.Is(err, errLoginDisabled) {
+			encodederr, _ := json.Marshal(err.Error())
+			w.WriteHeader(http.StatusForbidden)
+			w.Write(encodederr)
+			return
+		} else if err != nil {
 			encodederr, _ := json.Marshal(err.Error())
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write(encodederr)
 			return
 		}
 
+		issuedToken = loginResponse.Token
+
 		encodedResponse, err := json.Marshal(*loginResponse)
 		if err != nil {
-			slog.Error(err.Error())
+			requestLogger(r).Error(err.Error())
 			encodederr, _ := json.Marshal(err.Error())
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write(encodederr)
@@ -158,7 +360,7 @@ func (owldb *owldb) HandleAuth(w http.ResponseWriter, r *http.Request) {
 
 		err = owldb.logout(authToken)
 		if err != nil {
-			slog.Error(err.Error())
+			requestLogger(r).Error(err.Error())
 			encodederr, _ := json.Marshal(err.Error())
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write(encodederr)
@@ -180,3 +382,48 @@ func (owldb *owldb) HandleAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// HandleRefresh extends the lifetime of the bearer token in the request (POST)
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "POST")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method != "POST" {
+		encodederr, _ := json.Marshal("bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(encodederr)
+		return
+	}
+
+	if !owldb.limitRequest(w, RouteAuth, clientAddress(r)) {
+		return
+	}
+
+	authToken, err := owldb.bearerToken(r)
+	if err != nil {
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(encodederr)
+		return
+	}
+
+	refreshResponse, err := owldb.refresh(authToken)
+	if err != nil {
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(encodederr)
+		return
+	}
+
+	encodedResponse, _ := json.Marshal(*refreshResponse)
+	w.WriteHeader(http.StatusOK)
+	w.Write(encodedResponse)
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// clientCertAuth authenticates requests by their verified client
+// certificates. Each certificate is given a token that never leaves the
+// server, so the rest of the server authorizes it like any other token.
+type clientCertAuth struct {
+	users   map[string]string // subject or common name to username, common name if empty
+	mu      sync.Mutex
+	tokens  map[string]string    // certificate fingerprint to token
+	entries map[string]authEntry // token hash to entry
+}
+
+// newClientCertAuth creates the client certificate authenticator
+// Input: Map from certificate subject or common name to username
+// Output: clientCertAuth
+func newClientCertAuth(users map[string]string) *clientCertAuth {
+	return &clientCertAuth{users: users, tokens: make(map[string]string), entries: make(map[string]authEntry)}
+}
+
+// username maps a certificate to a user. With a mapping, the full subject
+// is looked up first and then the common name; without one, the common
+// name is the username.
+// Input: Certificate
+// Output: Username (string), error if the certificate is not mapped
+func (auth *clientCertAuth) username(cert *x509.Certificate) (string, error) {
+	if len(auth.users) == 0 {
+		if cert.Subject.CommonName == "" {
+			return "", fmt.Errorf("client certificate has no common name")
+		}
+		return cert.Subject.CommonName, nil
+	}
+	if user, ok := auth.users[cert.Subject.String()]; ok {
+		return user, nil
+	}
+	if user, ok := auth.users[cert.Subject.CommonName]; ok && cert.Subject.CommonName != "" {
+		return user, nil
+	}
+	return "", fmt.Errorf("client certificate %q is not mapped to a user", cert.Subject.String())
+}
+
+// token returns the token of a certificate, issuing one that expires with
+// the certificate the first time it is seen
+// Input: Certificate
+// Output: Token (string), error if the certificate is not mapped to a user
+func (auth *clientCertAuth) token(cert *x509.Certificate) (string, error) {
+	username, err := auth.username(cert)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(digest[:])
+
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if token, ok := auth.tokens[fingerprint]; ok {
+		if entry, ok := auth.entries[hashToken(token)]; ok && !entry.expired(time.Now()) {
+			return token, nil
+		}
+		delete(auth.entries, hashToken(token))
+	}
+	token := rand.Text()
+	auth.tokens[fingerprint] = token
+	auth.entries[hashToken(token)] = authEntry{username: username, expiration: cert.NotAfter}
+	return token, nil
+}
+
+// lookup returns the entry of a certificate token
+// Input: Token hash (string)
+// Output: authEntry, whether it was found
+func (auth *clientCertAuth) lookup(tokenHash string) (authEntry, bool) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	entry, ok := auth.entries[tokenHash]
+	return entry, ok
+}
+
+// sweep evicts the tokens of certificates that have expired
+// Input: Current time (time.Time)
+// Output: Number of tokens evicted (int)
+func (auth *clientCertAuth) sweep(now time.Time) int {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	evicted := 0
+	for fingerprint, token := range auth.tokens {
+		if entry, ok := auth.entries[hashToken(token)]; !ok || entry.expired(now) {
+			delete(auth.entries, hashToken(token))
+			delete(auth.tokens, fingerprint)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// bearerToken returns the token a request authenticates with: the bearer
+// token of its Authorization header or, when client certificates are
+// accepted and the request has no header, the token of its verified
+// certificate
+// Input: HTTP request
+// Output: Token (string), error if the request carries neither
+func (owldb *owldb) bearerToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" && owldb.clientCerts != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return owldb.clientCerts.token(r.TLS.VerifiedChains[0][0])
+	}
+	return processAuthField(authHeader)
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+	"slices"
+)
+
+// allowOrigin sets the CORS origin header of a response. Any origin is
+// allowed unless specific origins are configured, in which case only
+// requests from one of them get the header.
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) allowOrigin(w http.ResponseWriter, r *http.Request) {
+	if len(owldb.corsOrigins) == 0 || slices.Contains(owldb.corsOrigins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); origin != "" && owldb.originAllowed(r) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// originAllowed reports whether a request comes from an allowed origin.
+// Browsers send an Origin header on cross-origin requests, so requests
+// without one are allowed.
+// Input: HTTP request
+// Output: Boolean
+func (owldb *owldb) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || len(owldb.corsOrigins) == 0 || slices.Contains(owldb.corsOrigins, "*") || slices.Contains(owldb.corsOrigins, origin)
+}
+
+// HandleAdminConfig shows the configuration the server was started with,
+// after flags were applied and with secrets redacted (GET /admin/config)
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "GET")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	_, statusCode, err := owldb.requireAdmin(r)
+	if err != nil {
+		writeJSON(w, statusCode, err.Error())
+		return
+	}
+	if r.Method != "GET" {
+		writeJSON(w, http.StatusBadRequest, "bad request")
+		return
+	}
+	if owldb.effectiveConfig == nil {
+		writeJSON(w, http.StatusNotFound, "server was not started from a configuration")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, owldb.effectiveConfig)
+}
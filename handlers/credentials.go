@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Parameters for hashing passwords with PBKDF2-HMAC-SHA256
+const (
+	passwordIterations = 600000
+	passwordSaltSize   = 16
+	passwordKeySize    = 32
+)
+
+// errInvalidCredentials is returned when a login fails password verification
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// errLoginDisabled is returned for logins when there is no users file to
+// check passwords against and insecure logins are not allowed
+var errLoginDisabled = errors.New("login is disabled: no users file is configured")
+
+// credential is a user record in the users file. Password holds a plaintext
+// password and is only accepted when loading the file, after which it is
+// replaced by its hash.
+type credential struct {
+	Salt       string `json:"salt,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Admin      bool   `json:"admin"`
+}
+
+// userInfo describes a user without its credentials
+type userInfo struct {
+	Username string `json:"username"`
+	Admin    bool   `json:"admin"`
+}
+
+// credentialStore holds the users allowed to log in with a password and
+// keeps the users file up to date
+type credentialStore struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]credential
+}
+
+// hashPassword derives the password hash for the given salt and iteration count
+// Input: Password (string), Salt ([]byte), Iterations (int)
+// Output: Derived key, error if any
+func hashPassword(password string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iterations, passwordKeySize)
+}
+
+// newCredential hashes a password with a fresh random salt
+// Input: Password (string), Admin flag (bool)
+// Output: credential, error if any
+func newCredential(password string, admin bool) (credential, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return credential{}, err
+	}
+	hash, err := hashPassword(password, salt, passwordIterations)
+	if err != nil {
+		return credential{}, err
+	}
+	return credential{
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Hash:       base64.StdEncoding.EncodeToString(hash),
+		Iterations: passwordIterations,
+		Admin:      admin,
+	}, nil
+}
+
+// loadCredentials reads the users file, hashing any plaintext passwords it
+// contains. The file must exist, as without an admin in it no users could be
+// added.
+// Input: Users file path (string)
+// Output: Pointer to credentialStore or error
+func loadCredentials(path string) (*credentialStore, error) {
+	store := &credentialStore{path: path, users: make(map[string]credential)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("users file could not be read")
+	}
+	if err := json.Unmarshal(data, &store.users); err != nil {
+		return nil, fmt.Errorf("users file in incorrect format")
+	}
+
+	rewrite := false
+	for username, cred := range store.users {
+		if cred.Password != "" {
+			hashed, err := newCredential(cred.Password, cred.Admin)
+			if err != nil {
+				return nil, err
+			}
+			store.users[username] = hashed
+			rewrite = true
+			continue
+		}
+		if cred.Salt == "" || cred.Hash == "" || cred.Iterations <= 0 {
+			return nil, fmt.Errorf("user %q in users file has no password", username)
+		}
+	}
+
+	// Never leave plaintext passwords on disk
+	if rewrite {
+		if err := store.save(); err != nil {
+			return nil, err
+		}
+		slog.Info("Hashed plaintext passwords in users file", "path", path)
+	}
+
+	slog.Info("Loaded users", "path", path, "count", len(store.users))
+	return store, nil
+}
+
+// save writes the users to the users file, replacing it atomically.
+// Must be called with store.mu held or before the store is shared.
+// Input: None
+// Output: Error if any
+func (store *credentialStore) save() error {
+	encoded, err := json.MarshalIndent(store.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(store.path), ".users-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write users file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write users file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write users file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), store.path); err != nil {
+		return fmt.Errorf("failed to write users file: %v", err)
+	}
+	return nil
+}
+
+// verify checks a username and password against the store
+// Input: Username (string), Password (string)
+// Output: Boolean indicating if the password is correct
+func (store *credentialStore) verify(username string, password string) bool {
+	store.mu.RLock()
+	cred, exists := store.users[username]
+	store.mu.RUnlock()
+
+	if !exists {
+		// Spend the same time as a real check so usernames cannot be probed
+		hashPassword(password, make([]byte, passwordSaltSize), passwordIterations)
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(cred.Salt)
+	if err != nil {
+		return false
+	}
+	expected, err := base64.StdEncoding.DecodeString(cred.Hash)
+	if err != nil {
+		return false
+	}
+	actual, err := hashPassword(password, salt, cred.Iterations)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(expected, actual) == 1
+}
+
+// isAdmin reports whether the user may use the admin endpoints
+// Input: Username (string)
+// Output: Boolean
+func (store *credentialStore) isAdmin(username string) bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.users[username].Admin
+}
+
+// setPassword creates a user or replaces an existing user's password
+// Input: Username (string), Password (string), Admin flag (bool)
+// Output: Boolean indicating if the user already existed, error if any
+func (store *credentialStore) setPassword(username string, password string, admin bool) (bool, error) {
+	cred, err := newCredential(password, admin)
+	if err != nil {
+		return false, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	previous, existed := store.users[username]
+	store.users[username] = cred
+	if err := store.save(); err != nil {
+		if existed {
+			store.users[username] = previous
+		} else {
+			delete(store.users, username)
+		}
+		return false, err
+	}
+	return existed, nil
+}
+
+// remove deletes a user from the store
+// Input: Username (string)
+// Output: Error if the user does not exist or the file cannot be written
+func (store *credentialStore) remove(username string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	previous, exists := store.users[username]
+	if !exists {
+		return fmt.Errorf("user does not exist")
+	}
+	delete(store.users, username)
+	if err := store.save(); err != nil {
+		store.users[username] = previous
+		return err
+	}
+	return nil
+}
+
+// list returns all users sorted by username
+// Input: None
+// Output: Slice of userInfo
+func (store *credentialStore) list() []userInfo {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	users := make([]userInfo, 0, len(store.users))
+	for username, cred := range store.users {
+		users = append(users, userInfo{Username: username, Admin: cred.Admin})
+	}
+	slices.SortFunc(users, func(a, b userInfo) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+	return users
+}
@@ -2,17 +2,25 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/acl"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/audit"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group35/jsondata"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/jwt"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/ratelimit"
 
 	"github.com/RICE-COMP318-FALL24/owldb-p1group35/storage"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group35/subscription"
@@ -33,6 +41,9 @@ type httpRequest struct {
 	minKey      string
 	maxKey      string
 	noOverwrite bool
+	ownerOnly   bool
+	limits      storage.DocumentLimits
+	logger      *slog.Logger
 }
 
 // GetType returns the HTTP request type
@@ -84,6 +95,30 @@ func (http_req httpRequest) GetEndKey() string {
 	return http_req.maxKey
 }
 
+// GetLogger returns the logger of the request, which includes its ID
+// Input: None
+// Output: Logger
+func (http_req httpRequest) GetLogger() *slog.Logger {
+	if http_req.logger == nil {
+		return slog.Default()
+	}
+	return http_req.logger
+}
+
+// GetDocumentLimits returns the size and depth limits for new document contents
+// Input: None
+// Output: DocumentLimits
+func (http_req httpRequest) GetDocumentLimits() storage.DocumentLimits {
+	return http_req.limits
+}
+
+// GetOwnerOnly returns whether only document creators may change documents
+// Input: None
+// Output: Boolean indicating the owner-only policy applies
+func (http_req httpRequest) GetOwnerOnly() bool {
+	return http_req.ownerOnly
+}
+
 // GetNoOverwrite returns whether no-overwrite mode is enabled
 // Input: None
 // Output: Boolean indicating no-overwrite mode
@@ -102,13 +137,85 @@ type IStorage interface {
 }
 
 type owldb struct {
-	storage      *storage.Storage
-	validator    jsondata.Validator
-	mu           sync.RWMutex
-	tokenToUser  map[string]authEntry
-	subscription *subscription.SubscriberHandler
+	storage *storage.Storage
+	// The validator and tokens are replaced on reload, under mu
+	validator   jsondata.Validator
+	mu          sync.RWMutex
+	tokenToUser map[string]authEntry
+	credentials *credentialStore
+	// Whether anyone may log in without a password when there is no users
+	// file
+	insecureLogin bool
+	schemaFile    string
+	tokenFile     string
+	// Key for signing and verifying JWTs, nil unless JWT mode is enabled;
+	// revoked is guarded by mu
+	jwtKey  []byte
+	revoked revocationList
+	// Rate limiters by route class
+	limiters map[string]*ratelimit.Limiter
+	// Size limits by method, with AllMethods for the rest, and for documents
+	maxBodySize    map[string]int64
+	documentLimits storage.DocumentLimits
+	rejections     rejectionCounters
+	acls           *acl.Store
+	policies       map[string]databasePolicy
+	policyFile     string
+	policyMu       sync.RWMutex
+	dataDir        string
+	// Lifetime of login tokens and of tokens from the token file; a zero
+	// static lifetime means static tokens never expire
+	sessionLifetime time.Duration
+	staticLifetime  time.Duration
+	audit           *audit.Log
+	corsOrigins     []string
+	clientCerts     *clientCertAuth
+	effectiveConfig any
+	metrics         *serverMetrics
+	metricsToken    string // Hash of the token that may scrape /metrics, empty if none
+	subscription    *subscription.SubscriberHandler
+	snapshotMu      sync.RWMutex
+	done            chan struct{}
+	closeOnce       sync.Once
+	// Readiness: draining is set once shutdown has begun
+	startedAt time.Time
+	draining  atomic.Bool
 }
 
+// Options configures a new owldb instance
+type Options struct {
+	SchemaFile string // JSON schema for validating documents
+	TokenFile  string // JSON object mapping service account usernames to tokens
+	UsersFile  string // JSON object of users who log in with a password, optional
+	DataDir    string // Directory where login sessions are saved, optional
+	ACLFile    string // JSON file of groups and resource ACLs, optional
+	JWTKeyFile string // Key for issuing signed JWTs instead of stored tokens, optional
+	AuditFile  string // JSON lines file where changes are audited, optional
+
+	MetricsTokenFile string // Bearer token that may read /metrics besides admins, optional
+
+	AccessLog       io.Writer // Where a line is written per request, none if nil
+	AccessLogFormat string    // AccessLogCombined or AccessLogJSON
+
+	CORSOrigins     []string // Origins allowed by CORS, any if empty or containing "*"
+	EffectiveConfig any      // Shown by GET /admin/config, secrets already redacted
+
+	ClientCertAuth  bool              // Authenticate requests without a token by their verified client certificate
+	ClientCertUsers map[string]string // Certificate subject or common name to username, the common name if empty
+
+	RateLimits map[string]ratelimit.Limit // Limits by route class, unlimited if missing
+
+	MaxBodySize    map[string]int64       // Body limits by method or AllMethods, DefaultMaxBodySize if missing
+	DocumentLimits storage.DocumentLimits // Document limits, DefaultMaxDepth if MaxDepth is zero
+
+	InsecureLogin       bool          // Let anyone log in without a password when there is no users file
+	SessionLifetime     time.Duration // Lifetime of login tokens, DefaultSessionLifetime if zero
+	StaticTokenLifetime time.Duration // Lifetime of token file tokens, never expire if zero
+}
+
+// sweepInterval is how often expired tokens are evicted
+const sweepInterval = time.Minute
+
 // GetSupportedRequests returns a list of supported HTTP methods for the given storage type
 // Input: Storage type string
 // Output: Slice of supported request methods
@@ -123,7 +230,7 @@ func GetSupportedRequests(storage_type string) []string {
 	}
 
 	// Log the supported requests for the given storage type
-	slog.Info("Supported requests determined", "storage_type", storage_type, "supported_requests", slice)
+	slog.Debug("Supported requests determined", "storage_type", storage_type, "supported_requests", slice)
 	return slice
 }
 
@@ -141,7 +248,7 @@ func GetStorageType(path_length int) string {
 	}
 
 	// Log the determined storage type
-	slog.Info("Determined storage type", "path_length", path_length, "storage_type", storageType)
+	slog.Debug("Determined storage type", "path_length", path_length, "storage_type", storageType)
 	return storageType
 }
 
@@ -168,6 +275,10 @@ func GetStatusCode(status_class string) (code int, success bool) {
 		return 200, true
 	case "Document not overwritten":
 		return 412, false
+	case "Forbidden":
+		return 403, false
+	case "Too Large":
+		return 413, false
 	default:
 		// Log an unexpected status class
 		slog.Warn("Unknown status class encountered", "status_class", status_class)
@@ -179,49 +290,163 @@ func GetStatusCode(status_class string) (code int, success bool) {
 // Input: Schema file path, token file path
 // Output: Pointer to owldb instance or error
 func New(schemaFile string, tokenFile string) (*owldb, error) {
+	return NewWithOptions(Options{SchemaFile: schemaFile, TokenFile: tokenFile})
+}
+
+// NewWithOptions initializes a new owldb instance from the given options
+// Input: Options
+// Output: Pointer to owldb instance or error
+func NewWithOptions(opts Options) (*owldb, error) {
 	store := storage.NewStorageTree()
 	subscribe := subscription.NewHandler()
-	schema, err := jsonschema.Compile(schemaFile)
+	schema, err := jsonschema.Compile(opts.SchemaFile)
 
 	if err != nil {
 		return nil, fmt.Errorf("schema file not found")
 	}
 
-	jsonfile, err := os.Open(tokenFile)
+	auth_map, err := readTokenFile(opts.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Loaded token file", "users", len(auth_map))
+
+	token_to_tokeninfo := make(map[string]authEntry, len(auth_map))
+	if opts.DataDir != "" {
+		if err := os.MkdirAll(opts.DataDir, 0700); err != nil {
+			return nil, fmt.Errorf("data directory could not be created")
+		}
+		token_to_tokeninfo, err = loadSessions(opts.DataDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only token hashes are kept in memory
+	for tokenHash, entry := range staticEntries(auth_map, opts.StaticTokenLifetime) {
+		token_to_tokeninfo[tokenHash] = entry
+	}
+
+	var credentials *credentialStore
+	if opts.UsersFile != "" {
+		credentials, err = loadCredentials(opts.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+	} else if opts.InsecureLogin {
+		slog.Warn("No users file configured, logins are not password protected")
+	} else {
+		slog.Info("No users file configured, login is disabled")
+	}
 
+	// ACLs are saved with the data directory unless given their own file
+	aclFile := opts.ACLFile
+	if aclFile == "" && opts.DataDir != "" {
+		aclFile = filepath.Join(opts.DataDir, "acls.json")
+	}
+	acls := acl.NewStore()
+	policyFile := ""
+	if aclFile != "" {
+		acls, err = acl.Load(aclFile)
+		if err != nil {
+			return nil, err
+		}
+		policyFile = filepath.Join(filepath.Dir(aclFile), policiesFileName)
+	}
+	policies, err := loadPolicies(policyFile)
 	if err != nil {
-		return nil, fmt.Errorf("token file not found")
+		return nil, err
+	}
+
+	var metricsToken string
+	if opts.MetricsTokenFile != "" {
+		metricsToken, err = loadMetricsToken(opts.MetricsTokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// In JWT mode any instance with the same key can verify tokens
+	var jwtKey []byte
+	revoked := newRevocationList()
+	if opts.JWTKeyFile != "" {
+		jwtKey, err = jwt.LoadKey(opts.JWTKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if opts.DataDir != "" {
+			revoked, err = loadRevocations(opts.DataDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		slog.Info("JWT auth mode enabled", "revoked", len(revoked.IDs))
+	}
+
+	var auditLog *audit.Log
+	if opts.AuditFile != "" {
+		auditLog, err = audit.Open(opts.AuditFile)
+		if err != nil {
+			return nil, err
+		}
 	}
-	jsonbytes, _ := io.ReadAll(jsonfile)
-	slog.Info("jsonbytes", "jsonbytes", jsonbytes)
 
-	var auth_map map[string]string
-	json.Unmarshal(jsonbytes, &auth_map)
-	slog.Info("auth_map", "auth_map", auth_map)
+	var clientCerts *clientCertAuth
+	if opts.ClientCertAuth {
+		clientCerts = newClientCertAuth(opts.ClientCertUsers)
+	}
 
-	token_user_map := make(map[string]string, len(auth_map))
-	for key, value := range auth_map {
-		token_user_map[value] = key
+	maxBodySize := map[string]int64{AllMethods: DefaultMaxBodySize}
+	for method, limit := range opts.MaxBodySize {
+		maxBodySize[method] = limit
+	}
+	if opts.DocumentLimits.MaxDepth == 0 {
+		opts.DocumentLimits.MaxDepth = DefaultMaxDepth
 	}
-	slog.Info("token_to_user", "token_to_user", token_user_map)
 
-	token_to_tokeninfo := make(map[string]authEntry, len(token_user_map))
-	expiration_time := time.Now().Add(1 * time.Hour)
-	for token, user := range token_user_map {
-		new_info := authEntry{username: user, expiration: expiration_time}
-		token_to_tokeninfo[token] = new_info
+	if opts.SessionLifetime <= 0 {
+		opts.SessionLifetime = DefaultSessionLifetime
 	}
 
-	service := owldb{storage: store, validator: schema, tokenToUser: token_to_tokeninfo, subscription: subscribe}
+	service := owldb{
+		storage:         store,
+		validator:       schema,
+		tokenToUser:     token_to_tokeninfo,
+		credentials:     credentials,
+		insecureLogin:   opts.InsecureLogin,
+		schemaFile:      opts.SchemaFile,
+		tokenFile:       opts.TokenFile,
+		jwtKey:          jwtKey,
+		revoked:         revoked,
+		limiters:        newLimiters(opts.RateLimits),
+		maxBodySize:     maxBodySize,
+		documentLimits:  opts.DocumentLimits,
+		acls:            acls,
+		policies:        policies,
+		policyFile:      policyFile,
+		dataDir:         opts.DataDir,
+		sessionLifetime: opts.SessionLifetime,
+		staticLifetime:  opts.StaticTokenLifetime,
+		audit:           auditLog,
+		corsOrigins:     opts.CORSOrigins,
+		clientCerts:     clientCerts,
+		effectiveConfig: opts.EffectiveConfig,
+		metrics:         newServerMetrics(),
+		metricsToken:    metricsToken,
+		subscription:    subscribe,
+		done:            make(chan struct{}),
+		startedAt:       time.Now(),
+	}
+	go service.runSweeper(sweepInterval)
 	return &service, nil
 }
 
 // RequestValid validates the given HTTP request based on storage type and other parameters
-// Input: Method string, storage type string, slash ending boolean, interval boolean, overwrite boolean
+// Input: Method string, storage type string, slash ending boolean, interval boolean, overwrite boolean, Logger of the request
 // Output: Boolean indicating if the request is valid, and error if not valid
-func RequestValid(method string, storage_type string, slashEnd bool, interval bool, overwrite bool) (bool, error) {
+func RequestValid(method string, storage_type string, slashEnd bool, interval bool, overwrite bool, logger *slog.Logger) (bool, error) {
 
-	slog.Info("in requestvalid", "storage_type", storage_type, "slashEnd", slashEnd, "interval", interval, "overwrite", overwrite)
+	logger.Debug("in requestvalid", "storage_type", storage_type, "slashEnd", slashEnd, "interval", interval, "overwrite", overwrite)
 	// Validate that the request method is supported for the given storage type
 	if !slices.Contains(GetSupportedRequests(storage_type), method) {
 		return false, fmt.Errorf("invalid request type")
@@ -258,9 +483,9 @@ type PathStruct struct {
 }
 
 // A generic way to extract the "Path" field from a variable of type 'any'.
-// Input: JSON []byte
+// Input: JSON []byte, Logger of the request
 // Output: String and error
-func extractPath(value []byte) (string, error) {
+func extractPath(value []byte, logger *slog.Logger) (string, error) {
 	// Use a map to extract the "path" field from the JSON bytes
 	var pathObj PathStruct
 	err := json.Unmarshal(value, &pathObj)
@@ -270,7 +495,7 @@ func extractPath(value []byte) (string, error) {
 
 	// Check if the "path" key exists and is a string
 	path := pathObj.URI
-	slog.Info("in extractPath", "path", path)
+	logger.Debug("in extractPath", "path", path)
 	return path[strings.LastIndex(path, "/")+1:], nil
 
 }
@@ -279,21 +504,51 @@ func extractPath(value []byte) (string, error) {
 // Input: HTTP response writer and request
 // Output: None
 func (owldb *owldb) HandleStorage(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	owldb.allowOrigin(w, r)
 	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 	w.Header().Set("Content-Type", "application/json")
+	r, logger := withRequestID(w, r)
 
 	requestPath := r.URL.Path
-	requestBody, err := io.ReadAll(r.Body)
 
+	// Every request is measured and every change is audited, including ones
+	// that are rejected. The user is looked up first since a request may end
+	// the session it was made with.
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+	w = rec
+	var statusClass string
+	var requestBody []byte
+	defer func() {
+		owldb.observeStorage(r, rec.code, statusClass, time.Since(start))
+	}()
+	if isMutation(r.Method) {
+		auditUser := owldb.auditUser(r)
+		defer func() {
+			owldb.recordAudit(auditUser, r, rec.code, statusClass, requestBody)
+		}()
+	}
+	if owldb.refuseWhileDraining(w, r) {
+		return
+	}
+
+	requestBody, err := owldb.readBody(w, r)
 	if err != nil {
-		slog.Error("Failed to read request body", "error", err)
-		encodederr, _ := json.Marshal("Failed to read request body")
-		w.WriteHeader(http.StatusBadRequest)
+		logger.Error("Failed to read request body", "error", err)
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(bodyErrorStatus(err))
 		w.Write(encodederr)
 		return
 	}
 
+	if r.URL.Query().Get("mode") == "acl" {
+		owldb.HandleACL(w, r, requestBody)
+		return
+	} else if r.URL.Query().Get("mode") == "policy" {
+		owldb.HandlePolicy(w, r, requestBody)
+		return
+	}
+
 	pathSegments := strings.Split(requestPath, "/")[2:]
 
 	hasTrailingSlash := false
@@ -304,7 +559,7 @@ func (owldb *owldb) HandleStorage(w http.ResponseWriter, r *http.Request) {
 
 	storageType := GetStorageType(len(pathSegments))
 	if r.Method == "OPTIONS" {
-		slog.Info("Determined storage type for OPTIONS request", "storageType", storageType)
+		logger.Info("Determined storage type for OPTIONS request", "storageType", storageType)
 
 		// Get supported methods for the storage type and set response headers
 		supportedMethods := GetSupportedRequests(storageType)
@@ -344,7 +599,7 @@ func (owldb *owldb) HandleStorage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate the request based on storage type and parameters
-	isValid, err := RequestValid(r.Method, storageType, hasTrailingSlash, hasInterval, noOverwrite)
+	isValid, err := RequestValid(r.Method, storageType, hasTrailingSlash, hasInterval, noOverwrite, logger)
 
 	if !isValid {
 		encodederr, _ := json.Marshal(err.Error())
@@ -355,7 +610,7 @@ func (owldb *owldb) HandleStorage(w http.ResponseWriter, r *http.Request) {
 
 	// Extract the authorization token from the request header
 	var authToken string
-	authToken, err = processAuthField(r.Header.Get("Authorization"))
+	authToken, err = owldb.bearerToken(r)
 
 	if err != nil {
 		encodederr, _ := json.Marshal(err.Error())
@@ -365,9 +620,7 @@ func (owldb *owldb) HandleStorage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Authorize the user using the token
-	var user string
-
-	user, err = owldb.authorize(authToken)
+	entry, err := owldb.lookupToken(authToken)
 
 	if err != nil {
 		encodederr, _ := json.Marshal(err.Error())
@@ -375,60 +628,106 @@ func (owldb *owldb) HandleStorage(w http.ResponseWriter, r *http.Request) {
 		w.Write(encodederr)
 		return
 	}
-	slog.Info("Request Valid")
+	user := entry.username
+	r, logger = withUser(r, user)
+	logger.Info("Request Valid")
+
+	if !owldb.limitRequest(w, storageRouteClass(r.Method, subscribeMode), user) {
+		return
+	}
+
+	// Collection and database listings are filtered instead of denied
+	listing := r.Method == "GET" && hasTrailingSlash
+	required := acl.Read
+	if r.Method != "GET" {
+		required = acl.Write
+	}
+	if !listing && owldb.access(entry, requestPath) < required {
+		logger.Warn("Request denied by ACL", "username", user, "method", r.Method, "path", requestPath)
+		encodederr, _ := json.Marshal(errPermissionDenied.Error())
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(encodederr)
+		return
+	}
+
+	if r.Method == "GET" && subscribeMode {
+		// Handle subscription requests separately
+		noteSubscription(r)
+		owldb.HandleSubscription(w, r)
+		return
+	}
+
+	if r.Method != "GET" {
+		// Writes and their notifications happen together while holding the
+		// snapshot lock shared, so a new subscriber's initial snapshot either
+		// includes a write or receives its event, never both or neither
+		owldb.snapshotMu.RLock()
+		defer owldb.snapshotMu.RUnlock()
+	}
 
 	// Create a new HTTP request details object
 	reqDetails := httpRequest{
 		request:     r.Method,
 		path:        pathSegments,
 		content:     requestBody,
-		validator:   owldb.validator,
+		validator:   owldb.currentValidator(),
 		username:    user,
 		minKey:      minKey,
 		maxKey:      maxKey,
 		noOverwrite: noOverwrite,
+		ownerOnly:   owldb.ownerOnly(pathSegments[0], user),
+		limits:      owldb.documentLimits,
+		logger:      logger,
 	}
 
 	// Perform the operation using the storage handler
 	opResult, status := owldb.storage.HandleOperation(reqDetails)
+	statusClass = status.GetClass()
+	owldb.countDocumentRejection(status.GetError())
 
 	// Determine the HTTP status code from the operation status
 	statusCode, success := GetStatusCode(status.GetClass())
-	slog.Info("check status", "type", r.Method, "status code", statusCode, "success", success, "stat", status)
+	logger.Info("check status", "type", r.Method, "status code", statusCode, "success", success, "stat", status)
 
 	if !success {
-		slog.Warn("Operation on child failed", "statusClass", status.GetClass(), "errorMessage", status.GetError().Error())
+		logger.Warn("Operation on child failed", "statusClass", status.GetClass(), "errorMessage", status.GetError().Error())
 		encodederr, _ := json.Marshal(status.GetError().Error())
-		slog.Info("Failed to process request", "method", r.Method, "path", pathSegments, "statusCode", statusCode, "encodederr", encodederr)
+		logger.Info("Failed to process request", "method", r.Method, "path", pathSegments, "statusCode", statusCode, "encodederr", encodederr)
 		w.WriteHeader(statusCode)
 		w.Write(encodederr)
 		return
 	}
 
+	if listing {
+		opResult = owldb.readableDocuments(entry, opResult)
+	}
+
 	// Encode the operation result to JSON
 	encodedResponse, err := json.Marshal(opResult)
 	if err != nil {
-		slog.Error("Failed to encode response", "error", err)
+		logger.Error("Failed to encode response", "error", err)
 		encodederr, _ := json.Marshal("failed to encode response")
-		slog.Info("Failed to process request", "method", r.Method, "path", pathSegments, "statusCode", statusCode, "encodederr", encodederr)
+		logger.Info("Failed to process request", "method", r.Method, "path", pathSegments, "statusCode", statusCode, "encodederr", encodederr)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(encodederr)
 		return
 	}
 
-	slog.Info("response marshal", "opResult", opResult, "encodedResponse", encodedResponse)
+	logger.Info("response marshal", "opResult", opResult, "encodedResponse", encodedResponse)
 
 	// Determine event type based on the HTTP method
 	var eventType string
 	var eventData []byte
+	var eventResource string
 	if r.Method == "DELETE" {
 		eventType = "delete"
 		eventPath := requestPath
+		eventResource = requestPath
 		eventData, err = json.Marshal(eventPath)
 		if err != nil {
-			slog.Error("Failed to encode response", "error", err)
+			logger.Error("Failed to encode response", "error", err)
 			encodederr, _ := json.Marshal("failed to encode response")
-			slog.Info("Failed to process request", "method", r.Method, "path", pathSegments, "statusCode", statusCode, "encodederr", encodederr)
+			logger.Info("Failed to process request", "method", r.Method, "path", pathSegments, "statusCode", statusCode, "encodederr", encodederr)
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write(encodederr)
 			return
@@ -437,36 +736,38 @@ func (owldb *owldb) HandleStorage(w http.ResponseWriter, r *http.Request) {
 		eventType = "update"
 		eventPath := pathSegments
 		if r.Method == "POST" {
-			postDoc, err := extractPath(encodedResponse)
+			postDoc, err := extractPath(encodedResponse, logger)
 			if err != nil {
-				slog.Error("Failed to get post path", "error", err)
+				logger.Error("Failed to get post path", "error", err)
 				encodederr, _ := json.Marshal("failed to get post path")
 				w.WriteHeader(http.StatusBadRequest)
 				w.Write(encodederr)
 				return
 			}
 			eventPath = append(eventPath, postDoc)
-			slog.Info("in getting post path", "eventPath", eventPath, "post doc name", postDoc)
+			logger.Info("in getting post path", "eventPath", eventPath, "post doc name", postDoc)
 		}
-		slog.Info("update path", "eventPath", eventPath)
+		logger.Info("update path", "eventPath", eventPath)
+		eventResource = "/v1/" + strings.Join(eventPath, "/")
 		reqSubscribe := httpRequest{
 			request:     "GET",
 			path:        eventPath,
 			content:     requestBody,
-			validator:   owldb.validator,
+			validator:   owldb.currentValidator(),
 			username:    user,
 			minKey:      minKey,
 			maxKey:      maxKey,
 			noOverwrite: noOverwrite,
+			logger:      logger,
 		}
 		subResult, subStatus := owldb.storage.HandleOperation(reqSubscribe)
 
 		// Determine the HTTP status code from the operation status
 		subStatusCode, subSuccess := GetStatusCode(subStatus.GetClass())
-		slog.Info("check status", "type", "GET", "status code", subStatusCode, "success", subSuccess, "stat", subStatus)
+		logger.Info("check status", "type", "GET", "status code", subStatusCode, "success", subSuccess, "stat", subStatus)
 
 		if !subSuccess {
-			slog.Warn("Operation on child failed", "statusClass", subStatus.GetClass(), "errorMessage", subStatus.GetError().Error())
+			logger.Warn("Operation on child failed", "statusClass", subStatus.GetClass(), "errorMessage", subStatus.GetError().Error())
 			encodederr, _ := json.Marshal(subStatus.GetError().Error())
 			w.WriteHeader(subStatusCode)
 			w.Write(encodederr)
@@ -475,7 +776,7 @@ func (owldb *owldb) HandleStorage(w http.ResponseWriter, r *http.Request) {
 
 		eventData, err = json.Marshal(subResult)
 		if err != nil {
-			slog.Error("Failed to encode response", "error", err)
+			logger.Error("Failed to encode response", "error", err)
 			encodederr, _ := json.Marshal("failed to get post path")
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write(encodederr)
@@ -483,31 +784,31 @@ func (owldb *owldb) HandleStorage(w http.ResponseWriter, r *http.Request) {
 		}
 
 	} else if r.Method == "GET" {
-		if subscribeMode {
-			// Handle subscription requests separately
-			owldb.HandleSubscription(w, r)
-			return
-		}
 		eventType = ""
 	} else {
 		// For other methods, there shouldn't be any notifications
-		slog.Info("No notifications for this HTTP method", "method", r.Method)
+		logger.Info("No notifications for this HTTP method", "method", r.Method)
 		eventType = "" // Set eventType to an empty string to indicate no notification
 	}
 
+	event := subscription.Event{Type: eventType, Path: eventResource, Data: eventData, RequestID: requestID(r)}
+	if patchResult, ok := opResult.(storage.PatchResponse); ok && !patchResult.PatchFailed {
+		event.Delta = &subscription.PatchDelta{Path: eventResource, Version: patchResult.Version, Patch: requestBody}
+	}
+
 	// Check if there are subscribers to notify
 	hasSubscribers := false
 	if eventType != "" {
 		if storageType == "Database" && owldb.subscription.HasClients(requestPath+"/") {
-			err = owldb.subscription.Dispatch(requestPath+"/", eventData, true, eventType)
+			err = owldb.subscription.Dispatch(requestPath+"/", event, true)
 			if err != nil {
-				slog.Error("Failed to notify all subscribers", "error", err)
+				logger.Error("Failed to notify all subscribers", "error", err)
 			}
 			hasSubscribers = true
 		} else if owldb.subscription.HasClients(requestPath) {
-			err = owldb.subscription.Dispatch(requestPath, eventData, true, eventType)
+			err = owldb.subscription.Dispatch(requestPath, event, true)
 			if err != nil {
-				slog.Error("Failed to notify all subscribers", "error", err)
+				logger.Error("Failed to notify all subscribers", "error", err)
 			}
 			hasSubscribers = true
 		}
@@ -515,22 +816,32 @@ func (owldb *owldb) HandleStorage(w http.ResponseWriter, r *http.Request) {
 	}
 	// Check for collection-level subscribers
 	if storageType == "Document" && owldb.subscription.HasClients("/v1/"+strings.Join(pathSegments[:len(pathSegments)-1], "/")+"/") {
-		err = owldb.subscription.Dispatch("/v1/"+strings.Join(pathSegments[:len(pathSegments)-1], "/")+"/", eventData, false, eventType)
+		err = owldb.subscription.Dispatch("/v1/"+strings.Join(pathSegments[:len(pathSegments)-1], "/")+"/", event, false)
 		if err != nil {
-			slog.Error("Failed to notify collection subscribers", "error", err)
+			logger.Error("Failed to notify collection subscribers", "error", err)
 		}
 		hasSubscribers = true
 	}
 	if !hasSubscribers {
-		slog.Info("No subscribers for resource, skipping notification", "resource", requestPath)
+		logger.Debug("No subscribers for resource, skipping notification", "resource", requestPath)
+	}
+
+	// A resource created later at the same path must not inherit old ACLs
+	if r.Method == "DELETE" {
+		if err := owldb.acls.RemoveTree(requestPath); err != nil {
+			logger.Error("Failed to remove ACLs of deleted resource", "resource", requestPath, "error", err)
+		}
+		if storageType == "Database" {
+			owldb.removePolicy(pathSegments[0])
+		}
 	}
 
 	if owldb == nil {
-		slog.Error("owldb instance is nil")
+		logger.Error("owldb instance is nil")
 	}
 
 	// Send the response back to the client
-	slog.Info("Successfully processed request", "method", r.Method, "path", pathSegments, "statusCode", statusCode)
+	logger.Info("Successfully processed request", "method", r.Method, "path", pathSegments, "statusCode", statusCode)
 	w.WriteHeader(statusCode)
 	w.Write(encodedResponse)
 }
@@ -540,16 +851,150 @@ type flusher interface {
 	http.Flusher
 }
 
-// HandleSubscription handles HTTP requests for client subscriptions
+// snapshotEvents encodes the current state of a resource as update event data,
+// one entry per document
+// Input: Result of a GET operation
+// Output: Slice of encoded documents, error if encoding fails
+func snapshotEvents(snapshot any) ([][]byte, error) {
+	events := make([][]byte, 0)
+	switch content := snapshot.(type) {
+	case []storage.DocumentContent:
+		for _, doc := range content {
+			encoded, err := json.Marshal(doc)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, encoded)
+		}
+	default:
+		encoded, err := json.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, encoded)
+	}
+	return events, nil
+}
+
+// openSubscription reads the current state of a resource and registers a
+// channel for its live events while no write is in progress, so every later
+// write is delivered exactly once as an event
+// Input: Resource path (string), Token entry (authEntry), Interval parameter (string), Subscriber, Logger of the request
+// Output: Snapshot event data, sequence number the snapshot reflects, HTTP status code, error
+func (owldb *owldb) openSubscription(resourcePath string, entry authEntry, interval string, subscriber *subscription.Subscriber, logger *slog.Logger) ([][]byte, uint64, int, error) {
+	pathSegments := strings.Split(resourcePath, "/")
+	if len(pathSegments) < 3 || pathSegments[1] != "v1" {
+		return nil, 0, http.StatusBadRequest, fmt.Errorf("bad request path")
+	}
+	pathSegments = pathSegments[2:]
+	hasTrailingSlash := false
+	if pathSegments[len(pathSegments)-1] == "" {
+		pathSegments = pathSegments[:len(pathSegments)-1]
+		hasTrailingSlash = true
+	}
+
+	minKey := ""
+	maxKey := ""
+	if interval != "" {
+		intervalSplit := getInterval(interval)
+		if len(intervalSplit) != 2 {
+			return nil, 0, http.StatusBadRequest, fmt.Errorf("bad interval")
+		}
+		minKey = intervalSplit[0]
+		maxKey = intervalSplit[1]
+	}
+
+	storageType := GetStorageType(len(pathSegments))
+	if isValid, err := RequestValid("GET", storageType, hasTrailingSlash, interval != "", false, logger); !isValid {
+		return nil, 0, http.StatusBadRequest, err
+	}
+	if !hasTrailingSlash && owldb.access(entry, resourcePath) < acl.Read {
+		return nil, 0, http.StatusForbidden, errPermissionDenied
+	}
+	subscriber.SetFilter(owldb.eventFilter(entry))
+
+	reqSnapshot := httpRequest{
+		request:   "GET",
+		path:      pathSegments,
+		validator: owldb.currentValidator(),
+		username:  entry.username,
+		minKey:    minKey,
+		maxKey:    maxKey,
+		logger:    logger,
+	}
+
+	owldb.snapshotMu.Lock()
+	snapshot, snapStatus := owldb.storage.HandleOperation(reqSnapshot)
+	statusCode, success := GetStatusCode(snapStatus.GetClass())
+	var err error
+	if success {
+		err = owldb.subscription.Register(resourcePath, subscriber)
+	}
+	sequence := owldb.subscription.Sequence()
+	owldb.snapshotMu.Unlock()
+
+	if !success {
+		logger.Warn("Failed to read subscription snapshot", "resourcePath", resourcePath, "statusClass", snapStatus.GetClass())
+		return nil, 0, statusCode, snapStatus.GetError()
+	}
+	if errors.Is(err, subscription.ErrShuttingDown) {
+		return nil, 0, http.StatusServiceUnavailable, err
+	}
+	if err != nil {
+		logger.Error("Failed to add subscriber", "resourcePath", resourcePath, "error", err)
+		return nil, 0, http.StatusBadRequest, fmt.Errorf("unable to add subscriber")
+	}
+
+	snapshotData, err := snapshotEvents(owldb.readableDocuments(entry, snapshot))
+	if err != nil {
+		logger.Error("Failed to encode subscription snapshot", "resourcePath", resourcePath, "error", err)
+		owldb.subscription.Unregister(resourcePath, subscriber)
+		return nil, 0, http.StatusBadRequest, fmt.Errorf("failed to encode response")
+	}
+	return snapshotData, sequence, http.StatusOK, nil
+}
+
+// newSubscriber creates a subscriber with the buffer size, overflow policy and
+// update mode requested by the client, using the defaults for empty values
+// Input: Buffer size parameter (string), Overflow policy parameter (string), Update mode parameter (string)
+// Output: New subscriber, error if any parameter is invalid
+func newSubscriber(bufferParam string, policyParam string, updatesParam string) (*subscription.Subscriber, error) {
+	bufferSize := subscription.DefaultBufferSize
+	if bufferParam != "" {
+		var err error
+		bufferSize, err = strconv.Atoi(bufferParam)
+		if err != nil {
+			return nil, fmt.Errorf("invalid buffer size")
+		}
+	}
+	policy, err := subscription.ParsePolicy(policyParam)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := subscription.ParseUpdateMode(updatesParam)
+	if err != nil {
+		return nil, err
+	}
+	return subscription.NewSubscriber(bufferSize, policy, mode)
+}
+
+// HandleSubscription handles HTTP requests for client subscriptions. The
+// client first receives the current state of the resource as update events,
+// followed by live events with no gap or duplicate in between. The "buffer"
+// and "overflow" query parameters choose how many events may be pending for
+// a slow client and what happens when that limit is reached. The "updates"
+// parameter chooses whether PATCH updates carry the full document ("full"),
+// the applied patch and new version ("patch"), or both ("both").
 // Input: HTTP response writer and request
 // Output: None
 func (owldb *owldb) HandleSubscription(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	owldb.allowOrigin(w, r)
 	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 	w.Header().Set("Content-Type", "application/json")
+	logger := requestLogger(r)
 
 	if owldb == nil {
-		slog.Error("owldb instance is nil")
+		logger.Error("owldb instance is nil")
 	}
 
 	// Check that the client is requesting to subscribe... if not, return error
@@ -562,17 +1007,18 @@ func (owldb *owldb) HandleSubscription(w http.ResponseWriter, r *http.Request) {
 	resourcePath := r.URL.Path
 
 	// Perform authorization
-	authToken, err := processAuthField(r.Header.Get("Authorization"))
+	authToken, err := owldb.bearerToken(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	user, err := owldb.authorize(authToken)
+	entry, err := owldb.lookupToken(authToken)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
+	user := entry.username
 
 	// Convert response writer to flusher
 	flusher, ok := w.(flusher)
@@ -581,64 +1027,92 @@ func (owldb *owldb) HandleSubscription(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	slog.Info("Converted to writeFlusher")
+	logger.Info("Converted to writeFlusher")
+
+	// Create a subscriber for the client
+	subscriber, err := newSubscriber(r.URL.Query().Get("buffer"), r.URL.Query().Get("overflow"), r.URL.Query().Get("updates"))
+	if err != nil {
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(encodederr)
+		return
+	}
+
+	subscriber.SetAuthorizer(owldb.subscriberAuthorizer(authToken))
+
+	snapshotData, sequence, statusCode, err := owldb.openSubscription(resourcePath, entry, r.URL.Query().Get("interval"), subscriber, logger)
+	if err != nil {
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(statusCode)
+		w.Write(encodederr)
+		return
+	}
+	defer owldb.subscription.Unregister(resourcePath, subscriber)
+
+	// Notify that the subscription was successful
+	logger.Info("Subscriber added", "resourcePath", resourcePath, "username", user, "sequence", sequence)
 
 	// Set up event stream connection
 	flusher.Header().Set("Content-Type", "text/event-stream")
 	flusher.Header().Set("Cache-Control", "no-cache")
 	flusher.Header().Set("Connection", "keep-alive")
 	flusher.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Last-Event-ID")
-	flusher.Header().Set("Access-Control-Allow-Origin", "*")
+	owldb.allowOrigin(flusher, r)
 	flusher.WriteHeader(http.StatusOK)
-	flusher.Flush()
-
-	slog.Info("Sent headers")
 
-	// Create a channel for the client
-	subscriberChannel := make(chan string, 10)
+	logger.Info("Sent headers")
 
-	// Add resource path and channel to subscribers
-	err = owldb.subscription.Register(resourcePath, subscriberChannel)
-	if err != nil {
-		slog.Error("Failed to add subscriber", "resourcePath", resourcePath, "error", err)
-		http.Error(w, "Unable to add subscriber", http.StatusBadRequest)
-		return
+	// Send the initial state, tagged with the sequence number it reflects
+	for _, eventData := range snapshotData {
+		snapshotEvent := subscription.Event{Type: "update", Data: eventData, Sequence: sequence}
+		fmt.Fprint(w, snapshotEvent.Format())
 	}
-
-	// Notify that the subscription was successful
-	slog.Info("Subscriber added", "resourcePath", resourcePath, "username", user)
+	flusher.Flush()
 
 	ticker := time.NewTicker(15 * time.Second) // Keep-alive interval
 	defer ticker.Stop()
 
-	// Start a goroutine to listen for messages sent to the client
-	go func() {
-		defer close(subscriberChannel)
-
-		for {
-			select {
-			case message := <-subscriberChannel:
-				// Write message to the client
-				if _, err := fmt.Fprintf(w, "%s\n", message); err != nil {
-					slog.Warn("Failed to write to client", "error", err)
-					owldb.subscription.Unregister(resourcePath, subscriberChannel)
+	// Recheck authorization when the token is due to expire
+	expiry := time.NewTimer(max(owldb.tokenLifetime(authToken), time.Second))
+	defer expiry.Stop()
+
+	// Listen for messages sent to the client
+	for {
+		select {
+		case <-subscriber.Ready():
+			// Write pending messages to the client
+			for _, message := range subscriber.Drain() {
+				if _, err := fmt.Fprintf(w, "%s\n", message.Format()); err != nil {
+					logger.Warn("Failed to write to client", "error", err)
 					return
 				}
-				flusher.Flush()
-			case <-ticker.C:
-				// Send a keep-alive comment
-				fmt.Fprintf(w, ": keep-alive\n\n")
-				flusher.Flush()
-			case <-r.Context().Done():
-				// Handle client disconnection
-				err := r.Context().Err()
-				slog.Info("Client disconnected", "resourcePath", resourcePath, "username", user, "reason", err)
-				owldb.subscription.Unregister(resourcePath, subscriberChannel)
-				return
 			}
+			flusher.Flush()
+		case <-subscriber.Done():
+			// The client fell too far behind, lost its authorization or the
+			// server is shutting down, so end the stream after any events
+			// still pending
+			finalEvent := subscriber.FinalEvent()
+			logger.Warn("Subscription closed", "resourcePath", resourcePath, "username", user, "reason", finalEvent.Type, "dropped", subscriber.Dropped())
+			for _, message := range subscriber.Drain() {
+				fmt.Fprintf(w, "%s\n", message.Format())
+			}
+			fmt.Fprint(w, finalEvent.Format())
+			flusher.Flush()
+			return
+		case <-expiry.C:
+			if subscriber.Recheck() {
+				expiry.Reset(max(owldb.tokenLifetime(authToken), time.Second))
+			}
+		case <-ticker.C:
+			// Send a keep-alive comment
+			fmt.Fprintf(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			// Handle client disconnection
+			err := r.Context().Err()
+			logger.Info("Client disconnected", "resourcePath", resourcePath, "username", user, "reason", err)
+			return
 		}
-	}()
-
-	// Keep the connection open
-	<-r.Context().Done()
+	}
 }
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/subscription"
+)
+
+// shutdownRetry is how long clients are told to wait before reconnecting or
+// retrying a write while the server shuts down
+const shutdownRetry = 5 * time.Second
+
+// Version is the server version reported by /v1/_info, set when building
+// with -ldflags "-X github.com/RICE-COMP318-FALL24/owldb-p1group35/handlers.Version=<version>"
+var Version = "dev"
+
+// infoResponse is the response to GET /v1/_info
+type infoResponse struct {
+	Version       string          `json:"version"`
+	StartedAt     time.Time       `json:"startedAt"`
+	UptimeSeconds int64           `json:"uptimeSeconds"`
+	Databases     int             `json:"databases"`
+	Features      map[string]bool `json:"features"`
+}
+
+// StartDraining prepares the server to shut down: the readiness probe fails
+// so load balancers stop sending it new requests, writes and new
+// subscriptions are refused, and open subscriptions end with a shutdown
+// event telling clients when to reconnect
+// Input: None
+// Output: None
+func (owldb *owldb) StartDraining() {
+	if !owldb.draining.Swap(true) {
+		slog.Info("Draining, readiness probe now fails and writes are refused")
+		owldb.subscription.Shutdown(shutdownRetry)
+	}
+}
+
+// refuseWhileDraining answers 503 with a Retry-After header to writes and
+// subscriptions once the server is draining. Reads are still served.
+// Input: HTTP response writer and request
+// Output: Boolean indicating if the request was refused
+func (owldb *owldb) refuseWhileDraining(w http.ResponseWriter, r *http.Request) bool {
+	if !owldb.draining.Load() || (!isMutation(r.Method) && r.URL.Query().Get("mode") != "subscribe") {
+		return false
+	}
+	requestLogger(r).Info("Refused request while draining", "method", r.Method, "path", r.URL.Path)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(shutdownRetry)))
+	encodederr, _ := json.Marshal(subscription.ErrShuttingDown.Error())
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(encodederr)
+	return true
+}
+
+// features reports which optional features are configured
+// Input: None
+// Output: Map from feature name to whether it is enabled
+func (owldb *owldb) features() map[string]bool {
+	rateLimited := false
+	for _, limiter := range owldb.limiters {
+		rateLimited = rateLimited || !limiter.Limit().Unlimited()
+	}
+	return map[string]bool{
+		"passwordLogin":      owldb.credentials != nil,
+		"jwt":                owldb.jwtKey != nil,
+		"sessionPersistence": owldb.dataDir != "",
+		"auditLog":           owldb.audit != nil,
+		"rateLimits":         rateLimited,
+		"documentSizeLimit":  owldb.documentLimits.MaxSize > 0,
+		"clientCertAuth":     owldb.clientCerts != nil,
+	}
+}
+
+// HandleHealth answers the liveness probe (GET /healthz). It succeeds as
+// long as the server is able to handle requests.
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, http.StatusOK, "ok")
+}
+
+// HandleReady answers the readiness probe (GET /readyz). The schema, tokens
+// and saved state are loaded before the server starts listening, so it only
+// fails once the server starts draining for shutdown.
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if owldb.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, "draining")
+	} else {
+		writeJSON(w, http.StatusOK, "ready")
+	}
+}
+
+// HandleInfo returns the version, uptime, number of databases and enabled
+// features of the server (GET /v1/_info)
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleInfo(w http.ResponseWriter, r *http.Request) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "GET")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	authToken, err := owldb.bearerToken(r)
+	if err == nil {
+		_, err = owldb.authorize(authToken)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if r.Method != "GET" {
+		writeJSON(w, http.StatusBadRequest, "bad request")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, infoResponse{
+		Version:       Version,
+		StartedAt:     owldb.startedAt,
+		UptimeSeconds: int64(time.Since(owldb.startedAt).Seconds()),
+		Databases:     len(owldb.storage.DatabaseSizes()),
+		Features:      owldb.features(),
+	})
+}
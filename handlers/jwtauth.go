@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/jwt"
+)
+
+// revocationsFileName is the file in the data directory holding revoked JWTs
+const revocationsFileName = "revoked.json"
+
+// revocationRetention is the longest lifetime of a JWT, unless login tokens
+// last longer, and so how long revocations need to be kept
+const revocationRetention = 30 * 24 * time.Hour
+
+// revocationList records JWTs that were revoked before they expired. IDs
+// maps a token ID to its expiry, after which the entry is dropped; Users
+// maps a username to a time before which all of its tokens were issued and
+// are revoked.
+type revocationList struct {
+	IDs   map[string]time.Time `json:"ids"`
+	Users map[string]time.Time `json:"users"`
+}
+
+// newRevocationList creates an empty revocation list
+// Input: None
+// Output: revocationList
+func newRevocationList() revocationList {
+	return revocationList{IDs: make(map[string]time.Time), Users: make(map[string]time.Time)}
+}
+
+// merge adds the entries of another revocation list, keeping the latest
+// revocation of each user
+// Input: Other revocationList
+// Output: None
+func (revoked revocationList) merge(other revocationList) {
+	for id, expiration := range other.IDs {
+		revoked.IDs[id] = expiration
+	}
+	for user, revokedAt := range other.Users {
+		if revokedAt.After(revoked.Users[user]) {
+			revoked.Users[user] = revokedAt
+		}
+	}
+}
+
+// prune drops revoked token IDs that have expired and user revocations older
+// than any token they could still apply to
+// Input: Current time (time.Time), longest lifetime of a JWT (time.Duration)
+// Output: None
+func (revoked revocationList) prune(now time.Time, maxLifetime time.Duration) {
+	for id, expiration := range revoked.IDs {
+		if now.After(expiration) {
+			delete(revoked.IDs, id)
+		}
+	}
+	for user, revokedAt := range revoked.Users {
+		if now.Sub(revokedAt) > maxLifetime {
+			delete(revoked.Users, user)
+		}
+	}
+}
+
+// maxJWTLifetime returns the longest lifetime a JWT may be issued with
+// Input: None
+// Output: time.Duration
+func (owldb *owldb) maxJWTLifetime() time.Duration {
+	return max(owldb.sessionLifetime, revocationRetention)
+}
+
+// newJWTID returns a random token ID that records when the token was issued,
+// to the nanosecond, as the issued at claim is only in whole seconds
+// Input: Issue time (time.Time)
+// Output: Token ID (string)
+func newJWTID(issued time.Time) string {
+	return strconv.FormatInt(issued.UnixNano(), 10) + "-" + rand.Text()
+}
+
+// parseJWTID returns the issue time recorded in a token ID made by newJWTID
+// Input: Token ID (string)
+// Output: Issue time (time.Time), error if the ID is not in that form
+func parseJWTID(id string) (time.Time, error) {
+	nanos, random, found := strings.Cut(id, "-")
+	issued, err := strconv.ParseInt(nanos, 10, 64)
+	if !found || err != nil || len(random) != len(rand.Text()) || strings.Trim(random, "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567") != "" {
+		return time.Time{}, fmt.Errorf("invalid token ID")
+	}
+	return time.Unix(0, issued), nil
+}
+
+// issueJWT signs a token for a user, valid for the given lifetime. Must be
+// called with owldb.mu held.
+// Input: Username (string), Scopes ([]tokenScope), nil for none, Lifetime (time.Duration)
+// Output: Token (string), token ID (string), expiry (time.Time), error if any
+func (owldb *owldb) issueJWT(username string, scopes []tokenScope, lifetime time.Duration) (string, string, time.Time, error) {
+	now := time.Now()
+	expiration := now.Add(lifetime).Truncate(time.Second)
+	claims := jwt.Claims{
+		Subject:   username,
+		ID:        newJWTID(now),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiration.Unix(),
+		Scopes:    scopeStrings(scopes),
+	}
+	token, err := jwt.Sign(claims, owldb.jwtKey)
+	return token, claims.ID, expiration, err
+}
+
+// verifyJWT checks a JWT's signature, claims and the revocation list. Must be
+// called with owldb.mu held.
+// Input: Token (string)
+// Output: authEntry for the token, error if it is invalid or revoked
+func (owldb *owldb) verifyJWT(token string) (authEntry, error) {
+	claims, err := jwt.Verify(token, owldb.jwtKey, time.Now())
+	if err != nil {
+		return authEntry{}, fmt.Errorf("missing or invalid bearer token")
+	}
+	if _, revoked := owldb.revoked.IDs[claims.ID]; revoked {
+		return authEntry{}, fmt.Errorf("missing or invalid bearer token")
+	}
+	issued, err := parseJWTID(claims.ID)
+	if err != nil {
+		return authEntry{}, fmt.Errorf("missing or invalid bearer token")
+	}
+	if revokedAt, revoked := owldb.revoked.Users[claims.Subject]; revoked && issued.Before(revokedAt) {
+		return authEntry{}, fmt.Errorf("missing or invalid bearer token")
+	}
+
+	entry := authEntry{username: claims.Subject, expiration: claims.Expiration(), jwtID: claims.ID}
+	if claims.Scopes != nil {
+		entry.scopes, err = parseScopes(claims.Scopes)
+		if err != nil {
+			return authEntry{}, fmt.Errorf("missing or invalid bearer token")
+		}
+		entry.service = true
+	}
+	return entry, nil
+}
+
+// revokeJWT adds a token ID to the revocation list. Must be called with
+// owldb.mu held.
+// Input: Token ID (string), expiry of the token (time.Time)
+// Output: None
+func (owldb *owldb) revokeJWT(id string, expiration time.Time) {
+	owldb.revoked.IDs[id] = expiration
+	owldb.saveRevocations()
+}
+
+// revokeUserJWTs revokes every JWT issued to a user so far. Must be called
+// with owldb.mu held.
+// Input: Username (string)
+// Output: None
+func (owldb *owldb) revokeUserJWTs(username string) {
+	owldb.revoked.Users[username] = time.Now()
+	owldb.saveRevocations()
+}
+
+// loadRevocations reads the revocation list saved in the data directory
+// Input: Data directory (string)
+// Output: revocationList, error if the file is unreadable
+func loadRevocations(dataDir string) (revocationList, error) {
+	revoked := newRevocationList()
+	data, err := os.ReadFile(filepath.Join(dataDir, revocationsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return revoked, nil
+	}
+	if err != nil {
+		return revoked, fmt.Errorf("revocations file could not be read")
+	}
+	if err := json.Unmarshal(data, &revoked); err != nil {
+		return newRevocationList(), fmt.Errorf("revocations file in incorrect format")
+	}
+	if revoked.IDs == nil {
+		revoked.IDs = make(map[string]time.Time)
+	}
+	if revoked.Users == nil {
+		revoked.Users = make(map[string]time.Time)
+	}
+	return revoked, nil
+}
+
+// saveRevocations merges the revocation list saved by other instances sharing
+// the data directory, drops stale entries and writes the result back,
+// replacing the file atomically. Must be called with owldb.mu held.
+// Input: None
+// Output: None
+func (owldb *owldb) saveRevocations() {
+	if owldb.dataDir != "" {
+		saved, err := loadRevocations(owldb.dataDir)
+		if err != nil {
+			slog.Warn("Failed to read revocations", "error", err)
+		}
+		owldb.revoked.merge(saved)
+	}
+	owldb.revoked.prune(time.Now(), owldb.maxJWTLifetime())
+	if owldb.dataDir == "" {
+		return
+	}
+	encoded, err := json.Marshal(owldb.revoked)
+	if err != nil {
+		slog.Error("Failed to encode revocations", "error", err)
+		return
+	}
+	tmp, err := os.CreateTemp(owldb.dataDir, ".revoked-*.json")
+	if err != nil {
+		slog.Error("Failed to save revocations", "error", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(encoded)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(owldb.dataDir, revocationsFileName))
+	}
+	if err != nil {
+		slog.Error("Failed to save revocations", "error", err)
+	}
+}
+
+// syncRevocations merges the revocation list saved by other instances sharing
+// the data directory and drops entries for tokens that have expired
+// Input: None
+// Output: None
+func (owldb *owldb) syncRevocations() {
+	owldb.mu.Lock()
+	owldb.saveRevocations()
+	owldb.mu.Unlock()
+
+	// Tokens revoked by other instances end their subscriptions here too
+	owldb.subscription.Recheck()
+}
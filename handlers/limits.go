@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/storage"
+)
+
+// DefaultMaxBodySize is the largest request body accepted for any method
+// that is not configured
+const DefaultMaxBodySize = 1 << 20
+
+// DefaultMaxDepth is how deeply documents may be nested when not configured
+const DefaultMaxDepth = 64
+
+// AllMethods is the key of body limits that apply to every method without
+// its own limit
+const AllMethods = "*"
+
+// errBodyTooLarge is returned when a request body is over its limit
+var errBodyTooLarge = errors.New("request body too large")
+
+// rejectionCounters counts requests rejected for breaking a size limit
+type rejectionCounters struct {
+	bodyTooLarge     atomic.Uint64
+	documentTooLarge atomic.Uint64
+	documentTooDeep  atomic.Uint64
+}
+
+// rejectionCounts is a snapshot of rejectionCounters
+type rejectionCounts struct {
+	BodyTooLarge     uint64 `json:"bodyTooLarge"`
+	DocumentTooLarge uint64 `json:"documentTooLarge"`
+	DocumentTooDeep  uint64 `json:"documentTooDeep"`
+}
+
+// limitsResponse is the response to GET /admin/limits
+type limitsResponse struct {
+	MaxBodySize map[string]int64       `json:"maxBodySize"`
+	Document    storage.DocumentLimits `json:"document"`
+	Rejected    rejectionCounts        `json:"rejected"`
+}
+
+// ParseBodyLimits converts body limits written as a comma separated list of
+// "<METHOD>=<bytes>" entries to a map from method to limit. A bare "<bytes>"
+// entry applies to every method without its own limit.
+// Input: Body limits (string)
+// Output: Map from method to limit in bytes, error if malformed
+func ParseBodyLimits(limits string) (map[string]int64, error) {
+	parsed := make(map[string]int64)
+	if limits == "" {
+		return parsed, nil
+	}
+	for _, entry := range strings.Split(limits, ",") {
+		method, sizeText, hasMethod := strings.Cut(strings.TrimSpace(entry), "=")
+		if !hasMethod {
+			method, sizeText = AllMethods, method
+		}
+		size, err := strconv.ParseInt(sizeText, 10, 64)
+		if err != nil || size < 0 || method == "" {
+			return nil, fmt.Errorf("invalid body limit %q", entry)
+		}
+		parsed[strings.ToUpper(method)] = size
+	}
+	return parsed, nil
+}
+
+// bodyLimit returns the largest body accepted for a method, 0 if unlimited
+// Input: HTTP method (string)
+// Output: Limit in bytes (int64)
+func (owldb *owldb) bodyLimit(method string) int64 {
+	if limit, exists := owldb.maxBodySize[method]; exists {
+		return limit
+	}
+	return owldb.maxBodySize[AllMethods]
+}
+
+// readBody reads the request body, stopping at the method's body limit
+// Input: HTTP response writer and request
+// Output: Body ([]byte), errBodyTooLarge if over the limit or the read error
+func (owldb *owldb) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body := r.Body
+	if limit := owldb.bodyLimit(r.Method); limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	requestBody, err := io.ReadAll(body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		owldb.rejections.bodyTooLarge.Add(1)
+		slog.Warn("Request body too large", "method", r.Method, "path", r.URL.Path, "limit", maxBytesErr.Limit)
+		return nil, errBodyTooLarge
+	}
+	return requestBody, err
+}
+
+// bodyErrorStatus returns the status code for an error from readBody
+// Input: error
+// Output: 413 if the body was too large, 400 otherwise
+func bodyErrorStatus(err error) int {
+	if errors.Is(err, errBodyTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// countDocumentRejection counts a storage request that failed because the
+// document broke its limits
+// Input: error from the storage operation
+// Output: None
+func (owldb *owldb) countDocumentRejection(err error) {
+	if errors.Is(err, storage.ErrDocumentTooLarge) {
+		owldb.rejections.documentTooLarge.Add(1)
+	} else if errors.Is(err, storage.ErrDocumentTooDeep) {
+		owldb.rejections.documentTooDeep.Add(1)
+	}
+}
+
+// rejectionCounts returns the number of requests rejected for each limit
+// Input: None
+// Output: rejectionCounts
+func (owldb *owldb) rejectionCounts() rejectionCounts {
+	return rejectionCounts{
+		BodyTooLarge:     owldb.rejections.bodyTooLarge.Load(),
+		DocumentTooLarge: owldb.rejections.documentTooLarge.Load(),
+		DocumentTooDeep:  owldb.rejections.documentTooDeep.Load(),
+	}
+}
+
+// HandleAdminLimits shows the size limits and how many requests each has
+// rejected (GET /admin/limits)
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleAdminLimits(w http.ResponseWriter, r *http.Request) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "GET")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	_, statusCode, err := owldb.requireAdmin(r)
+	if err != nil {
+		writeJSON(w, statusCode, err.Error())
+		return
+	}
+	if r.Method != "GET" {
+		writeJSON(w, http.StatusBadRequest, "bad request")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, limitsResponse{
+		MaxBodySize: owldb.maxBodySize,
+		Document:    owldb.documentLimits,
+		Rejected:    owldb.rejectionCounts(),
+	})
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/subtle"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/metrics"
+)
+
+// maxDatabaseSeries is how many databases, the largest first, get their own
+// document count series, as database names are chosen by clients
+const maxDatabaseSeries = 20
+
+// serverMetrics holds the metrics counted as requests are handled. Values
+// kept elsewhere, such as subscriber counts, are read when scraped.
+type serverMetrics struct {
+	requests *metrics.Counter
+	latency  *metrics.Histogram
+	auth     *metrics.Counter
+}
+
+// newServerMetrics creates empty request and auth metrics
+// Input: None
+// Output: serverMetrics
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests: metrics.NewCounter("owldb_requests_total",
+			"Storage requests handled, by method, storage type and status class.",
+			"method", "storage_type", "status_class"),
+		latency: metrics.NewHistogram("owldb_request_duration_seconds",
+			"Time taken to handle storage requests other than subscriptions.",
+			metrics.DefaultBuckets, "method", "storage_type"),
+		auth: metrics.NewCounter("owldb_auth_requests_total",
+			"Logins and logouts, by whether they succeeded.",
+			"action", "result"),
+	}
+}
+
+// loadMetricsToken reads the token that may scrape /metrics
+// Input: Token file path (string)
+// Output: Hash of the token (string), error if the file is unreadable or empty
+func loadMetricsToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("metrics token file could not be read")
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("metrics token file is empty")
+	}
+	return hashToken(token), nil
+}
+
+// isMetricsToken reports whether a request carries the metrics token
+// Input: HTTP request
+// Output: Boolean
+func (owldb *owldb) isMetricsToken(r *http.Request) bool {
+	if owldb.metricsToken == "" {
+		return false
+	}
+	authToken, err := owldb.bearerToken(r)
+	return err == nil && subtle.ConstantTimeCompare([]byte(hashToken(authToken)), []byte(owldb.metricsToken)) == 1
+}
+
+// storageTypeOf returns the storage type of a /v1/ path as given by
+// GetStorageType, or "Root" for /v1/ itself
+// Input: Request path (string)
+// Output: Storage type (string)
+func storageTypeOf(requestPath string) string {
+	trimmed := strings.Trim(strings.TrimPrefix(requestPath, "/v1"), "/")
+	if trimmed == "" {
+		return "Root"
+	}
+	return GetStorageType(len(strings.Split(trimmed, "/")))
+}
+
+// methodOf returns the method of a request as a metric label, with any
+// method the server does not handle counted as OTHER, since clients choose it
+// Input: HTTP method (string)
+// Output: Method label (string)
+func methodOf(method string) string {
+	switch method {
+	case "GET", "PUT", "POST", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "OTHER"
+}
+
+// statusClassOf returns the status class of a response: the storage status
+// class if the request reached storage, or the text of its HTTP status
+// Input: Status code (int), Storage status class (string), empty if none
+// Output: Status class (string)
+func statusClassOf(code int, statusClass string) string {
+	if statusClass != "" {
+		return statusClass
+	}
+	return http.StatusText(code)
+}
+
+// observeStorage counts a storage request and, unless it was a
+// subscription, records how long it took
+// Input: HTTP request, Status code (int), Storage status class (string), Elapsed time (time.Duration)
+// Output: None
+func (owldb *owldb) observeStorage(r *http.Request, code int, statusClass string, elapsed time.Duration) {
+	method, storageType := methodOf(r.Method), storageTypeOf(r.URL.Path)
+	owldb.metrics.requests.Inc(method, storageType, statusClassOf(code, statusClass))
+	if r.URL.Query().Get("mode") != "subscribe" {
+		owldb.metrics.latency.Observe(elapsed.Seconds(), method, storageType)
+	}
+}
+
+// observeAuth counts a login (POST) or logout (DELETE)
+// Input: HTTP method (string), Status code (int)
+// Output: None
+func (owldb *owldb) observeAuth(method string, code int) {
+	action := "login"
+	if method == "DELETE" {
+		action = "logout"
+	}
+	result := "success"
+	if code >= 400 {
+		result = "failure"
+	}
+	owldb.metrics.auth.Inc(action, result)
+}
+
+// HandleMetrics writes every metric in the Prometheus text format (GET
+// /metrics). Only admins and the metrics token may read them, since they
+// name databases.
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !owldb.isMetricsToken(r) {
+		if _, statusCode, err := owldb.requireAdmin(r); err != nil {
+			writeJSON(w, statusCode, err.Error())
+			return
+		}
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, "bad request")
+		return
+	}
+
+	var out bytes.Buffer
+	owldb.metrics.requests.Write(&out)
+	owldb.metrics.latency.Write(&out)
+	owldb.metrics.auth.Write(&out)
+
+	metrics.WriteSamples(&out, "owldb_subscribers", "Open subscriptions.", "gauge", nil,
+		[]metrics.Sample{{Value: float64(owldb.subscription.Count())}})
+
+	sizes := owldb.storage.DatabaseSizes()
+	total := 0
+	for _, size := range sizes {
+		total += size
+	}
+	metrics.WriteSamples(&out, "owldb_databases", "Databases.", "gauge", nil,
+		[]metrics.Sample{{Value: float64(len(sizes))}})
+	metrics.WriteSamples(&out, "owldb_documents", "Documents directly in any database.", "gauge", nil,
+		[]metrics.Sample{{Value: float64(total)}})
+
+	largest := slices.SortedFunc(maps.Keys(sizes), func(a, b string) int {
+		return cmp.Or(cmp.Compare(sizes[b], sizes[a]), strings.Compare(a, b))
+	})
+	documents := make([]metrics.Sample, 0, maxDatabaseSeries)
+	for _, database := range largest[:min(len(largest), maxDatabaseSeries)] {
+		documents = append(documents, metrics.Sample{Labels: []string{database}, Value: float64(sizes[database])})
+	}
+	metrics.WriteSamples(&out, "owldb_database_documents", "Documents directly in each of the largest databases.", "gauge",
+		[]string{"database"}, documents)
+
+	rejected := owldb.rejectionCounts()
+	metrics.WriteSamples(&out, "owldb_rejected_requests_total", "Requests rejected for breaking a size limit.", "counter",
+		[]string{"reason"}, []metrics.Sample{
+			{Labels: []string{"body_too_large"}, Value: float64(rejected.BodyTooLarge)},
+			{Labels: []string{"document_too_large"}, Value: float64(rejected.DocumentTooLarge)},
+			{Labels: []string{"document_too_deep"}, Value: float64(rejected.DocumentTooDeep)},
+		})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out.Bytes())
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/acl"
+)
+
+// databasePolicy holds the opt-in rules of one database
+type databasePolicy struct {
+	// OwnerOnly lets only a document's creator, or an admin user, overwrite,
+	// patch or delete it
+	OwnerOnly bool `json:"ownerOnly"`
+}
+
+// policiesFileName is the file next to the ACL file holding database policies
+const policiesFileName = "policies.json"
+
+// policyResponse describes the policy of a database
+type policyResponse struct {
+	Path string `json:"path"`
+	databasePolicy
+}
+
+// ownerOnly reports whether the owner-only policy applies to a user's
+// request on a database. Admin users from the users file are exempt.
+// Input: Database name (string), Username (string)
+// Output: Boolean
+func (owldb *owldb) ownerOnly(database string, user string) bool {
+	owldb.policyMu.RLock()
+	policy := owldb.policies[database]
+	owldb.policyMu.RUnlock()
+
+	if !policy.OwnerOnly {
+		return false
+	}
+	return owldb.credentials == nil || !owldb.credentials.isAdmin(user)
+}
+
+// removePolicy forgets the policy of a deleted database
+// Input: Database name (string)
+// Output: None
+func (owldb *owldb) removePolicy(database string) {
+	owldb.policyMu.Lock()
+	defer owldb.policyMu.Unlock()
+	if _, ok := owldb.policies[database]; !ok {
+		return
+	}
+	delete(owldb.policies, database)
+	if err := owldb.savePolicies(); err != nil {
+		slog.Error("Failed to save policies", "error", err)
+	}
+}
+
+// loadPolicies reads the database policies saved next to the ACL file
+// Input: Policies file path (string), empty to keep policies in memory only
+// Output: Map from database name to policy, error if the file is unreadable
+func loadPolicies(path string) (map[string]databasePolicy, error) {
+	policies := make(map[string]databasePolicy)
+	if path == "" {
+		return policies, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return policies, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("policies file could not be read")
+	}
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("policies file in incorrect format")
+	}
+	slog.Info("Loaded database policies", "path", path, "policies", len(policies))
+	return policies, nil
+}
+
+// savePolicies writes the database policies to their file, replacing it
+// atomically. Must be called with owldb.policyMu held.
+// Input: None
+// Output: Error if the file cannot be written
+func (owldb *owldb) savePolicies() error {
+	if owldb.policyFile == "" {
+		return nil
+	}
+	encoded, err := json.MarshalIndent(owldb.policies, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(owldb.policyFile), ".policies-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(encoded)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), owldb.policyFile)
+}
+
+// HandlePolicy reads (GET) or replaces (PUT) the policy of a database, for
+// requests on a database path with mode=policy. The user needs admin
+// permission on the database, see canManage.
+// Input: HTTP response writer, request and the request body
+// Output: None
+func (owldb *owldb) HandlePolicy(w http.ResponseWriter, r *http.Request, requestBody []byte) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		allowedMethods := "GET, PUT"
+		w.Header().Set("Allow", allowedMethods)
+		w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	resource, err := acl.Normalize(r.URL.Path)
+	database := strings.TrimPrefix(resource, "/v1/")
+	if err != nil || strings.Contains(database, "/") {
+		encodederr, _ := json.Marshal("bad request path")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(encodederr)
+		return
+	}
+
+	authToken, err := owldb.bearerToken(r)
+	if err != nil {
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(encodederr)
+		return
+	}
+	entry, err := owldb.lookupToken(authToken)
+	if err != nil {
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(encodederr)
+		return
+	}
+	if !owldb.limitRequest(w, storageRouteClass(r.Method, false), entry.username) {
+		return
+	}
+	if statusCode, err := owldb.canManage(entry, resource, r.Method); err != nil {
+		slog.Warn("Policy change denied", "username", entry.username, "database", database, "error", err)
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(statusCode)
+		w.Write(encodederr)
+		return
+	}
+	if _, err := owldb.storage.Creator([]string{database}); err != nil {
+		encodederr, _ := json.Marshal("database does not exist")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(encodederr)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		owldb.policyMu.RLock()
+		policy := owldb.policies[database]
+		owldb.policyMu.RUnlock()
+		writeJSON(w, http.StatusOK, policyResponse{Path: resource, databasePolicy: policy})
+	case "PUT":
+		var policy databasePolicy
+		if err := json.Unmarshal(requestBody, &policy); err != nil {
+			encodederr, _ := json.Marshal("policy in incorrect format")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(encodederr)
+			return
+		}
+		owldb.policyMu.Lock()
+		previous, existed := owldb.policies[database]
+		owldb.policies[database] = policy
+		if err := owldb.savePolicies(); err != nil {
+			if existed {
+				owldb.policies[database] = previous
+			} else {
+				delete(owldb.policies, database)
+			}
+			owldb.policyMu.Unlock()
+			slog.Error("Failed to save policies", "error", err)
+			encodederr, _ := json.Marshal("failed to save policy")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(encodederr)
+			return
+		}
+		owldb.policyMu.Unlock()
+		slog.Info("Database policy updated", "database", database, "ownerOnly", policy.OwnerOnly)
+		writeJSON(w, http.StatusOK, policyResponse{Path: resource, databasePolicy: policy})
+	default:
+		encodederr, _ := json.Marshal("bad request")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(encodederr)
+	}
+}
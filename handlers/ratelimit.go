@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/ratelimit"
+)
+
+// Route classes with their own rate limit. Storage requests are limited per
+// user and /auth requests per client address.
+const (
+	RouteReads         = "reads"
+	RouteWrites        = "writes"
+	RouteSubscriptions = "subscriptions"
+	RouteAuth          = "auth"
+)
+
+// routeClasses lists every route class
+var routeClasses = []string{RouteReads, RouteWrites, RouteSubscriptions, RouteAuth}
+
+// limiterState describes the limit and buckets of one route class
+type limiterState struct {
+	Limit   ratelimit.Limit         `json:"limit"`
+	Buckets []ratelimit.BucketState `json:"buckets"`
+}
+
+// newLimiters creates a limiter for every route class, unlimited unless
+// configured
+// Input: Map from route class to Limit
+// Output: Map from route class to Limiter
+func newLimiters(limits map[string]ratelimit.Limit) map[string]*ratelimit.Limiter {
+	limiters := make(map[string]*ratelimit.Limiter, len(routeClasses))
+	for _, class := range routeClasses {
+		limiters[class] = ratelimit.New(limits[class])
+	}
+	return limiters
+}
+
+// storageRouteClass returns the route class of a storage request
+// Input: HTTP method (string), Subscribe mode (bool)
+// Output: Route class (string)
+func storageRouteClass(method string, subscribe bool) string {
+	if method == "GET" && subscribe {
+		return RouteSubscriptions
+	} else if method == "GET" {
+		return RouteReads
+	}
+	return RouteWrites
+}
+
+// clientAddress returns the address a request came from, without the port
+// Input: HTTP request
+// Output: Client address (string)
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowRequest takes a token from the key's bucket for the route class
+// Input: Route class (string), Key (string)
+// Output: Boolean indicating if the request may proceed, and how long to wait otherwise
+func (owldb *owldb) allowRequest(class string, key string) (bool, time.Duration) {
+	allowed, wait := owldb.limiters[class].Allow(key)
+	if !allowed {
+		slog.Warn("Rate limit exceeded", "class", class, "key", key, "retryAfter", wait)
+	}
+	return allowed, wait
+}
+
+// limitRequest applies the rate limit of the route class, answering 429 with
+// a Retry-After header when the key has no tokens left
+// Input: HTTP response writer, Route class (string), Key (string)
+// Output: Boolean indicating if the request may proceed
+func (owldb *owldb) limitRequest(w http.ResponseWriter, class string, key string) bool {
+	allowed, wait := owldb.allowRequest(class, key)
+	if allowed {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+	encodederr, _ := json.Marshal("rate limit exceeded")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(encodederr)
+	return false
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds for Retry-After
+// Input: Wait (time.Duration)
+// Output: Seconds (int), at least one
+func retryAfterSeconds(wait time.Duration) int {
+	return max(int(math.Ceil(wait.Seconds())), 1)
+}
+
+// pruneLimiters forgets buckets that have refilled completely
+// Input: None
+// Output: None
+func (owldb *owldb) pruneLimiters() {
+	for _, limiter := range owldb.limiters {
+		limiter.Prune()
+	}
+}
+
+// HandleAdminRateLimits shows the limit and current buckets of every route
+// class (GET /admin/ratelimits)
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleAdminRateLimits(w http.ResponseWriter, r *http.Request) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "GET")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	_, statusCode, err := owldb.requireAdmin(r)
+	if err != nil {
+		writeJSON(w, statusCode, err.Error())
+		return
+	}
+	if r.Method != "GET" {
+		writeJSON(w, http.StatusBadRequest, "bad request")
+		return
+	}
+
+	state := make(map[string]limiterState, len(owldb.limiters))
+	for class, limiter := range owldb.limiters {
+		state[class] = limiterState{Limit: limiter.Limit(), Buckets: limiter.State()}
+	}
+	writeJSON(w, http.StatusOK, state)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/jsondata"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// reloadResponse is the response to POST /admin/reload
+type reloadResponse struct {
+	Schema string `json:"schema"`
+	Tokens int    `json:"tokens"`
+}
+
+// currentValidator returns the validator for new documents, which a reload
+// may replace
+// Input: None
+// Output: JSON validator
+func (owldb *owldb) currentValidator() jsondata.Validator {
+	owldb.mu.RLock()
+	defer owldb.mu.RUnlock()
+	return owldb.validator
+}
+
+// Reload recompiles the schema file and rereads the token file, then swaps
+// both in at once. If either cannot be loaded the running schema and tokens
+// are kept, so a bad edit never takes effect halfway. Login sessions and
+// service tokens are kept, and subscriptions opened with removed tokens end.
+// Input: None
+// Output: Number of tokens loaded, error describing what failed to load
+func (owldb *owldb) Reload() (int, error) {
+	schema, err := jsonschema.Compile(owldb.schemaFile)
+	if err != nil {
+		return 0, fmt.Errorf("schema file %s: %w", owldb.schemaFile, err)
+	}
+	authMap, err := readTokenFile(owldb.tokenFile)
+	if err != nil {
+		return 0, fmt.Errorf("token file %s: %w", owldb.tokenFile, err)
+	}
+	entries := staticEntries(authMap, owldb.staticLifetime)
+
+	owldb.mu.Lock()
+	owldb.validator = schema
+	owldb.replaceStaticEntries(entries)
+	owldb.mu.Unlock()
+
+	owldb.subscription.Recheck()
+	slog.Info("Reloaded schema and token files", "schema", owldb.schemaFile, "tokens", owldb.tokenFile, "users", len(entries))
+	return len(entries), nil
+}
+
+// HandleAdminReload reloads the schema and token files (POST /admin/reload),
+// as SIGHUP does
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleAdminReload(w http.ResponseWriter, r *http.Request) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "POST")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	admin, statusCode, err := owldb.requireAdmin(r)
+	if err != nil {
+		writeJSON(w, statusCode, err.Error())
+		return
+	}
+	if r.Method != "POST" {
+		writeJSON(w, http.StatusBadRequest, "bad request")
+		return
+	}
+
+	loaded, err := owldb.Reload()
+	if err != nil {
+		slog.Error("Reload failed, keeping the running schema and tokens", "error", err, "by", admin)
+		writeJSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("Schema and token files reloaded", "by", admin)
+	writeJSON(w, http.StatusOK, reloadResponse{Schema: owldb.schemaFile, Tokens: loaded})
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+)
+
+// RequestIDHeader carries the ID that correlates the logs of a request
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID accepted from a client
+const maxRequestIDLength = 128
+
+// requestContextKey is the context key of a request's requestContext
+type requestContextKey struct{}
+
+// requestContext is the ID and logger of a request
+type requestContext struct {
+	id     string
+	logger *slog.Logger
+}
+
+// validRequestID reports whether a client supplied request ID is safe to log
+// and echo: short, and made only of letters, digits and "-_.:"
+// Input: Request ID (string)
+// Output: Boolean
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		isAlnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlnum && c != '-' && c != '_' && c != '.' && c != ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID makes sure the request has an ID and a logger that includes
+// the ID, method and path. A request that already has an ID keeps it;
+// otherwise the ID is taken from its X-Request-ID header if valid, or newly
+// generated. The ID is echoed in the response.
+// Input: HTTP response writer and request
+// Output: Request carrying the ID and logger in its context, and the logger
+func withRequestID(w http.ResponseWriter, r *http.Request) (*http.Request, *slog.Logger) {
+	if current, ok := r.Context().Value(requestContextKey{}).(requestContext); ok {
+		w.Header().Set(RequestIDHeader, current.id)
+		return r, current.logger
+	}
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = rand.Text()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	return attachRequestID(r, id)
+}
+
+// attachRequestID gives the request the given ID and a logger that includes
+// the ID, method and path, replacing any it had
+// Input: HTTP request, Request ID (string)
+// Output: Request carrying the ID and logger in its context, and the logger
+func attachRequestID(r *http.Request, id string) (*http.Request, *slog.Logger) {
+	logger := slog.With("requestID", id, "method", r.Method, "path", r.URL.Path)
+	ctx := context.WithValue(r.Context(), requestContextKey{}, requestContext{id: id, logger: logger})
+	return r.WithContext(ctx), logger
+}
+
+// WithRequestID wraps a handler so every request has an ID and a request
+// scoped logger, see withRequestID
+// Input: HTTP handler
+// Output: HTTP handler
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, _ = withRequestID(w, r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withUser adds the authenticated user to the request's logger and access
+// log entry
+// Input: HTTP request, Username (string)
+// Output: Request carrying the new logger in its context, and the logger
+func withUser(r *http.Request, user string) (*http.Request, *slog.Logger) {
+	noteUser(r, user)
+	current, ok := r.Context().Value(requestContextKey{}).(requestContext)
+	if !ok {
+		return r, slog.Default().With("username", user)
+	}
+	current.logger = current.logger.With("username", user)
+	return r.WithContext(context.WithValue(r.Context(), requestContextKey{}, current)), current.logger
+}
+
+// requestID returns the ID of a request, or an empty string if it has none
+// Input: HTTP request
+// Output: Request ID (string)
+func requestID(r *http.Request) string {
+	current, _ := r.Context().Value(requestContextKey{}).(requestContext)
+	return current.id
+}
+
+// requestLogger returns the logger of a request, or the default logger if
+// it has none
+// Input: HTTP request
+// Output: Logger
+func requestLogger(r *http.Request) *slog.Logger {
+	if current, ok := r.Context().Value(requestContextKey{}).(requestContext); ok {
+		return current.logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/acl"
+)
+
+// tokenScope limits what a service token may do: at most Permission on Path
+// and everything below it, or everywhere if Path is empty
+type tokenScope struct {
+	Permission acl.Permission
+	Path       string
+}
+
+// parseScope converts a scope written as "<permission>" or
+// "<permission>:<path>", such as "read" or "write:/v1/db", to a tokenScope
+// Input: Scope (string)
+// Output: tokenScope, error if the scope is malformed
+func parseScope(scope string) (tokenScope, error) {
+	name, path, hasPath := strings.Cut(scope, ":")
+	permission, err := acl.ParsePermission(name)
+	if err != nil || permission == acl.None {
+		return tokenScope{}, fmt.Errorf("invalid scope %q", scope)
+	}
+	if !hasPath {
+		return tokenScope{Permission: permission}, nil
+	}
+	path, err = acl.Normalize(path)
+	if err != nil {
+		return tokenScope{}, fmt.Errorf("invalid scope %q", scope)
+	}
+	return tokenScope{Permission: permission, Path: path}, nil
+}
+
+// parseScopes converts a list of scopes, see parseScope
+// Input: Scopes ([]string)
+// Output: Slice of tokenScope, error if any scope is malformed
+func parseScopes(scopes []string) ([]tokenScope, error) {
+	parsed := make([]tokenScope, 0, len(scopes))
+	for _, scope := range scopes {
+		tokenScope, err := parseScope(scope)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, tokenScope)
+	}
+	return parsed, nil
+}
+
+// String returns the scope in the form accepted by parseScope
+// Input: None
+// Output: Scope (string)
+func (scope tokenScope) String() string {
+	if scope.Path == "" {
+		return scope.Permission.String()
+	}
+	return scope.Permission.String() + ":" + scope.Path
+}
+
+// scopeStrings converts scopes back to their string form
+// Input: Scopes ([]tokenScope)
+// Output: Slice of scope strings
+func scopeStrings(scopes []tokenScope) []string {
+	if scopes == nil {
+		return nil
+	}
+	strs := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		strs = append(strs, scope.String())
+	}
+	return strs
+}
+
+// adminScope reports whether scopes include admin without a path, which a
+// service token needs to use the /admin endpoints
+// Input: Scopes ([]tokenScope)
+// Output: Boolean
+func adminScope(scopes []tokenScope) bool {
+	for _, scope := range scopes {
+		if scope.Permission == acl.Admin && scope.Path == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeLimit returns the highest permission a token's scopes allow on a
+// resource. Tokens without scopes are not limited.
+// Input: Scopes ([]tokenScope), Resource path (string)
+// Output: Permission
+func scopeLimit(scopes []tokenScope, resource string) acl.Permission {
+	if scopes == nil {
+		return acl.Admin
+	}
+	resource = strings.TrimSuffix(resource, "/")
+	limit := acl.None
+	for _, scope := range scopes {
+		if scope.Path == "" || resource == scope.Path || strings.HasPrefix(resource, scope.Path+"/") {
+			limit = max(limit, scope.Permission)
+		}
+	}
+	return limit
+}
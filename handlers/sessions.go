@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sessionsFileName is the file in the data directory holding login sessions
+const sessionsFileName = "sessions.json"
+
+// sessionRecord is a login session or service token as stored in the
+// sessions file. Only the hash of the token is ever written.
+type sessionRecord struct {
+	TokenHash  string    `json:"tokenHash"`
+	Username   string    `json:"username"`
+	Expiration time.Time `json:"expiration"`
+	Service    bool      `json:"service,omitempty"`
+	Scopes     []string  `json:"scopes,omitempty"`
+}
+
+// hashToken returns the key under which a token is stored in tokenToUser
+// Input: token string
+// Output: Hex encoded SHA-256 hash of the token
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// readTokenFile reads the token file, a JSON object mapping service account
+// usernames to tokens
+// Input: Token file path (string)
+// Output: Map from username to token, error if the file is missing or malformed
+func readTokenFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("token file not found")
+	}
+	var authMap map[string]string
+	if err := json.Unmarshal(data, &authMap); err != nil {
+		return nil, fmt.Errorf("token file in incorrect format")
+	}
+	return authMap, nil
+}
+
+// staticEntries builds the tokenToUser entries for the tokens of the token file
+// Input: Map from username to token, Static token lifetime (time.Duration), zero to never expire
+// Output: Map from token hash to authEntry
+func staticEntries(authMap map[string]string, lifetime time.Duration) map[string]authEntry {
+	var expiration time.Time
+	if lifetime > 0 {
+		expiration = time.Now().Add(lifetime)
+	}
+	entries := make(map[string]authEntry, len(authMap))
+	for user, token := range authMap {
+		entries[hashToken(token)] = authEntry{username: user, expiration: expiration, static: true}
+	}
+	return entries
+}
+
+// reloadTokenFile replaces the tokens from the token file with its current
+// contents. Login sessions and service tokens are kept, and subscriptions
+// opened with removed tokens end.
+// Input: None
+// Output: Number of tokens loaded, error if the file cannot be read
+func (owldb *owldb) reloadTokenFile() (int, error) {
+	authMap, err := readTokenFile(owldb.tokenFile)
+	if err != nil {
+		return 0, err
+	}
+	entries := staticEntries(authMap, owldb.staticLifetime)
+
+	owldb.mu.Lock()
+	owldb.replaceStaticEntries(entries)
+	owldb.mu.Unlock()
+
+	owldb.subscription.Recheck()
+	slog.Info("Reloaded token file", "path", owldb.tokenFile, "users", len(entries))
+	return len(entries), nil
+}
+
+// replaceStaticEntries replaces the tokens from the token file with the
+// given entries, keeping login sessions and service tokens. The caller must
+// hold owldb.mu.
+// Input: Map from token hash to authEntry
+// Output: None
+func (owldb *owldb) replaceStaticEntries(entries map[string]authEntry) {
+	for tokenHash, entry := range owldb.tokenToUser {
+		if entry.static {
+			delete(owldb.tokenToUser, tokenHash)
+		}
+	}
+	for tokenHash, entry := range entries {
+		owldb.tokenToUser[tokenHash] = entry
+	}
+}
+
+// loadSessions reads the unexpired login sessions saved in the data directory
+// Input: Data directory (string)
+// Output: Map from token hash to authEntry, error if the file is unreadable
+func loadSessions(dataDir string) (map[string]authEntry, error) {
+	sessions := make(map[string]authEntry)
+	data, err := os.ReadFile(filepath.Join(dataDir, sessionsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sessions file could not be read")
+	}
+
+	var records []sessionRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("sessions file in incorrect format")
+	}
+	now := time.Now()
+	for _, record := range records {
+		scopes, err := parseScopes(record.Scopes)
+		if err != nil {
+			return nil, fmt.Errorf("sessions file in incorrect format")
+		}
+		if !record.Service {
+			scopes = nil
+		}
+		entry := authEntry{username: record.Username, expiration: record.Expiration, service: record.Service, scopes: scopes}
+		if !entry.expired(now) {
+			sessions[record.TokenHash] = entry
+		}
+	}
+	slog.Info("Restored login sessions", "count", len(sessions))
+	return sessions, nil
+}
+
+// saveSessions writes the login sessions to the data directory, replacing the
+// file atomically. Tokens from the token file are not saved. Must be called
+// with owldb.mu held.
+// Input: None
+// Output: None
+func (owldb *owldb) saveSessions() {
+	if owldb.dataDir == "" {
+		return
+	}
+
+	records := make([]sessionRecord, 0, len(owldb.tokenToUser))
+	for tokenHash, entry := range owldb.tokenToUser {
+		if !entry.static {
+			records = append(records, sessionRecord{
+				TokenHash:  tokenHash,
+				Username:   entry.username,
+				Expiration: entry.expiration,
+				Service:    entry.service,
+				Scopes:     scopeStrings(entry.scopes),
+			})
+		}
+	}
+	encoded, err := json.Marshal(records)
+	if err != nil {
+		slog.Error("Failed to encode sessions", "error", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(owldb.dataDir, ".sessions-*.json")
+	if err != nil {
+		slog.Error("Failed to save sessions", "error", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(encoded)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(owldb.dataDir, sessionsFileName))
+	}
+	if err != nil {
+		slog.Error("Failed to save sessions", "error", err)
+	}
+}
+
+// sweepExpired evicts expired tokens and ends the subscriptions that used them
+// Input: None
+// Output: Number of tokens evicted (int)
+func (owldb *owldb) sweepExpired() int {
+	owldb.mu.Lock()
+	now := time.Now()
+	evicted := 0
+	for tokenHash, entry := range owldb.tokenToUser {
+		if entry.expired(now) {
+			delete(owldb.tokenToUser, tokenHash)
+			evicted++
+		}
+	}
+	if evicted > 0 {
+		owldb.saveSessions()
+	}
+	owldb.mu.Unlock()
+
+	if evicted > 0 {
+		owldb.subscription.Recheck()
+		slog.Info("Evicted expired tokens", "count", evicted)
+	}
+	if owldb.jwtKey != nil {
+		owldb.syncRevocations()
+	}
+	return evicted
+}
+
+// runSweeper periodically evicts expired tokens until the instance is closed
+// Input: Sweep interval (time.Duration)
+// Output: None
+func (owldb *owldb) runSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			owldb.sweepExpired()
+			owldb.pruneLimiters()
+			if owldb.clientCerts != nil {
+				owldb.clientCerts.sweep(time.Now())
+			}
+		case <-owldb.done:
+			return
+		}
+	}
+}
+
+// Close stops the background work of the instance, closes WebSocket
+// sessions, and saves the login sessions and revocations one last time
+// before closing the audit log
+// Input: None
+// Output: None
+func (owldb *owldb) Close() {
+	owldb.closeOnce.Do(func() {
+		close(owldb.done)
+		owldb.mu.Lock()
+		owldb.saveSessions()
+		if owldb.jwtKey != nil {
+			owldb.saveRevocations()
+		}
+		owldb.mu.Unlock()
+		if err := owldb.audit.Close(); err != nil {
+			slog.Error("Failed to close audit log", "error", err)
+		}
+	})
+}
@@ -0,0 +1,441 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/subscription"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/websocket"
+)
+
+// wsRequest is a message sent by a WebSocket client. Type is one of
+// "subscribe", "unsubscribe" or "request".
+type wsRequest struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Mode     string          `json:"mode"`
+	Interval string          `json:"interval"`
+	Buffer   int             `json:"buffer"`
+	Overflow string          `json:"overflow"`
+	Updates  string          `json:"updates"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// wsResponse answers a client message, with Type "response" or "error".
+type wsResponse struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Status    int             `json:"status"`
+	Body      json.RawMessage `json:"body"`
+	RequestID string          `json:"requestId,omitempty"`
+}
+
+// wsEvent carries a subscription event to a WebSocket client, where ID is the
+// id of the subscribe message that opened the subscription.
+type wsEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Event     string          `json:"event"`
+	Sequence  uint64          `json:"seq"`
+	Data      json.RawMessage `json:"data"`
+	RequestID string          `json:"requestId,omitempty"`
+}
+
+// wsSubscription is one subscription multiplexed on a WebSocket connection.
+type wsSubscription struct {
+	path       string
+	subscriber *subscription.Subscriber
+	done       chan struct{}
+}
+
+// wsSession holds the state of a single WebSocket connection.
+type wsSession struct {
+	owldb         *owldb
+	conn          *websocket.Conn
+	token         string
+	user          string
+	ctx           context.Context
+	logger        *slog.Logger
+	mu            sync.Mutex
+	subscriptions map[string]*wsSubscription
+}
+
+// responseBuffer is an http.ResponseWriter that keeps the response in memory,
+// used to run WebSocket requests through HandleStorage.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// Header returns the response headers
+// Input: None
+// Output: Response headers (http.Header)
+func (rb *responseBuffer) Header() http.Header {
+	return rb.header
+}
+
+// Write appends to the response body
+// Input: Data ([]byte)
+// Output: Number of bytes written, error if any
+func (rb *responseBuffer) Write(data []byte) (int, error) {
+	if rb.status == 0 {
+		rb.status = http.StatusOK
+	}
+	return rb.body.Write(data)
+}
+
+// WriteHeader records the response status code
+// Input: Status code (int)
+// Output: None
+func (rb *responseBuffer) WriteHeader(statusCode int) {
+	if rb.status == 0 {
+		rb.status = statusCode
+	}
+}
+
+// HandleWebSocket upgrades the request to a WebSocket connection that carries
+// any number of subscriptions as well as read and write requests. The bearer
+// token is taken from the Authorization header, or from the "token" query
+// parameter for clients that cannot set headers. Browsers do not apply CORS
+// to WebSocket upgrades, so upgrades from other origins are refused here.
+// Input: HTTP response writer and request
+// Output: None
+func (owldb *owldb) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	owldb.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !owldb.originAllowed(r) {
+		requestLogger(r).Warn("WebSocket upgrade from a disallowed origin refused", "origin", r.Header.Get("Origin"))
+		writeJSON(w, http.StatusForbidden, "origin not allowed")
+		return
+	}
+
+	var authToken string
+	var err error
+	if r.Header.Get("Authorization") == "" && r.URL.Query().Get("token") != "" {
+		authToken = r.URL.Query().Get("token")
+	} else {
+		authToken, err = owldb.bearerToken(r)
+	}
+	if err != nil {
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(encodederr)
+		return
+	}
+
+	user, err := owldb.authorize(authToken)
+	if err != nil {
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(encodederr)
+		return
+	}
+	noteUser(r, user)
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		requestLogger(r).Warn("WebSocket upgrade failed", "error", err)
+		encodederr, _ := json.Marshal(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(encodederr)
+		return
+	}
+
+	noteSubscription(r)
+
+	// The hijacked connection outlives the request context, so the session
+	// gets its own
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	session := &wsSession{
+		owldb:         owldb,
+		conn:          conn,
+		token:         authToken,
+		user:          user,
+		ctx:           ctx,
+		logger:        requestLogger(r).With("username", user),
+		subscriptions: make(map[string]*wsSubscription),
+	}
+	session.logger.Info("WebSocket session opened")
+
+	go session.keepAlive()
+	session.readLoop()
+
+	session.closeSubscriptions()
+	conn.Close()
+	session.logger.Info("WebSocket session closed")
+}
+
+// keepAlive pings the client until the session ends, and closes the
+// connection when the server closes, since hijacked connections are not
+// closed by the HTTP server's shutdown
+// Input: None
+// Output: None
+func (session *wsSession) keepAlive() {
+	ticker := time.NewTicker(15 * time.Second) // Keep-alive interval
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := session.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-session.owldb.done:
+			session.conn.Close()
+			return
+		case <-session.ctx.Done():
+			return
+		}
+	}
+}
+
+// readLoop reads and handles client messages until the connection closes
+// Input: None
+// Output: None
+func (session *wsSession) readLoop() {
+	for {
+		messageType, data, err := session.conn.ReadMessage()
+		if err != nil {
+			session.logger.Info("WebSocket read ended", "username", session.user, "reason", err)
+			return
+		}
+		if messageType != websocket.TextMessage {
+			session.sendError("", http.StatusBadRequest, "messages must be text")
+			continue
+		}
+
+		var msg wsRequest
+		if err := json.Unmarshal(data, &msg); err != nil {
+			session.sendError("", http.StatusBadRequest, "message in incorrect format")
+			continue
+		}
+
+		switch msg.Type {
+		case "subscribe":
+			session.subscribe(msg)
+		case "unsubscribe":
+			session.unsubscribe(msg)
+		case "request":
+			session.request(msg)
+		default:
+			session.sendError(msg.ID, http.StatusBadRequest, "unknown message type")
+		}
+	}
+}
+
+// send encodes and writes a message to the client
+// Input: Message (any)
+// Output: Error if any
+func (session *wsSession) send(message any) error {
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return session.conn.WriteMessage(websocket.TextMessage, encoded)
+}
+
+// sendError writes an error message to the client
+// Input: Message id (string), Status code (int), Error message (string)
+// Output: None
+func (session *wsSession) sendError(id string, statusCode int, message string) {
+	encodederr, _ := json.Marshal(message)
+	session.send(wsResponse{ID: id, Type: "error", Status: statusCode, Body: encodederr})
+}
+
+// subscribe opens a subscription identified by the message id, sending the
+// current state of the resource before live events
+// Input: Client message (wsRequest)
+// Output: None
+func (session *wsSession) subscribe(msg wsRequest) {
+	if msg.ID == "" {
+		session.sendError(msg.ID, http.StatusBadRequest, "subscribe requires an id")
+		return
+	}
+
+	session.mu.Lock()
+	_, exists := session.subscriptions[msg.ID]
+	session.mu.Unlock()
+	if exists {
+		session.sendError(msg.ID, http.StatusBadRequest, "subscription id already in use")
+		return
+	}
+
+	bufferParam := ""
+	if msg.Buffer != 0 {
+		bufferParam = strconv.Itoa(msg.Buffer)
+	}
+	subscriber, err := newSubscriber(bufferParam, msg.Overflow, msg.Updates)
+	if err != nil {
+		session.sendError(msg.ID, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	subscriber.SetAuthorizer(session.owldb.subscriberAuthorizer(session.token))
+
+	sub := &wsSubscription{
+		path:       msg.Path,
+		subscriber: subscriber,
+		done:       make(chan struct{}),
+	}
+	entry, err := session.owldb.lookupToken(session.token)
+	if err != nil {
+		session.sendError(msg.ID, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if allowed, _ := session.owldb.allowRequest(RouteSubscriptions, entry.username); !allowed {
+		session.sendError(msg.ID, http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+	snapshotData, sequence, statusCode, err := session.owldb.openSubscription(msg.Path, entry, msg.Interval, subscriber, session.logger)
+	if err != nil {
+		session.sendError(msg.ID, statusCode, err.Error())
+		return
+	}
+
+	session.mu.Lock()
+	session.subscriptions[msg.ID] = sub
+	session.mu.Unlock()
+	session.logger.Info("WebSocket subscriber added", "resourcePath", msg.Path, "sequence", sequence)
+
+	session.send(wsResponse{ID: msg.ID, Type: "response", Status: http.StatusOK})
+	for _, eventData := range snapshotData {
+		session.send(wsEvent{ID: msg.ID, Type: "event", Event: "update", Sequence: sequence, Data: eventData})
+	}
+
+	go session.forward(msg.ID, sub)
+}
+
+// forward relays events of one subscription to the client until it is closed
+// Input: Subscription id (string), Subscription (*wsSubscription)
+// Output: None
+func (session *wsSession) forward(id string, sub *wsSubscription) {
+	defer session.owldb.subscription.Unregister(sub.path, sub.subscriber)
+
+	// Recheck authorization when the token is due to expire
+	expiry := time.NewTimer(max(session.owldb.tokenLifetime(session.token), time.Second))
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-sub.subscriber.Ready():
+			for _, event := range sub.subscriber.Drain() {
+				err := session.send(wsEvent{ID: id, Type: "event", Event: event.Type, Sequence: event.Sequence, Data: event.Data, RequestID: event.RequestID})
+				if err != nil {
+					session.logger.Warn("Failed to write to client", "error", err)
+					return
+				}
+			}
+		case <-expiry.C:
+			if sub.subscriber.Recheck() {
+				expiry.Reset(max(session.owldb.tokenLifetime(session.token), time.Second))
+			}
+		case <-sub.subscriber.Done():
+			// The client fell too far behind, lost its authorization or the
+			// server is shutting down, so end this subscription after any
+			// events still pending
+			for _, event := range sub.subscriber.Drain() {
+				session.send(wsEvent{ID: id, Type: "event", Event: event.Type, Sequence: event.Sequence, Data: event.Data, RequestID: event.RequestID})
+			}
+			event := sub.subscriber.FinalEvent()
+			session.send(wsEvent{ID: id, Type: "event", Event: event.Type, Sequence: event.Sequence, Data: event.Data, RequestID: event.RequestID})
+			session.mu.Lock()
+			delete(session.subscriptions, id)
+			session.mu.Unlock()
+			return
+		case <-sub.done:
+			return
+		case <-session.ctx.Done():
+			return
+		}
+	}
+}
+
+// unsubscribe closes the subscription opened with the given id
+// Input: Client message (wsRequest)
+// Output: None
+func (session *wsSession) unsubscribe(msg wsRequest) {
+	session.mu.Lock()
+	sub, exists := session.subscriptions[msg.ID]
+	delete(session.subscriptions, msg.ID)
+	session.mu.Unlock()
+
+	if !exists {
+		session.sendError(msg.ID, http.StatusNotFound, "no subscription with this id")
+		return
+	}
+	close(sub.done)
+	session.send(wsResponse{ID: msg.ID, Type: "response", Status: http.StatusNoContent})
+}
+
+// closeSubscriptions closes every subscription of the session
+// Input: None
+// Output: None
+func (session *wsSession) closeSubscriptions() {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	for id, sub := range session.subscriptions {
+		close(sub.done)
+		delete(session.subscriptions, id)
+	}
+}
+
+// request runs a read or write request through HandleStorage with the
+// session's token and sends back the status and body
+// Input: Client message (wsRequest)
+// Output: None
+func (session *wsSession) request(msg wsRequest) {
+	if !strings.HasPrefix(msg.Path, "/v1/") {
+		session.sendError(msg.ID, http.StatusBadRequest, "bad request path")
+		return
+	}
+	if msg.Mode == "subscribe" {
+		session.sendError(msg.ID, http.StatusBadRequest, "use a subscribe message to subscribe")
+		return
+	}
+
+	query := url.Values{}
+	if msg.Mode != "" {
+		query.Set("mode", msg.Mode)
+	}
+	if msg.Interval != "" {
+		query.Set("interval", msg.Interval)
+	}
+	target := msg.Path
+	if len(query) > 0 {
+		target = fmt.Sprintf("%s?%s", msg.Path, query.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(session.ctx, msg.Method, target, bytes.NewReader(msg.Body))
+	if err != nil {
+		session.sendError(msg.ID, http.StatusBadRequest, "bad request")
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+session.token)
+	// Each message is its own request with its own ID
+	req, _ = attachRequestID(req, rand.Text())
+
+	response := &responseBuffer{header: make(http.Header)}
+	session.owldb.HandleStorage(response, req)
+
+	var body json.RawMessage
+	if response.body.Len() > 0 {
+		body = response.body.Bytes()
+	}
+	session.send(wsResponse{ID: msg.ID, Type: "response", Status: response.status, Body: body, RequestID: response.header.Get(RequestIDHeader)})
+}
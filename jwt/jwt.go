@@ -0,0 +1,135 @@
+// Package jwt signs and verifies JSON Web Tokens (RFC 7519) using HMAC
+// SHA-256 (HS256) with only the standard library.  Any server holding the
+// same key can verify a token without shared state.
+package jwt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// MinKeySize is the smallest signing key accepted, matching the SHA-256 output size.
+const MinKeySize = 32
+
+// Issuer is the issuer claim of tokens signed by this package.
+const Issuer = "owldb"
+
+// header is the only JOSE header produced and accepted.
+const header = `{"alg":"HS256","typ":"JWT"}`
+
+// Errors returned by Verify.
+var (
+	ErrMalformed = errors.New("malformed token")
+	ErrSignature = errors.New("invalid token signature")
+	ErrExpired   = errors.New("token has expired")
+	ErrClaims    = errors.New("invalid token claims")
+)
+
+// Claims are the registered claims used by OwlDB plus the token's scopes.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	ID        string   `json:"jti"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	Scopes    []string `json:"scopes,omitempty"`
+}
+
+// Expiration returns the expiry claim as a time
+// Input: None
+// Output: Expiry time (time.Time)
+func (c Claims) Expiration() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// LoadKey reads a signing key from a file, ignoring surrounding whitespace
+// Input: Key file path (string)
+// Output: Key ([]byte), error if the file is unreadable or the key too short
+func LoadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("jwt key file could not be read")
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < MinKeySize {
+		return nil, fmt.Errorf("jwt key must be at least %d bytes", MinKeySize)
+	}
+	return key, nil
+}
+
+// LooksLikeToken reports whether a bearer token has the three part JWT form
+// Input: Token (string)
+// Output: Boolean
+func LooksLikeToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// sign computes the encoded signature of the signing input
+// Input: Signing input (string), Key ([]byte)
+// Output: Encoded signature (string)
+func sign(input string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(input))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign encodes and signs the claims, setting the issuer
+// Input: Claims, Key ([]byte)
+// Output: Token (string), error if the claims cannot be encoded
+func Sign(claims Claims, key []byte) (string, error) {
+	claims.Issuer = Issuer
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + sign(input, key), nil
+}
+
+// Verify checks a token's header, signature, issuer, subject and expiry
+// Input: Token (string), Key ([]byte), Current time (time.Time)
+// Output: Claims, error if the token is not valid at that time
+func Verify(token string, key []byte, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrMalformed
+	}
+
+	// Only HS256 is accepted, so a token cannot choose a weaker algorithm
+	var head struct {
+		Alg string `json:"alg"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &head) != nil {
+		return Claims{}, ErrMalformed
+	}
+	if head.Alg != "HS256" {
+		return Claims{}, ErrSignature
+	}
+
+	expected := sign(parts[0]+"."+parts[1], key)
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return Claims{}, ErrSignature
+	}
+
+	var claims Claims
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return Claims{}, ErrMalformed
+	}
+	if claims.Issuer != Issuer || claims.Subject == "" || claims.ID == "" {
+		return Claims{}, ErrClaims
+	}
+	if !now.Before(claims.Expiration()) {
+		return Claims{}, ErrExpired
+	}
+	return claims, nil
+}
@@ -0,0 +1,85 @@
+package jwt
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func testClaims(now time.Time) Claims {
+	return Claims{Subject: "alice", ID: "abc", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix(), Scopes: []string{"read"}}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Now()
+	token, err := Sign(testClaims(now), testKey)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if !LooksLikeToken(token) {
+		t.Errorf("Expected a three part token, got %q", token)
+	}
+
+	claims, err := Verify(token, testKey, now)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if claims.Subject != "alice" || claims.Issuer != Issuer || len(claims.Scopes) != 1 {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+}
+
+func TestVerify_Expired(t *testing.T) {
+	now := time.Now()
+	token, _ := Sign(testClaims(now), testKey)
+	if _, err := Verify(token, testKey, now.Add(2*time.Hour)); !errors.Is(err, ErrExpired) {
+		t.Errorf("Expected ErrExpired, got %v", err)
+	}
+}
+
+func TestVerify_WrongKey(t *testing.T) {
+	now := time.Now()
+	token, _ := Sign(testClaims(now), testKey)
+	if _, err := Verify(token, []byte("another key that is 32 bytes long"), now); !errors.Is(err, ErrSignature) {
+		t.Errorf("Expected ErrSignature, got %v", err)
+	}
+}
+
+func TestVerify_TamperedClaims(t *testing.T) {
+	now := time.Now()
+	token, _ := Sign(testClaims(now), testKey)
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"root","iss":"owldb","jti":"abc","exp":9999999999}`))
+	if _, err := Verify(strings.Join(parts, "."), testKey, now); !errors.Is(err, ErrSignature) {
+		t.Errorf("Expected ErrSignature, got %v", err)
+	}
+}
+
+func TestVerify_NoneAlgorithm(t *testing.T) {
+	now := time.Now()
+	token, _ := Sign(testClaims(now), testKey)
+	parts := strings.Split(token, ".")
+	parts[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	if _, err := Verify(parts[0]+"."+parts[1]+".", testKey, now); err == nil {
+		t.Errorf("Expected unsigned token to be rejected")
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(path, []byte("short\n"), 0600)
+	if _, err := LoadKey(path); err == nil {
+		t.Errorf("Expected short key to be rejected")
+	}
+	os.WriteFile(path, append(testKey, '\n'), 0600)
+	key, err := LoadKey(path)
+	if err != nil || string(key) != string(testKey) {
+		t.Errorf("Unexpected key %q, %v", key, err)
+	}
+}
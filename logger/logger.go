@@ -12,6 +12,10 @@
 // handler := logger.NewPrettyHandler(os.Stdout, logOpts)
 // logger := slog.New(handler)
 // slog.SetDefault(logger)
+//
+// Set JSON in the options to write one JSON object per line instead,
+// and pass a RotatingFile as the writer to log to a file that is
+// rotated by size or age.
 package logger
 
 import (
@@ -51,6 +55,7 @@ type PrettyHandlerOptions struct {
 	Level       slog.Leveler
 	ReplaceAttr func([]string, slog.Attr) slog.Attr
 	Colorize    bool
+	JSON        bool // write JSON lines instead of text; Colorize is ignored
 }
 
 // PrettyHandler is an slog.Handler that pretty-prints log records using color.
@@ -63,6 +68,7 @@ type PrettyHandler struct {
 	goas []groupOrAttrs
 	mu   *sync.Mutex
 	out  io.Writer
+	json slog.Handler // handles records in JSON mode, nil otherwise
 }
 
 // groupOrAttrs holds either a group name or a list of slog.Attrs.
@@ -199,11 +205,18 @@ func (h *PrettyHandler) appendAttr(buf []byte, a slog.Attr, groups []string) []b
 
 // Enabled returns true if the logging level is enabled.
 func (h *PrettyHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.opts.Level == nil {
+		return level >= slog.LevelInfo
+	}
 	return level >= h.opts.Level.Level()
 }
 
 // Handle writes the record to the output.
 func (h *PrettyHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.json != nil {
+		return h.json.Handle(ctx, r)
+	}
+
 	// Allocate a buffer for the record from the pool.
 	bufp := h.allocBuf()
 	buf := *bufp
@@ -334,6 +347,13 @@ func (h *PrettyHandler) withGroupOrAttrs(goa groupOrAttrs) *PrettyHandler {
 	h2.goas = make([]groupOrAttrs, len(h.goas)+1)
 	copy(h2.goas, h.goas)
 	h2.goas[len(h2.goas)-1] = goa
+	if h.json != nil {
+		if goa.group != "" {
+			h2.json = h.json.WithGroup(goa.group)
+		} else {
+			h2.json = h.json.WithAttrs(goa.attrs)
+		}
+	}
 	return &h2
 }
 
@@ -353,13 +373,22 @@ func (h *PrettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
 	return h.withGroupOrAttrs(groupOrAttrs{attrs: attrs})
 }
 
+// NewPrettyHandler creates a handler that writes records to w, as colorized
+// text or as JSON lines depending on the options.
 func NewPrettyHandler(w io.Writer, opts *PrettyHandlerOptions) *PrettyHandler {
 	if opts == nil {
 		opts = &PrettyHandlerOptions{
 			Level: slog.LevelInfo,
 		}
 	}
-	h := &PrettyHandler{nil, opts, nil, &sync.Mutex{}, w}
+	h := &PrettyHandler{nil, opts, nil, &sync.Mutex{}, w, nil}
+	if opts.JSON {
+		h.json = slog.NewJSONHandler(w, &slog.HandlerOptions{
+			AddSource:   opts.AddSource,
+			Level:       opts.Level,
+			ReplaceAttr: opts.ReplaceAttr,
+		})
+	}
 	h.initPool()
 
 	return h
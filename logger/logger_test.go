@@ -0,0 +1,150 @@
+package logger
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrettyHandler_JSON(t *testing.T) {
+	var out strings.Builder
+	handler := NewPrettyHandler(&out, &PrettyHandlerOptions{Level: slog.LevelInfo, Colorize: true, JSON: true})
+	log := slog.New(handler).With("requestID", "abc").WithGroup("req")
+	log.Debug("hidden")
+	log.Info("handled", "status", 200)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line, got %d: %q", len(lines), out.String())
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Line is not JSON: %v", err)
+	}
+	if record["msg"] != "handled" || record["level"] != "INFO" || record["requestID"] != "abc" {
+		t.Errorf("Unexpected record: %v", record)
+	}
+	if group, ok := record["req"].(map[string]any); !ok || group["status"] != float64(200) {
+		t.Errorf("Expected status in req group, got %v", record)
+	}
+	if strings.Contains(out.String(), Reset) {
+		t.Errorf("JSON output should not be colorized")
+	}
+}
+
+func TestRotatingFile_Size(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owldb.log")
+	rf, err := NewRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rf.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	current, _ := os.ReadFile(path)
+	if string(current) != "fourth\n" {
+		t.Errorf("Expected current file to hold the last line, got %q", current)
+	}
+	backups, err := rf.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups kept, got %v", backups)
+	}
+	oldest, _ := os.ReadFile(backups[0])
+	if string(oldest) != "second\n" {
+		t.Errorf("Expected oldest kept backup to hold second line, got %q", oldest)
+	}
+}
+
+func TestRotatingFile_Age(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owldb.log")
+	rf, err := NewRotatingFile(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	clock := time.Now()
+	rf.now = func() time.Time { return clock }
+	rf.Write([]byte("old\n"))
+	clock = clock.Add(30 * time.Minute)
+	rf.Write([]byte("still old\n"))
+	clock = clock.Add(31 * time.Minute)
+	rf.Write([]byte("new\n"))
+
+	current, _ := os.ReadFile(path)
+	if string(current) != "new\n" {
+		t.Errorf("Expected rotation after max age, got %q", current)
+	}
+	backups, _ := rf.Backups()
+	if len(backups) != 1 {
+		t.Errorf("Expected 1 backup, got %v", backups)
+	}
+
+	rf.Close()
+	if _, err := rf.Write([]byte("closed\n")); err == nil {
+		t.Errorf("Expected write after close to fail")
+	}
+}
+
+func TestSamplingHandler(t *testing.T) {
+	var out strings.Builder
+	pretty := NewPrettyHandler(&out, &PrettyHandlerOptions{Level: slog.LevelDebug})
+	sampler := NewSamplingHandler(pretty, SamplingOptions{First: 2, Thereafter: 3, Interval: time.Second, MaxLevel: slog.LevelDebug})
+	clock := time.Now()
+	sampler.nowFunc = func() time.Time { return clock }
+
+	// Derived loggers share counters
+	log := slog.New(sampler)
+	for i := range 8 {
+		log.With("request", i).Debug("hot")
+	}
+	log.Debug("other")
+	log.Info("hot")
+	log.Info("hot")
+	log.Info("hot")
+
+	// hot is logged for the 1st, 2nd, 5th and 8th records
+	if count := strings.Count(out.String(), "DEBUG hot"); count != 4 {
+		t.Errorf("Expected 4 sampled debug records, got %d:\n%s", count, out.String())
+	}
+	if !strings.Contains(out.String(), "request=4") || strings.Contains(out.String(), "request=3") {
+		t.Errorf("Unexpected records sampled:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "DEBUG other") || strings.Count(out.String(), "INFO hot") != 3 {
+		t.Errorf("Expected other messages and levels above MaxLevel to pass:\n%s", out.String())
+	}
+	if sampler.Dropped() != 4 {
+		t.Errorf("Expected 4 dropped records, got %d", sampler.Dropped())
+	}
+
+	// Counters start over each interval, and Thereafter of zero rate limits
+	out.Reset()
+	limiter := NewSamplingHandler(pretty, SamplingOptions{First: 1, MaxLevel: slog.LevelDebug})
+	limiter.nowFunc = func() time.Time { return clock }
+	log = slog.New(limiter)
+	log.Debug("limited")
+	log.Debug("limited")
+	clock = clock.Add(time.Second)
+	log.Debug("limited")
+	if count := strings.Count(out.String(), "limited"); count != 2 {
+		t.Errorf("Expected 1 record per interval, got %d:\n%s", count, out.String())
+	}
+}
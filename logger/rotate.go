@@ -0,0 +1,194 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rotatedTimeFormat is the timestamp appended to the names of rotated files.
+// It sorts in time order and keeps files rotated within a second apart.
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// RotatingFile is an io.Writer that appends to a log file and moves it aside
+// once it grows past a size or gets older than an age, so it can be passed
+// to NewPrettyHandler in place of os.Stdout.  Rotated files are renamed to
+// the original path with a timestamp appended.
+type RotatingFile struct {
+	path       string
+	maxSize    int64         // rotate before a write would exceed this, 0 for no limit
+	maxAge     time.Duration // rotate once the file is this old, 0 for no limit
+	maxBackups int           // rotated files to keep, 0 to keep all
+	now        func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewRotatingFile opens the log file at path for appending, creating it if
+// needed.
+// Input: Path (string), Max size in bytes (int64), Max age (time.Duration),
+// Rotated files to keep (int)
+// Output: RotatingFile, error if the file cannot be opened
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups, now: time.Now}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open opens the log file and records its size.  The age of an existing
+// file counts from when it was last modified, so a restart does not reset it.
+// Input: None
+// Output: Error if the file cannot be opened
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("opening log file: %w", err)
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	rf.opened = rf.now()
+	if rf.size > 0 && info.ModTime().Before(rf.opened) {
+		rf.opened = info.ModTime()
+	}
+	return nil
+}
+
+// Write appends p to the log file, rotating it first if p would make it too
+// large or the file is too old.  A single write is never split across files.
+// Input: Bytes to write ([]byte)
+// Output: Bytes written (int), error if any
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.shouldRotate(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// shouldRotate reports whether the file must be rotated before writing
+// the given number of bytes.  An empty file is never rotated.
+// Input: Bytes about to be written (int64)
+// Output: Boolean
+func (rf *RotatingFile) shouldRotate(n int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.maxSize > 0 && rf.size+n > rf.maxSize {
+		return true
+	}
+	return rf.maxAge > 0 && rf.now().Sub(rf.opened) >= rf.maxAge
+}
+
+// Rotate moves the current log file aside and starts a new one.
+// Input: None
+// Output: Error if any
+func (rf *RotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return os.ErrClosed
+	}
+	return rf.rotate()
+}
+
+// rotate closes and renames the log file, opens a new one and removes the
+// oldest rotated files beyond the number to keep.  The lock must be held.
+// Input: None
+// Output: Error if any
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return fmt.Errorf("rotating log file: %w", err)
+	}
+	rf.file = nil
+
+	rotated := rf.path + "." + rf.now().Format(rotatedTimeFormat)
+	if err := os.Rename(rf.path, rotated); err != nil {
+		// Keep writing to the current file rather than losing messages
+		if openErr := rf.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("rotating log file: %w", err)
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	return rf.removeOldBackups()
+}
+
+// Backups returns the paths of the rotated files, oldest first.
+// Input: None
+// Output: Paths ([]string), error if any
+func (rf *RotatingFile) Backups() ([]string, error) {
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	backups := matches[:0]
+	for _, match := range matches {
+		if _, err := time.Parse(rotatedTimeFormat, match[len(rf.path)+1:]); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	slices.Sort(backups)
+	return backups, nil
+}
+
+// removeOldBackups deletes rotated files beyond the number to keep.
+// Input: None
+// Output: Error if any
+func (rf *RotatingFile) removeOldBackups() error {
+	if rf.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := rf.Backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > rf.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("removing old log file: %w", err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Close closes the log file.  Later writes fail.
+// Input: None
+// Output: Error if any
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
@@ -0,0 +1,125 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SamplingOptions controls which records a SamplingHandler lets through.
+// Records with the same level and message share a counter that starts over
+// every Interval: the first First of them are logged, then every Thereafter-th
+// one.  A Thereafter of zero drops the rest, which rate limits the message to
+// First per Interval.
+type SamplingOptions struct {
+	First      int           // records logged per message per interval before sampling
+	Thereafter int           // log every Thereafter-th record after the first, 0 to drop them
+	Interval   time.Duration // how often the counters start over, one second if zero
+	MaxLevel   slog.Level    // records above this level are never sampled
+}
+
+// SamplingHandler is an slog.Handler that drops repeated records before
+// passing the rest to another handler, so hot paths can log without the
+// cost of writing every line.
+type SamplingHandler struct {
+	next    slog.Handler
+	opts    SamplingOptions
+	state   *samplingState
+	nowFunc func() time.Time
+}
+
+// samplingState is shared by a SamplingHandler and the handlers derived from
+// it with WithAttrs and WithGroup, so request scoped loggers share counters
+type samplingState struct {
+	counters sync.Map // level and message to *sampleCounter
+	dropped  atomic.Uint64
+}
+
+// sampleCounter counts the records of one message in the current interval
+type sampleCounter struct {
+	mu    sync.Mutex
+	start time.Time
+	count int
+}
+
+// sampleKey identifies the records that share a counter
+type sampleKey struct {
+	level   slog.Level
+	message string
+}
+
+// NewSamplingHandler creates a handler that samples records before passing
+// them to next.
+// Input: Handler (slog.Handler), Options (SamplingOptions)
+// Output: SamplingHandler
+func NewSamplingHandler(next slog.Handler, opts SamplingOptions) *SamplingHandler {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	return &SamplingHandler{next: next, opts: opts, state: &samplingState{}, nowFunc: time.Now}
+}
+
+// Enabled returns true if the wrapped handler logs the level.
+func (h *SamplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle passes the record on unless it is sampled out.
+func (h *SamplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level <= h.opts.MaxLevel && !h.sample(r.Level, r.Message) {
+		h.state.dropped.Add(1)
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// sample counts a record and reports whether it should be logged.
+// Input: Level (slog.Level), Message (string)
+// Output: Boolean
+func (h *SamplingHandler) sample(level slog.Level, message string) bool {
+	key := sampleKey{level: level, message: message}
+	value, ok := h.state.counters.Load(key)
+	if !ok {
+		value, _ = h.state.counters.LoadOrStore(key, &sampleCounter{})
+	}
+	counter := value.(*sampleCounter)
+
+	now := h.nowFunc()
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if now.Sub(counter.start) >= h.opts.Interval {
+		counter.start = now
+		counter.count = 0
+	}
+	counter.count++
+
+	if counter.count <= h.opts.First {
+		return true
+	}
+	return h.opts.Thereafter > 0 && (counter.count-h.opts.First)%h.opts.Thereafter == 0
+}
+
+// Dropped returns the number of records sampled out so far.
+// Input: None
+// Output: Count (uint64)
+func (h *SamplingHandler) Dropped() uint64 {
+	return h.state.dropped.Load()
+}
+
+// WithAttrs returns a new SamplingHandler whose records have the attributes
+// added, sharing counters with this one.
+func (h *SamplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithAttrs(attrs)
+	return &h2
+}
+
+// WithGroup returns a new SamplingHandler whose records are in the group,
+// sharing counters with this one.
+func (h *SamplingHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+	return &h2
+}
@@ -7,13 +7,17 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
-	"time"
 
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/certs"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/config"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/logger"
 	owldbhandler "github.com/RICE-COMP318-FALL24/owldb-p1group35/owldbHandler"
 )
 
@@ -21,17 +25,81 @@ func main() {
 	var server http.Server
 	var err error
 
-	portFlag := flag.Int("p", 3318, "port for the server to listen to")
-	schemaFileFlag := flag.String("s", "", "file that contains JSON schema for validating documents")
-	tokenFileFlag := flag.String("t", "", "file that contains a JSON object mapping usernames to tokens")
+	// Flags override the configuration file, so they are parsed first to
+	// find it and applied again once it is loaded
+	configFileFlag := flag.String("c", "", "JSON configuration file, overridden by any other flags given")
+	flagConfig := config.Default()
+	flagConfig.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
-	port := *portFlag
-	tokenFile := *tokenFileFlag
-	schemaFile := *schemaFileFlag
-	slog.Info("Server configuration", "port: ", port, "schema: ", schemaFile, "token: ", tokenFile)
+	cfg := config.Default()
+	if *configFileFlag != "" {
+		cfg, err = config.Load(*configFileFlag)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+	if err = cfg.Override(flag.CommandLine, "c"); err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			slog.Error("Invalid configuration", "problem", line)
+		}
+		os.Exit(1)
+	}
 
-	handler, err := owldbhandler.New(schemaFile, tokenFile)
+	var logLevel slog.Level
+	logLevel.UnmarshalText([]byte(cfg.Log.Level))
+	var logFile *logger.RotatingFile
+	var logOut io.Writer = os.Stderr
+	if cfg.Log.File != "" {
+		logFile, err = logger.NewRotatingFile(cfg.Log.File, cfg.Log.MaxSize, cfg.Log.MaxAge.Duration, cfg.Log.Backups)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		logOut = logFile
+	}
+	var accessLogFile *logger.RotatingFile
+	var accessLog io.Writer
+	if cfg.Log.AccessLog == "-" {
+		accessLog = os.Stdout
+	} else if cfg.Log.AccessLog != "" {
+		accessLogFile, err = logger.NewRotatingFile(cfg.Log.AccessLog, cfg.Log.MaxSize, cfg.Log.MaxAge.Duration, cfg.Log.Backups)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		accessLog = accessLogFile
+	}
+	var logHandler slog.Handler = logger.NewPrettyHandler(logOut, &logger.PrettyHandlerOptions{
+		Level:    logLevel,
+		Colorize: cfg.Log.Color,
+		JSON:     cfg.Log.Format == "json",
+	})
+	// Hot paths log at debug level, so those messages are sampled
+	if cfg.Log.SampleFirst > 0 || cfg.Log.SampleEvery > 0 {
+		logHandler = logger.NewSamplingHandler(logHandler, logger.SamplingOptions{
+			First:      cfg.Log.SampleFirst,
+			Thereafter: cfg.Log.SampleEvery,
+			Interval:   cfg.Log.SampleInterval.Duration,
+			MaxLevel:   slog.LevelDebug,
+		})
+	}
+	slog.SetDefault(slog.New(logHandler))
+
+	port := cfg.Port
+	slog.Info("Server configuration", "config", cfg.Redacted())
+
+	opts, err := cfg.Options()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	opts.AccessLog = accessLog
+	handler, err := owldbhandler.NewWithOptions(opts)
 
 	if err != nil {
 		slog.Error(err.Error())
@@ -44,6 +112,32 @@ func main() {
 		Handler: handler,
 	}
 
+	// HTTPS is served with HTTP/2, picking up rotated certificate files
+	if cfg.TLS.Cert != "" {
+		reloader, err := certs.NewReloader(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		server.TLSConfig, err = certs.ServerConfig(reloader, cfg.TLS.ClientCA, cfg.TLS.ClientAuth)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// SIGHUP reloads the schema and token files without dropping
+	// subscribers
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := handler.Reload(); err != nil {
+				slog.Error("Reload failed, keeping the running schema and tokens", "error", err)
+			}
+		}
+	}()
+
 	// The following code should go last and remain unchanged.
 	// Note that you must actually initialize 'server' and 'port'
 	// before this.  Note that the server is started below by
@@ -53,23 +147,44 @@ func main() {
 	// signal.Notify requires the channel to be buffered
 	ctrlc := make(chan os.Signal, 1)
 	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM)
+	// ListenAndServe returns as soon as shutdown starts, so main waits on
+	// this until requests in progress have drained
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		<-ctrlc
-		slog.Info("Shutting down server...")
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		slog.Info("Shutting down server...", "drainTimeout", cfg.DrainTimeout.Duration)
+		// Subscribers are sent a shutdown event, which ends their streams
+		handler.Drain()
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout.Duration)
 		defer cancel()
 
 		if err := server.Shutdown(ctx); err != nil {
 			slog.Error("Server forced to shutdown", "error", err)
+			server.Close()
 		}
 	}()
 
 	// Start server
-	slog.Info("Listening", "port", port)
-	err = server.ListenAndServe()
+	slog.Info("Listening", "port", port, "tls", server.TLSConfig != nil)
+	if server.TLSConfig != nil {
+		// The certificate comes from the TLS configuration
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil && err != http.ErrServerClosed {
 		slog.Error("Server closed", "error", err)
 	} else {
+		<-shutdownDone
 		slog.Info("Server closed", "error", err)
 	}
+	// Saves sessions and flushes the audit log
+	handler.Close()
+	if accessLogFile != nil {
+		accessLogFile.Close()
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
 }
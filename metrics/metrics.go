@@ -0,0 +1,250 @@
+// Package metrics keeps counters and histograms and writes them, along with
+// values computed when scraped, in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram bucket upper bounds, in seconds, used for
+// request latencies
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Sample is one value of a metric and the values of its labels
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// Counter is a count that only goes up, kept separately for each combination
+// of label values
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*Sample
+}
+
+// histogramValue is the state of a histogram for one combination of labels
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Histogram counts observations in cumulative buckets, kept separately for
+// each combination of label values
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// labelKey joins label values into a map key
+// Input: Label values ([]string)
+// Output: Key (string)
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// NewCounter creates a counter with the given label names
+// Input: Metric name (string), Help text (string), Label names (...string)
+// Output: Counter
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{name: name, help: help, labels: labels, values: make(map[string]*Sample)}
+}
+
+// Inc adds one to the count for the given label values
+// Input: Label values (...string), one per label name
+// Output: None
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds to the count for the given label values
+// Input: Amount (float64), Label values (...string), one per label name
+// Output: None
+func (c *Counter) Add(amount float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := labelKey(labelValues)
+	sample, exists := c.values[key]
+	if !exists {
+		sample = &Sample{Labels: slices.Clone(labelValues)}
+		c.values[key] = sample
+	}
+	sample.Value += amount
+}
+
+// Value returns the count for the given label values
+// Input: Label values (...string)
+// Output: Count (float64)
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if sample, exists := c.values[labelKey(labelValues)]; exists {
+		return sample.Value
+	}
+	return 0
+}
+
+// Write writes the counter in the text exposition format
+// Input: Writer (io.Writer)
+// Output: None
+func (c *Counter) Write(w io.Writer) {
+	c.mu.Lock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, sample := range c.values {
+		samples = append(samples, *sample)
+	}
+	c.mu.Unlock()
+
+	WriteSamples(w, c.name, c.help, "counter", c.labels, samples)
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds and
+// label names
+// Input: Metric name (string), Help text (string), Buckets ([]float64), Label names (...string)
+// Output: Histogram
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: slices.Sorted(slices.Values(buckets)),
+		values:  make(map[string]*histogramValue),
+	}
+}
+
+// Observe records a value for the given label values
+// Input: Value (float64), Label values (...string), one per label name
+// Output: None
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := labelKey(labelValues)
+	state, exists := h.values[key]
+	if !exists {
+		state = &histogramValue{labels: slices.Clone(labelValues), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = state
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			state.counts[i]++
+		}
+	}
+	state.sum += value
+	state.count++
+}
+
+// Count returns the number of values observed for the given label values
+// Input: Label values (...string)
+// Output: Count (uint64)
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if state, exists := h.values[labelKey(labelValues)]; exists {
+		return state.count
+	}
+	return 0
+}
+
+// Write writes the histogram in the text exposition format
+// Input: Writer (io.Writer)
+// Output: None
+func (h *Histogram) Write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := slices.Sorted(maps.Keys(h.values))
+	bucketLabels := append(slices.Clone(h.labels), "le")
+	for _, key := range keys {
+		state := h.values[key]
+		for i, bound := range h.buckets {
+			labelValues := append(slices.Clone(state.labels), formatValue(bound))
+			writeSample(w, h.name+"_bucket", bucketLabels, labelValues, float64(state.counts[i]))
+		}
+		labelValues := append(slices.Clone(state.labels), "+Inf")
+		writeSample(w, h.name+"_bucket", bucketLabels, labelValues, float64(state.count))
+		writeSample(w, h.name+"_sum", h.labels, state.labels, state.sum)
+		writeSample(w, h.name+"_count", h.labels, state.labels, float64(state.count))
+	}
+}
+
+// WriteSamples writes a metric whose values are computed elsewhere, such as
+// a gauge read when scraped, in the text exposition format
+// Input: Writer (io.Writer), Metric name (string), Help text (string), Type (string), Label names ([]string), Samples ([]Sample)
+// Output: None
+func WriteSamples(w io.Writer, name string, help string, kind string, labels []string, samples []Sample) {
+	writeHeader(w, name, help, kind)
+	slices.SortFunc(samples, func(a, b Sample) int {
+		return slices.Compare(a.Labels, b.Labels)
+	})
+	for _, sample := range samples {
+		writeSample(w, name, labels, sample.Labels, sample.Value)
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric
+// Input: Writer (io.Writer), Metric name (string), Help text (string), Type (string)
+// Output: None
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes one line of a metric
+// Input: Writer (io.Writer), Metric name (string), Label names ([]string), Label values ([]string), Value (float64)
+// Output: None
+func writeSample(w io.Writer, name string, labels []string, labelValues []string, value float64) {
+	var line strings.Builder
+	line.WriteString(name)
+	if len(labels) > 0 {
+		line.WriteByte('{')
+		escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+		for i, label := range labels {
+			if i > 0 {
+				line.WriteByte(',')
+			}
+			labelValue := ""
+			if i < len(labelValues) {
+				labelValue = labelValues[i]
+			}
+			fmt.Fprintf(&line, `%s="%s"`, label, escaper.Replace(labelValue))
+		}
+		line.WriteByte('}')
+	}
+	line.WriteByte(' ')
+	line.WriteString(formatValue(value))
+	line.WriteByte('\n')
+	io.WriteString(w, line.String())
+}
+
+// formatValue formats a sample value or bucket bound
+// Input: Value (float64)
+// Output: Formatted value (string)
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	} else if math.IsInf(value, -1) {
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	counter := NewCounter("owldb_requests_total", "Requests handled.", "method", "status")
+	counter.Inc("GET", "Get")
+	counter.Inc("GET", "Get")
+	counter.Add(3, "PUT", `Bad "Request"`)
+
+	var out strings.Builder
+	counter.Write(&out)
+	expected := `# HELP owldb_requests_total Requests handled.
+# TYPE owldb_requests_total counter
+owldb_requests_total{method="GET",status="Get"} 2
+owldb_requests_total{method="PUT",status="Bad \"Request\""} 3
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nwant:\n%s", out.String(), expected)
+	}
+	if counter.Value("GET", "Get") != 2 || counter.Value("DELETE", "Deleted") != 0 {
+		t.Errorf("Unexpected counter values")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	histogram := NewHistogram("owldb_latency_seconds", "Latency.", []float64{0.1, 1}, "method")
+	histogram.Observe(0.05, "GET")
+	histogram.Observe(0.5, "GET")
+	histogram.Observe(2, "GET")
+
+	var out strings.Builder
+	histogram.Write(&out)
+	expected := `# HELP owldb_latency_seconds Latency.
+# TYPE owldb_latency_seconds histogram
+owldb_latency_seconds_bucket{method="GET",le="0.1"} 1
+owldb_latency_seconds_bucket{method="GET",le="1"} 2
+owldb_latency_seconds_bucket{method="GET",le="+Inf"} 3
+owldb_latency_seconds_sum{method="GET"} 2.55
+owldb_latency_seconds_count{method="GET"} 3
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nwant:\n%s", out.String(), expected)
+	}
+	if histogram.Count("GET") != 3 {
+		t.Errorf("Expected 3 observations, got %d", histogram.Count("GET"))
+	}
+}
+
+func TestWriteSamples(t *testing.T) {
+	var out strings.Builder
+	WriteSamples(&out, "owldb_subscribers", "Open subscriptions.", "gauge", nil, []Sample{{Value: 4}})
+	expected := "# HELP owldb_subscribers Open subscriptions.\n# TYPE owldb_subscribers gauge\nowldb_subscribers 4\n"
+	if out.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nwant:\n%s", out.String(), expected)
+	}
+}
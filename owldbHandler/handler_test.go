@@ -2,15 +2,30 @@ package owldbhandler
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/audit"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/config"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/handlers"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/ratelimit"
 	"github.com/RICE-COMP318-FALL24/owldb-p1group35/storage"
+	"github.com/RICE-COMP318-FALL24/owldb-p1group35/websocket"
 )
 
 // TestHelper struct for reusable helper functions
@@ -59,6 +74,37 @@ func (h *TestHelper) PatchDocument(patchOps []map[string]string, token string) {
 	h.MakeRequest("PATCH", "http://localhost:3318/v1/database/doc", r, token)
 }
 
+// Login posts the given credentials to /auth and returns the response
+func (h *TestHelper) Login(credentials map[string]string) *httptest.ResponseRecorder {
+	encoded, _ := json.Marshal(credentials)
+	req := httptest.NewRequest("POST", "http://localhost:3318/auth", bytes.NewReader(encoded))
+	w := httptest.NewRecorder()
+	h.handler.ServeHTTP(w, req)
+	return w
+}
+
+// Subscribe opens a subscription, runs the given action while it is open and
+// returns the recorded event stream once the subscription has been closed
+func (h *TestHelper) Subscribe(url, token string, action func()) *httptest.ResponseRecorder {
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", url, nil).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.handler.ServeHTTP(w, req)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	action()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	return w
+}
+
 // Test Cases
 
 // Test_AddAndRetrieveDatabase tests creating a new database and retrieving it
@@ -1056,3 +1102,1267 @@ func Test_Concurrent_AddDocsCheckingOrder(t *testing.T) {
 		t.Error("Expected doc99 to be the only document returned")
 	}
 }
+
+// Test_SubscribeSendsSnapshot tests that a subscription first receives the current document followed by live updates
+func Test_SubscribeSendsSnapshot(t *testing.T) {
+	handler, _ := New("../storage/anyschema.json", "../nametotoken.json")
+	helper := NewTestHelper(handler, t)
+
+	helper.MakeRequest("PUT", "http://localhost:3318/v1/database", nil, "token1")
+	encoded, _ := json.Marshal(map[string]string{"Description": "Snapshot"})
+	helper.MakeRequest("PUT", "http://localhost:3318/v1/database/doc", bytes.NewReader(encoded), "token1")
+
+	w := helper.Subscribe("http://localhost:3318/v1/database/doc?mode=subscribe", "token1", func() {
+		helper.PatchDocument([]map[string]string{{"op": "ObjectAdd", "path": "/live", "value": "yes"}}, "token1")
+	})
+	helper.AssertStatusCode(w, 200)
+
+	body := w.Body.String()
+	if strings.Count(body, "event: update") != 2 {
+		t.Fatalf("Expected snapshot and live update events, got %q", body)
+	}
+	snapshotIdx := strings.Index(body, "id: 0\n")
+	liveIdx := strings.Index(body, "id: 1\n")
+	if snapshotIdx == -1 || liveIdx == -1 || snapshotIdx > liveIdx {
+		t.Errorf("Expected snapshot with sequence 0 before live update with sequence 1, got %q", body)
+	}
+	if strings.Index(body, "live") < snapshotIdx {
+		t.Errorf("Snapshot should not include the live update")
+	}
+}
+
+// Test_SubscribeCollectionSnapshot tests that a collection subscription receives every document in the interval
+func Test_SubscribeCollectionSnapshot(t *testing.T) {
+	handler, _ := New("../storage/anyschema.json", "../nametotoken.json")
+	helper := NewTestHelper(handler, t)
+
+	helper.MakeRequest("PUT", "http://localhost:3318/v1/database", nil, "token1")
+	encoded, _ := json.Marshal(map[string]string{"Description": "Snapshot"})
+	for _, name := range []string{"a", "b", "c"} {
+		helper.MakeRequest("PUT", "http://localhost:3318/v1/database/"+name, bytes.NewReader(encoded), "token1")
+	}
+
+	w := helper.Subscribe("http://localhost:3318/v1/database/?mode=subscribe&interval=[a,c]", "token1", func() {})
+	helper.AssertStatusCode(w, 200)
+
+	body := w.Body.String()
+	if strings.Count(body, "event: update") != 2 {
+		t.Errorf("Expected two snapshot events for the interval, got %q", body)
+	}
+}
+
+// Test_WebSocketRequestsAndSubscriptions tests requests and a subscription multiplexed on one WebSocket connection
+func Test_WebSocketRequestsAndSubscriptions(t *testing.T) {
+	handler, _ := New("../storage/anyschema.json", "../nametotoken.json")
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer token1")
+	conn, err := websocket.Dial(strings.Replace(server.URL, "http", "ws", 1)+"/ws", header)
+	if err != nil {
+		t.Fatalf("Failed to open WebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	// readMessage reads the next JSON message from the connection
+	readMessage := func() map[string]any {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		var msg map[string]any
+		json.Unmarshal(data, &msg)
+		return msg
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"1","type":"request","method":"PUT","path":"/v1/database"}`))
+	if msg := readMessage(); msg["id"] != "1" || msg["status"] != float64(201) {
+		t.Fatalf("Expected database to be created, got %v", msg)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"2","type":"subscribe","path":"/v1/database/"}`))
+	if msg := readMessage(); msg["id"] != "2" || msg["status"] != float64(200) {
+		t.Fatalf("Expected subscription to open, got %v", msg)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"3","type":"request","method":"PUT","path":"/v1/database/doc","body":{"Description":"ws"}}`))
+	gotResponse, gotEvent := false, false
+	for !gotResponse || !gotEvent {
+		msg := readMessage()
+		if msg["id"] == "3" && msg["status"] == float64(201) {
+			gotResponse = true
+		} else if msg["id"] == "2" && msg["type"] == "event" && msg["event"] == "update" {
+			gotEvent = true
+		} else {
+			t.Fatalf("Unexpected message %v", msg)
+		}
+	}
+}
+
+// Test_SubscribePatchUpdates tests that a subscriber asking for patch updates receives the applied operations and version
+func Test_SubscribePatchUpdates(t *testing.T) {
+	handler, _ := New("../storage/anyschema.json", "../nametotoken.json")
+	helper := NewTestHelper(handler, t)
+
+	helper.MakeRequest("PUT", "http://localhost:3318/v1/database", nil, "token1")
+	encoded, _ := json.Marshal(map[string]string{"Description": "Delta"})
+	helper.MakeRequest("PUT", "http://localhost:3318/v1/database/doc", bytes.NewReader(encoded), "token1")
+
+	w := helper.Subscribe("http://localhost:3318/v1/database/doc?mode=subscribe&updates=patch", "token1", func() {
+		helper.PatchDocument([]map[string]string{{"op": "ObjectAdd", "path": "/live", "value": "yes"}}, "token1")
+	})
+
+	expected := `data: {"path":"/v1/database/doc","version":2,"patch":[{"op":"ObjectAdd","path":"/live","value":"yes"}]}`
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("Expected patch delta in %q", w.Body.String())
+	}
+}
+
+// Test_WebSocketOrigin tests that WebSocket upgrades are only accepted from
+// the configured CORS origins or without an Origin header
+func Test_WebSocketOrigin(t *testing.T) {
+	handler, _ := NewWithOptions(handlers.Options{
+		SchemaFile:  "../storage/anyschema.json",
+		TokenFile:   "../nametotoken.json",
+		CORSOrigins: []string{"https://app.example.com"},
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	url := strings.Replace(server.URL, "http", "ws", 1) + "/ws"
+
+	for origin, allowed := range map[string]bool{"": true, "https://app.example.com": true, "https://evil.example.com": false} {
+		header := http.Header{}
+		header.Set("Authorization", "Bearer token1")
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, err := websocket.Dial(url, header)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != allowed {
+			t.Errorf("Expected a WebSocket from origin %q to be allowed: %v, got error %v", origin, allowed, err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost:3318/ws?token=token1", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a disallowed origin to get 403, got %d", w.Code)
+	}
+}
+
+// Test_SubscriptionEndsOnLogout tests that logging out ends the token's subscriptions with an auth-expired event
+func Test_SubscriptionEndsOnLogout(t *testing.T) {
+	handler, _ := New("../storage/anyschema.json", "../nametotoken.json")
+	helper := NewTestHelper(handler, t)
+
+	helper.MakeRequest("PUT", "http://localhost:3318/v1/database", nil, "token1")
+
+	w := helper.Subscribe("http://localhost:3318/v1/database/?mode=subscribe", "token1", func() {
+		logout := helper.MakeRequest("DELETE", "http://localhost:3318/auth", nil, "token1")
+		helper.AssertStatusCode(logout, 204)
+	})
+
+	if !strings.Contains(w.Body.String(), "event: auth-expired") {
+		t.Errorf("Expected auth-expired event, got %q", w.Body.String())
+	}
+}
+
+// Test_LoginWithoutUsersFile tests that logins are refused without a users
+// file unless insecure logins are allowed
+func Test_LoginWithoutUsersFile(t *testing.T) {
+	handler, _ := New("../storage/anyschema.json", "../nametotoken.json")
+	helper := NewTestHelper(handler, t)
+	helper.AssertStatusCode(helper.Login(map[string]string{"username": "alice"}), 403)
+	helper.AssertStatusCode(helper.Login(map[string]string{"username": "alice", "password": "anything"}), 403)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, "token1"), 201)
+
+	handler, _ = NewWithOptions(handlers.Options{SchemaFile: "../storage/anyschema.json", TokenFile: "../nametotoken.json", InsecureLogin: true})
+	helper = NewTestHelper(handler, t)
+	helper.AssertStatusCode(helper.Login(map[string]string{"username": "alice"}), 200)
+}
+
+// Test_PasswordLoginAndAdminUsers tests password logins against a users file and managing users through the admin API
+func Test_PasswordLoginAndAdminUsers(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.json")
+	opts := handlers.Options{
+		SchemaFile: "../storage/anyschema.json",
+		TokenFile:  "../nametotoken.json",
+		UsersFile:  usersFile,
+	}
+	if _, err := NewWithOptions(opts); err == nil {
+		t.Errorf("Expected a missing users file to fail")
+	}
+	os.WriteFile(usersFile, []byte(`{"root": {"password": "secret", "admin": true}}`), 0600)
+
+	handler, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	helper := NewTestHelper(handler, t)
+
+	// The plaintext password is replaced by its hash on load
+	stored, _ := os.ReadFile(usersFile)
+	if strings.Contains(string(stored), "secret") {
+		t.Errorf("Users file still contains the plaintext password")
+	}
+
+	helper.AssertStatusCode(helper.Login(map[string]string{"username": "root", "password": "wrong"}), 401)
+	helper.AssertStatusCode(helper.Login(map[string]string{"username": "nobody", "password": "secret"}), 401)
+
+	w := helper.Login(map[string]string{"username": "root", "password": "secret"})
+	helper.AssertStatusCode(w, 200)
+	var login map[string]string
+	helper.DecodeResponseBody(w, &login)
+	rootToken := login["token"]
+
+	// Create a regular user who can log in but cannot manage users
+	body, _ := json.Marshal(map[string]any{"password": "hunter2"})
+	w = helper.MakeRequest("PUT", "http://localhost:3318/admin/users/bob", bytes.NewReader(body), rootToken)
+	helper.AssertStatusCode(w, 201)
+
+	w = helper.Login(map[string]string{"username": "bob", "password": "hunter2"})
+	helper.AssertStatusCode(w, 200)
+	helper.DecodeResponseBody(w, &login)
+	bobToken := login["token"]
+
+	w = helper.MakeRequest("GET", "http://localhost:3318/admin/users", nil, bobToken)
+	helper.AssertStatusCode(w, 403)
+
+	w = helper.MakeRequest("GET", "http://localhost:3318/admin/users", nil, rootToken)
+	helper.AssertStatusCode(w, 200)
+	var users []map[string]any
+	helper.DecodeResponseBody(w, &users)
+	if len(users) != 2 {
+		t.Errorf("Expected two users, got %v", users)
+	}
+
+	// Removing a user revokes their tokens
+	w = helper.MakeRequest("DELETE", "http://localhost:3318/admin/users/bob", nil, rootToken)
+	helper.AssertStatusCode(w, 204)
+	w = helper.MakeRequest("PUT", "http://localhost:3318/v1/database", nil, bobToken)
+	helper.AssertStatusCode(w, 401)
+
+	// Service account tokens from the token file keep working
+	w = helper.MakeRequest("PUT", "http://localhost:3318/v1/database", nil, "token1")
+	helper.AssertStatusCode(w, 201)
+}
+
+func Test_SessionsSurviveRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	opts := handlers.Options{
+		SchemaFile: "../storage/anyschema.json",
+		TokenFile:  "../nametotoken.json",
+		UsersFile:  filepath.Join(dataDir, "users.json"),
+		DataDir:    dataDir,
+	}
+	os.WriteFile(opts.UsersFile, []byte(`{"alice": {"password": "secret"}}`), 0600)
+
+	handler, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	helper := NewTestHelper(handler, t)
+	w := helper.Login(map[string]string{"username": "alice", "password": "secret"})
+	helper.AssertStatusCode(w, 200)
+	var login map[string]string
+	helper.DecodeResponseBody(w, &login)
+	token := login["token"]
+
+	// Only the token hash is written to disk
+	stored, err := os.ReadFile(filepath.Join(dataDir, "sessions.json"))
+	if err != nil {
+		t.Fatalf("Sessions were not saved: %v", err)
+	}
+	if strings.Contains(string(stored), token) {
+		t.Errorf("Sessions file contains the plaintext token")
+	}
+
+	restarted, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to restart handler: %v", err)
+	}
+	helper = NewTestHelper(restarted, t)
+	w = helper.MakeRequest("PUT", "http://localhost:3318/v1/database", nil, token)
+	helper.AssertStatusCode(w, 201)
+
+	// Logging out removes the saved session
+	w = helper.MakeRequest("DELETE", "http://localhost:3318/auth", nil, token)
+	helper.AssertStatusCode(w, 204)
+	restarted, _ = NewWithOptions(opts)
+	helper = NewTestHelper(restarted, t)
+	w = helper.MakeRequest("PUT", "http://localhost:3318/v1/other", nil, token)
+	helper.AssertStatusCode(w, 401)
+}
+
+func Test_TokenLifetimeAndRefresh(t *testing.T) {
+	handler, err := NewWithOptions(handlers.Options{
+		SchemaFile:      "../storage/anyschema.json",
+		TokenFile:       "../nametotoken.json",
+		InsecureLogin:   true,
+		SessionLifetime: 300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	helper := NewTestHelper(handler, t)
+
+	w := helper.Login(map[string]string{"username": "alice"})
+	helper.AssertStatusCode(w, 200)
+	var login struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	helper.DecodeResponseBody(w, &login)
+	if time.Until(login.ExpiresAt) > 300*time.Millisecond || login.ExpiresAt.Before(time.Now()) {
+		t.Errorf("Unexpected expiresAt %v", login.ExpiresAt)
+	}
+
+	// Refreshing before expiry keeps the token valid past its original expiry
+	time.Sleep(200 * time.Millisecond)
+	w = helper.MakeRequest("POST", "http://localhost:3318/auth/refresh", nil, login.Token)
+	helper.AssertStatusCode(w, 200)
+	var refreshed struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	helper.DecodeResponseBody(w, &refreshed)
+	if refreshed.Token != login.Token || !refreshed.ExpiresAt.After(login.ExpiresAt) {
+		t.Errorf("Refresh did not extend the token: %+v", refreshed)
+	}
+	time.Sleep(200 * time.Millisecond)
+	w = helper.MakeRequest("PUT", "http://localhost:3318/v1/database", nil, login.Token)
+	helper.AssertStatusCode(w, 201)
+
+	// Once expired the token can no longer be used or refreshed
+	time.Sleep(400 * time.Millisecond)
+	w = helper.MakeRequest("PUT", "http://localhost:3318/v1/other", nil, login.Token)
+	helper.AssertStatusCode(w, 401)
+	w = helper.MakeRequest("POST", "http://localhost:3318/auth/refresh", nil, login.Token)
+	helper.AssertStatusCode(w, 401)
+
+	// Tokens from the token file never expire by default
+	w = helper.MakeRequest("POST", "http://localhost:3318/auth/refresh", nil, "token1")
+	helper.AssertStatusCode(w, 200)
+	var static map[string]any
+	helper.DecodeResponseBody(w, &static)
+	if _, ok := static["expiresAt"]; ok {
+		t.Errorf("Static token should not have an expiry: %v", static)
+	}
+}
+
+func Test_PathACLs(t *testing.T) {
+	handler, err := NewWithOptions(handlers.Options{SchemaFile: "../storage/anyschema.json", TokenFile: "../nametotoken.json", InsecureLogin: true})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	helper := NewTestHelper(handler, t)
+	tokens := make(map[string]string)
+	for _, user := range []string{"alice", "bob"} {
+		var login map[string]string
+		helper.DecodeResponseBody(helper.Login(map[string]string{"username": user}), &login)
+		tokens[user] = login["token"]
+	}
+
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, tokens["alice"]), 201)
+
+	// Bob cannot take over alice's database by attaching the first ACL
+	takeover := `{"users": {"bob": "admin"}}`
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db?mode=acl", strings.NewReader(takeover), tokens["bob"]), 403)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/missing?mode=acl", strings.NewReader(takeover), tokens["bob"]), 404)
+	helper.AssertStatusCode(helper.MakeRequest("DELETE", "http://localhost:3318/v1/db?mode=acl", nil, tokens["alice"]), 404)
+
+	acl := `{"users": {"alice": "admin", "*": "read"}}`
+	w := helper.MakeRequest("PUT", "http://localhost:3318/v1/db?mode=acl", strings.NewReader(acl), tokens["alice"])
+	helper.AssertStatusCode(w, 200)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/public", strings.NewReader(`{"a": 1}`), tokens["alice"]), 201)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/secret", strings.NewReader(`{"b": 2}`), tokens["alice"]), 201)
+	w = helper.MakeRequest("PUT", "http://localhost:3318/v1/db/secret?mode=acl", strings.NewReader(`{"users": {"alice": "admin"}}`), tokens["alice"])
+	helper.AssertStatusCode(w, 200)
+
+	// Bob inherits read on the database but cannot write or change ACLs
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/public", nil, tokens["bob"]), 200)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/public", strings.NewReader(`{}`), tokens["bob"]), 403)
+	helper.AssertStatusCode(helper.MakeRequest("DELETE", "http://localhost:3318/v1/db", nil, tokens["bob"]), 403)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db?mode=acl", nil, tokens["bob"]), 403)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db?mode=acl", strings.NewReader(`{}`), tokens["bob"]), 403)
+
+	// The deeper ACL hides the secret document, including from listings
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/secret", nil, tokens["bob"]), 403)
+	var docs []map[string]any
+	helper.DecodeResponseBody(helper.MakeRequest("GET", "http://localhost:3318/v1/db/", nil, tokens["bob"]), &docs)
+	if len(docs) != 1 || docs[0]["path"] != "/v1/db/public" {
+		t.Errorf("Expected bob to only see the public document, got %v", docs)
+	}
+	helper.DecodeResponseBody(helper.MakeRequest("GET", "http://localhost:3318/v1/db/", nil, tokens["alice"]), &docs)
+	if len(docs) != 2 {
+		t.Errorf("Expected alice to see both documents, got %v", docs)
+	}
+
+	// Deleting the database removes its ACLs
+	helper.AssertStatusCode(helper.MakeRequest("DELETE", "http://localhost:3318/v1/db", nil, tokens["alice"]), 204)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, tokens["bob"]), 201)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db?mode=acl", nil, tokens["bob"]), 200)
+}
+
+func Test_OwnerOnlyPolicy(t *testing.T) {
+	dataDir := t.TempDir()
+	opts := handlers.Options{SchemaFile: "../storage/anyschema.json", TokenFile: "../nametotoken.json", DataDir: dataDir, InsecureLogin: true}
+	handler, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	helper := NewTestHelper(handler, t)
+	tokens := make(map[string]string)
+	for _, user := range []string{"alice", "bob"} {
+		var login map[string]string
+		helper.DecodeResponseBody(helper.Login(map[string]string{"username": user}), &login)
+		tokens[user] = login["token"]
+	}
+
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, tokens["alice"]), 201)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/missing?mode=policy", strings.NewReader(`{"ownerOnly": true}`), tokens["alice"]), 404)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db?mode=policy", strings.NewReader(`{"ownerOnly": true}`), tokens["bob"]), 403)
+	w := helper.MakeRequest("PUT", "http://localhost:3318/v1/db?mode=policy", strings.NewReader(`{"ownerOnly": true}`), tokens["alice"])
+	helper.AssertStatusCode(w, 200)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/doc", strings.NewReader(`{"a": 1}`), tokens["alice"]), 201)
+
+	// Bob may create his own documents but not change Alice's
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/doc", strings.NewReader(`{"a": 2}`), tokens["bob"]), 403)
+	helper.AssertStatusCode(helper.MakeRequest("PATCH", "http://localhost:3318/v1/db/doc", strings.NewReader(`[{"op": "ObjectAdd", "path": "/b", "value": 1}]`), tokens["bob"]), 403)
+	helper.AssertStatusCode(helper.MakeRequest("DELETE", "http://localhost:3318/v1/db/doc", nil, tokens["bob"]), 403)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/bobdoc", strings.NewReader(`{}`), tokens["bob"]), 201)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/doc", strings.NewReader(`{"a": 2}`), tokens["alice"]), 200)
+
+	var policy map[string]any
+	helper.DecodeResponseBody(helper.MakeRequest("GET", "http://localhost:3318/v1/db?mode=policy", nil, tokens["bob"]), &policy)
+	if policy["ownerOnly"] != true {
+		t.Errorf("Expected the owner-only policy, got %v", policy)
+	}
+
+	// The policy is saved with the ACLs and survives a restart, which keeps
+	// login sessions but not documents
+	handler.Close()
+	handler, err = NewWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to restart handler: %v", err)
+	}
+	defer handler.Close()
+	restarted := NewTestHelper(handler, t)
+	restarted.AssertStatusCode(restarted.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, tokens["alice"]), 201)
+	restarted.DecodeResponseBody(restarted.MakeRequest("GET", "http://localhost:3318/v1/db?mode=policy", nil, tokens["bob"]), &policy)
+	if policy["ownerOnly"] != true {
+		t.Errorf("Expected the owner-only policy after a restart, got %v", policy)
+	}
+	restarted.AssertStatusCode(restarted.MakeRequest("PUT", "http://localhost:3318/v1/db/doc", strings.NewReader(`{"a": 1}`), tokens["alice"]), 201)
+	restarted.AssertStatusCode(restarted.MakeRequest("DELETE", "http://localhost:3318/v1/db/doc", nil, tokens["bob"]), 403)
+
+	// Turning the policy off allows anyone with write access again
+	restarted.MakeRequest("PUT", "http://localhost:3318/v1/db?mode=policy", strings.NewReader(`{"ownerOnly": false}`), tokens["alice"])
+	restarted.AssertStatusCode(restarted.MakeRequest("DELETE", "http://localhost:3318/v1/db/doc", nil, tokens["bob"]), 204)
+}
+
+func Test_AdminSessionsAndServiceTokens(t *testing.T) {
+	dir := t.TempDir()
+	usersFile := filepath.Join(dir, "users.json")
+	tokenFile := filepath.Join(dir, "tokens.json")
+	os.WriteFile(usersFile, []byte(`{"root": {"password": "secret", "admin": true}, "alice": {"password": "pw"}}`), 0600)
+	os.WriteFile(tokenFile, []byte(`{"Brad": "token1"}`), 0600)
+
+	handler, err := NewWithOptions(handlers.Options{
+		SchemaFile: "../storage/anyschema.json",
+		TokenFile:  tokenFile,
+		UsersFile:  usersFile,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	helper := NewTestHelper(handler, t)
+	var login map[string]string
+	helper.DecodeResponseBody(helper.Login(map[string]string{"username": "root", "password": "secret"}), &login)
+	rootToken := login["token"]
+	helper.DecodeResponseBody(helper.Login(map[string]string{"username": "alice", "password": "pw"}), &login)
+	aliceToken := login["token"]
+
+	var sessions []map[string]any
+	helper.DecodeResponseBody(helper.MakeRequest("GET", "http://localhost:3318/admin/sessions", nil, rootToken), &sessions)
+	if len(sessions) != 3 || sessions[0]["username"] != "Brad" || sessions[0]["kind"] != "static" {
+		t.Errorf("Unexpected sessions %v", sessions)
+	}
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/admin/sessions", nil, aliceToken), 403)
+
+	// Service tokens are limited to their scopes
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, rootToken), 201)
+	body := strings.NewReader(`{"username": "ci", "scopes": ["read:/v1/db"], "ttl": "10m"}`)
+	w := helper.MakeRequest("POST", "http://localhost:3318/admin/tokens", body, rootToken)
+	helper.AssertStatusCode(w, 201)
+	var service map[string]any
+	helper.DecodeResponseBody(w, &service)
+	serviceToken := service["token"].(string)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/", nil, serviceToken), 200)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/doc", strings.NewReader(`{}`), serviceToken), 403)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/other", nil, serviceToken), 403)
+	body = strings.NewReader(`{"username": "ci", "scopes": ["owner"]}`)
+	helper.AssertStatusCode(helper.MakeRequest("POST", "http://localhost:3318/admin/tokens", body, rootToken), 400)
+
+	// Service tokens of admin users only reach /admin with the admin scope
+	for scopes, status := range map[string]int{`["write"]`: 403, `["admin:/v1/db"]`: 403, `["admin"]`: 200} {
+		body = strings.NewReader(`{"username": "root", "scopes": ` + scopes + `}`)
+		var adminService map[string]any
+		helper.DecodeResponseBody(helper.MakeRequest("POST", "http://localhost:3318/admin/tokens", body, rootToken), &adminService)
+		w = helper.MakeRequest("GET", "http://localhost:3318/admin/sessions", nil, adminService["token"].(string))
+		if w.Code != status {
+			t.Errorf("Expected a service token with scopes %s to get %d from /admin, got %d", scopes, status, w.Code)
+		}
+	}
+
+	// Revoking a user's tokens
+	w = helper.MakeRequest("DELETE", "http://localhost:3318/admin/sessions?user=alice", nil, rootToken)
+	helper.AssertStatusCode(w, 200)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db2", nil, aliceToken), 401)
+
+	// Reloading the token file keeps login sessions
+	os.WriteFile(tokenFile, []byte(`{"Brad": "token2"}`), 0600)
+	helper.AssertStatusCode(helper.MakeRequest("POST", "http://localhost:3318/admin/tokens/reload", nil, rootToken), 200)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db3", nil, "token1"), 401)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db3", nil, "token2"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db4", nil, rootToken), 201)
+
+	// Revoking a single token by its ID
+	helper.AssertStatusCode(helper.MakeRequest("DELETE", "http://localhost:3318/admin/sessions/"+service["id"].(string), nil, rootToken), 204)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/", nil, serviceToken), 401)
+}
+
+func Test_JWTAuthMode(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "jwt.key")
+	os.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef\n"), 0600)
+	usersFile := filepath.Join(dir, "users.json")
+	os.WriteFile(usersFile, []byte(`{"root": {"password": "secret", "admin": true}, "alice": {"password": "pw"}}`), 0600)
+	// Revocations older than any token they could apply to are dropped
+	os.WriteFile(filepath.Join(dir, "revoked.json"), []byte(`{"ids": {"old": "2020-01-01T00:00:00Z"}, "users": {"carol": "2020-01-01T00:00:00Z"}}`), 0600)
+	opts := handlers.Options{
+		SchemaFile: "../storage/anyschema.json",
+		TokenFile:  "../nametotoken.json",
+		UsersFile:  usersFile,
+		DataDir:    dir,
+		JWTKeyFile: keyFile,
+	}
+	first, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	second, _ := NewWithOptions(opts)
+	helperA := NewTestHelper(first, t)
+	helperB := NewTestHelper(second, t)
+
+	w := helperA.Login(map[string]string{"username": "alice", "password": "pw"})
+	helperA.AssertStatusCode(w, 200)
+	var login map[string]string
+	helperA.DecodeResponseBody(w, &login)
+	token := login["token"]
+	if strings.Count(token, ".") != 2 || login["expiresAt"] == "" {
+		t.Fatalf("Expected a JWT with an expiry, got %v", login)
+	}
+
+	// Any instance with the key accepts the token
+	helperB.AssertStatusCode(helperB.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, token), 201)
+	helperA.AssertStatusCode(helperA.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, token+"x"), 401)
+	helperA.AssertStatusCode(helperA.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, "token1"), 201)
+
+	// Refreshing issues a new token and revokes the old one
+	w = helperA.MakeRequest("POST", "http://localhost:3318/auth/refresh", nil, token)
+	helperA.AssertStatusCode(w, 200)
+	helperA.DecodeResponseBody(w, &login)
+	if login["token"] == token {
+		t.Errorf("Expected a new token from refresh")
+	}
+	helperA.AssertStatusCode(helperA.MakeRequest("PUT", "http://localhost:3318/v1/db2", nil, token), 401)
+	token = login["token"]
+
+	// Logout adds the token to the revocation list, which new instances load
+	helperA.AssertStatusCode(helperA.MakeRequest("DELETE", "http://localhost:3318/auth", nil, token), 204)
+	helperA.AssertStatusCode(helperA.MakeRequest("PUT", "http://localhost:3318/v1/db3", nil, token), 401)
+	third, _ := NewWithOptions(opts)
+	helperC := NewTestHelper(third, t)
+	helperC.AssertStatusCode(helperC.MakeRequest("PUT", "http://localhost:3318/v1/db3", nil, token), 401)
+
+	// Revoking all of a user's tokens still lets them log in again at once
+	w = helperA.Login(map[string]string{"username": "root", "password": "secret"})
+	helperA.DecodeResponseBody(w, &login)
+	rootToken := login["token"]
+	helperA.DecodeResponseBody(helperA.Login(map[string]string{"username": "alice", "password": "pw"}), &login)
+	token = login["token"]
+	w = helperA.Subscribe("http://localhost:3318/v1/db/?mode=subscribe", token, func() {
+		helperA.AssertStatusCode(helperA.MakeRequest("DELETE", "http://localhost:3318/admin/sessions?user=alice", nil, rootToken), 200)
+	})
+	if !strings.Contains(w.Body.String(), "event: auth-expired") {
+		t.Errorf("Expected the revoked JWT's subscription to end, got %q", w.Body.String())
+	}
+	helperA.AssertStatusCode(helperA.MakeRequest("PUT", "http://localhost:3318/v1/db3", nil, token), 401)
+	helperA.DecodeResponseBody(helperA.Login(map[string]string{"username": "alice", "password": "pw"}), &login)
+	loggedIn := time.Now()
+	helperA.AssertStatusCode(helperA.MakeRequest("PUT", "http://localhost:3318/v1/db3", nil, login["token"]), 201)
+	var claims struct {
+		IssuedAt int64 `json:"iat"`
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(login["token"], ".")[1])
+	if json.Unmarshal(payload, &claims); claims.IssuedAt > loggedIn.Unix() {
+		t.Errorf("Expected the issued at claim not to be in the future, got %d", claims.IssuedAt)
+	}
+
+	// An instance saving its revocations keeps those saved by the others
+	helperC.AssertStatusCode(helperC.MakeRequest("DELETE", "http://localhost:3318/auth", nil, login["token"]), 204)
+	fourth, _ := NewWithOptions(opts)
+	helperD := NewTestHelper(fourth, t)
+	helperD.AssertStatusCode(helperD.MakeRequest("PUT", "http://localhost:3318/v1/db4", nil, token), 401)
+	helperD.AssertStatusCode(helperD.MakeRequest("PUT", "http://localhost:3318/v1/db4", nil, login["token"]), 401)
+	saved, _ := os.ReadFile(filepath.Join(dir, "revoked.json"))
+	if strings.Contains(string(saved), "carol") || strings.Contains(string(saved), `"old"`) {
+		t.Errorf("Expected stale revocations to be dropped, got %s", saved)
+	}
+
+	// Service tokens cannot outlive the revocation list
+	body := strings.NewReader(`{"username": "ci", "scopes": ["read"], "ttl": "8760h"}`)
+	helperA.AssertStatusCode(helperA.MakeRequest("POST", "http://localhost:3318/admin/tokens", body, rootToken), 400)
+
+	// Only IDs of tokens this server could have issued can be revoked
+	body = strings.NewReader(`{"username": "ci", "scopes": ["read"]}`)
+	var service map[string]any
+	helperA.DecodeResponseBody(helperA.MakeRequest("POST", "http://localhost:3318/admin/tokens", body, rootToken), &service)
+	for _, id := range []string{"typo", "1-" + strings.SplitN(service["id"].(string), "-", 2)[1], strings.ToLower(service["id"].(string))} {
+		helperA.AssertStatusCode(helperA.MakeRequest("DELETE", "http://localhost:3318/admin/sessions/"+id, nil, rootToken), 404)
+	}
+	helperA.AssertStatusCode(helperA.MakeRequest("DELETE", "http://localhost:3318/admin/sessions/"+service["id"].(string), nil, rootToken), 204)
+	helperA.AssertStatusCode(helperA.MakeRequest("GET", "http://localhost:3318/v1/db/", nil, service["token"].(string)), 401)
+}
+
+func Test_RateLimits(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.json")
+	os.WriteFile(usersFile, []byte(`{"root": {"password": "secret", "admin": true}}`), 0600)
+	handler, err := NewWithOptions(handlers.Options{
+		SchemaFile: "../storage/anyschema.json",
+		TokenFile:  "../nametotoken.json",
+		UsersFile:  usersFile,
+		RateLimits: map[string]ratelimit.Limit{
+			handlers.RouteWrites: {Rate: 0.1, Burst: 2},
+			handlers.RouteAuth:   {Rate: 0.1, Burst: 2},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	helper := NewTestHelper(handler, t)
+
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db1", nil, "token1"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db2", nil, "token1"), 201)
+	w := helper.MakeRequest("PUT", "http://localhost:3318/v1/db3", nil, "token1")
+	helper.AssertStatusCode(w, 429)
+	if retry := w.Header().Get("Retry-After"); retry != "10" {
+		t.Errorf("Expected Retry-After of 10 seconds, got %q", retry)
+	}
+
+	// Reads have their own, unlimited, class
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db1/", nil, "token1"), 200)
+
+	// Logins are limited per client address
+	w = helper.Login(map[string]string{"username": "root", "password": "secret"})
+	helper.AssertStatusCode(w, 200)
+	var login map[string]string
+	helper.DecodeResponseBody(w, &login)
+	helper.AssertStatusCode(helper.Login(map[string]string{"username": "root", "password": "wrong"}), 401)
+	helper.AssertStatusCode(helper.Login(map[string]string{"username": "root", "password": "secret"}), 429)
+
+	var state map[string]map[string]any
+	helper.DecodeResponseBody(helper.MakeRequest("GET", "http://localhost:3318/admin/ratelimits", nil, login["token"]), &state)
+	buckets := state[handlers.RouteWrites]["buckets"].([]any)
+	if len(buckets) != 1 || buckets[0].(map[string]any)["key"] != "Brad" {
+		t.Errorf("Expected Brad's write bucket, got %v", state[handlers.RouteWrites])
+	}
+}
+
+// Test_AuditLog tests that changes made through storage and auth requests are
+// audited in a hash chained log, and reads are not
+func Test_AuditLog(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	handler, err := NewWithOptions(handlers.Options{
+		SchemaFile:    "../storage/anyschema.json",
+		TokenFile:     "../nametotoken.json",
+		AuditFile:     auditFile,
+		InsecureLogin: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	helper := NewTestHelper(handler, t)
+
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, "token1"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/doc", strings.NewReader(`{"a":1}`), "token1"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/doc", nil, "token1"), 200)
+	helper.AssertStatusCode(helper.MakeRequest("DELETE", "http://localhost:3318/v1/db/missing", nil, "token1"), 404)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db2", nil, "bad"), 401)
+
+	w := helper.Login(map[string]string{"username": "alice"})
+	helper.AssertStatusCode(w, 200)
+	var login map[string]string
+	helper.DecodeResponseBody(w, &login)
+	helper.AssertStatusCode(helper.MakeRequest("DELETE", "http://localhost:3318/auth", nil, login["token"]), 204)
+
+	count, err := audit.Verify(auditFile)
+	if err != nil || count != 6 {
+		t.Fatalf("Expected 6 chained audit entries, got %d, %v", count, err)
+	}
+
+	data, _ := os.ReadFile(auditFile)
+	var entries []audit.Entry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry audit.Entry
+		json.Unmarshal([]byte(line), &entry)
+		entries = append(entries, entry)
+	}
+	expected := []audit.Entry{
+		{Username: "Brad", Method: "PUT", Path: "/v1/db", Status: 201, StatusClass: "Created"},
+		{Username: "Brad", Method: "PUT", Path: "/v1/db/doc", Status: 201, StatusClass: "Created", ContentHash: audit.HashContent([]byte(`{"a":1}`))},
+		{Username: "Brad", Method: "DELETE", Path: "/v1/db/missing", Status: 404, StatusClass: "Does Not Exist"},
+		{Username: "", Method: "PUT", Path: "/v1/db2", Status: 401, StatusClass: "Unauthorized"},
+		{Username: "alice", Method: "POST", Path: "/auth", Status: 200, StatusClass: "OK"},
+		{Username: "alice", Method: "DELETE", Path: "/auth", Status: 204, StatusClass: "No Content"},
+	}
+	for i, want := range expected {
+		got := entries[i]
+		if got.Username != want.Username || got.Method != want.Method || got.Path != want.Path ||
+			got.Status != want.Status || got.StatusClass != want.StatusClass || got.ContentHash != want.ContentHash {
+			t.Errorf("Audit entry %d = %+v, want %+v", i, got, want)
+		}
+	}
+
+	// A token in the query never reaches the audit log, which cannot be
+	// edited afterwards
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db3?token=token1", nil, "token1"), 201)
+	data, _ = os.ReadFile(auditFile)
+	if strings.Contains(string(data), "token1") || !strings.Contains(string(data), `"path":"/v1/db3?token=REDACTED"`) {
+		t.Errorf("Expected the query token to be redacted, got %s", data)
+	}
+}
+
+// Test_SizeLimits tests body limits per method, document size and depth
+// limits, and the counts of rejected requests
+func Test_SizeLimits(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.json")
+	os.WriteFile(usersFile, []byte(`{"root": {"password": "secret", "admin": true}}`), 0600)
+	handler, err := NewWithOptions(handlers.Options{
+		SchemaFile:     "../storage/anyschema.json",
+		TokenFile:      "../nametotoken.json",
+		UsersFile:      usersFile,
+		MaxBodySize:    map[string]int64{"PATCH": 64},
+		DocumentLimits: storage.DocumentLimits{MaxSize: 100, MaxDepth: 3},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	helper := NewTestHelper(handler, t)
+
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/database", nil, "token1"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/database/doc", strings.NewReader(`{"a":{"b":1}}`), "token1"), 201)
+
+	// Bodies over the default limit are rejected before being read in full
+	huge := strings.NewReader(`{"a":"` + strings.Repeat("x", handlers.DefaultMaxBodySize) + `"}`)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/database/huge", huge, "token1"), 413)
+
+	// PATCH has its own, smaller, limit
+	patch := `[{"op":"ObjectAdd","path":"/c","value":"` + strings.Repeat("x", 64) + `"}]`
+	helper.AssertStatusCode(helper.MakeRequest("PATCH", "http://localhost:3318/v1/database/doc", strings.NewReader(patch), "token1"), 413)
+
+	// Documents are limited whatever the body limit
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/database/big", strings.NewReader(`{"a":"`+strings.Repeat("x", 100)+`"}`), "token1"), 413)
+	helper.AssertStatusCode(helper.MakeRequest("POST", "http://localhost:3318/v1/database/", strings.NewReader(`{"a":[[[1]]]}`), "token1"), 400)
+
+	w := helper.Login(map[string]string{"username": "root", "password": "secret"})
+	var login map[string]string
+	helper.DecodeResponseBody(w, &login)
+	var limits map[string]map[string]any
+	helper.DecodeResponseBody(helper.MakeRequest("GET", "http://localhost:3318/admin/limits", nil, login["token"]), &limits)
+	expected := map[string]any{"bodyTooLarge": 2.0, "documentTooLarge": 1.0, "documentTooDeep": 1.0}
+	for reason, count := range expected {
+		if limits["rejected"][reason] != count {
+			t.Errorf("Expected %v requests rejected as %s, got %v", count, reason, limits["rejected"][reason])
+		}
+	}
+	if limits["maxBodySize"]["PATCH"] != 64.0 || limits["maxBodySize"][handlers.AllMethods] != float64(handlers.DefaultMaxBodySize) {
+		t.Errorf("Unexpected body limits %v", limits["maxBodySize"])
+	}
+}
+
+// Test_Metrics tests that /metrics reports requests, latencies, logins,
+// subscribers and database sizes in the Prometheus text format
+func Test_Metrics(t *testing.T) {
+	dir := t.TempDir()
+	usersFile, metricsTokenFile := filepath.Join(dir, "users.json"), filepath.Join(dir, "metrics.token")
+	os.WriteFile(usersFile, []byte(`{"root": {"password": "secret", "admin": true}, "alice": {"password": "pw"}}`), 0600)
+	os.WriteFile(metricsTokenFile, []byte("scrape-token\n"), 0600)
+	handler, err := NewWithOptions(handlers.Options{
+		SchemaFile:       "../storage/anyschema.json",
+		TokenFile:        "../nametotoken.json",
+		UsersFile:        usersFile,
+		MetricsTokenFile: metricsTokenFile,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	helper := NewTestHelper(handler, t)
+	var login map[string]string
+	helper.DecodeResponseBody(helper.Login(map[string]string{"username": "root", "password": "secret"}), &login)
+	rootToken := login["token"]
+
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, "token1"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/doc1", strings.NewReader(`{"a":1}`), "token1"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/doc2", strings.NewReader(`{"a":2}`), "token1"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/missing", nil, "token1"), 404)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/doc1", nil, "bad"), 401)
+	for _, method := range []string{"BREW", "WHEN"} {
+		helper.MakeRequest(method, "http://localhost:3318/v1/db/doc1", nil, "token1")
+	}
+	helper.DecodeResponseBody(helper.Login(map[string]string{"username": "alice", "password": "pw"}), &login)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/metrics", nil, ""), 401)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/metrics", nil, login["token"]), 403)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/metrics", nil, rootToken), 200)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/", nil, "scrape-token"), 401)
+	helper.AssertStatusCode(helper.MakeRequest("DELETE", "http://localhost:3318/auth", nil, login["token"]), 204)
+	helper.AssertStatusCode(helper.MakeRequest("DELETE", "http://localhost:3318/auth", nil, login["token"]), 401)
+
+	// Only the largest databases get a series of their own
+	for i := range 25 {
+		helper.MakeRequest("PUT", fmt.Sprintf("http://localhost:3318/v1/empty%d", i), nil, "token1")
+	}
+
+	var body string
+	helper.Subscribe("http://localhost:3318/v1/db/doc1?mode=subscribe", "token1", func() {
+		w := helper.MakeRequest("GET", "http://localhost:3318/metrics", nil, "scrape-token")
+		helper.AssertStatusCode(w, 200)
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("Expected text metrics, got %s", w.Header().Get("Content-Type"))
+		}
+		body = w.Body.String()
+	})
+
+	expected := []string{
+		`owldb_requests_total{method="PUT",storage_type="Database",status_class="Created"} 26`,
+		`owldb_requests_total{method="PUT",storage_type="Document",status_class="Created"} 2`,
+		`owldb_requests_total{method="GET",storage_type="Document",status_class="Does Not Exist"} 1`,
+		`owldb_requests_total{method="GET",storage_type="Document",status_class="Unauthorized"} 1`,
+		`owldb_request_duration_seconds_count{method="PUT",storage_type="Document"} 2`,
+		`owldb_request_duration_seconds_bucket{method="PUT",storage_type="Document",le="+Inf"} 2`,
+		`owldb_auth_requests_total{action="login",result="success"} 2`,
+		`owldb_auth_requests_total{action="logout",result="success"} 1`,
+		`owldb_auth_requests_total{action="logout",result="failure"} 1`,
+		`owldb_subscribers 1`,
+		`owldb_database_documents{database="db"} 2`,
+		`owldb_databases 26`,
+		`owldb_documents 2`,
+		`# TYPE owldb_request_duration_seconds histogram`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected metrics to contain %q", line)
+		}
+	}
+	if strings.Contains(body, "BREW") || !strings.Contains(body, `owldb_requests_total{method="OTHER",storage_type="Document"`) {
+		t.Errorf("Expected unknown methods to be counted as OTHER")
+	}
+	if series := strings.Count(body, "owldb_database_documents{"); series != 20 {
+		t.Errorf("Expected 20 database series, got %d", series)
+	}
+}
+
+// Test_HealthAndInfo tests the liveness and readiness probes, readiness
+// failing once the server drains, and the server info endpoint
+func Test_HealthAndInfo(t *testing.T) {
+	handler, err := New("../storage/anyschema.json", "../nametotoken.json")
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	defer handler.Close()
+	helper := NewTestHelper(handler, t)
+
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/healthz", nil, ""), 200)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/readyz", nil, ""), 200)
+
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db1", nil, "token1"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db2", nil, "token1"), 201)
+
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/_info", nil, "bad"), 401)
+	w := helper.MakeRequest("GET", "http://localhost:3318/v1/_info", nil, "token1")
+	helper.AssertStatusCode(w, 200)
+	var info map[string]any
+	helper.DecodeResponseBody(w, &info)
+	if info["version"] != handlers.Version || info["databases"] != 2.0 {
+		t.Errorf("Unexpected server info %v", info)
+	}
+	features := info["features"].(map[string]any)
+	if features["jwt"] != false || features["passwordLogin"] != false {
+		t.Errorf("Unexpected features %v", features)
+	}
+
+	// The info endpoint's name cannot be taken by a database
+	w = helper.MakeRequest("PUT", "http://localhost:3318/v1/_info", nil, "token1")
+	helper.AssertStatusCode(w, 400)
+	if !strings.Contains(w.Body.String(), "reserved") {
+		t.Errorf("Expected _info to be reserved, got %s", w.Body.String())
+	}
+	helper.AssertStatusCode(helper.MakeRequest("OPTIONS", "http://localhost:3318/v1/_info", nil, ""), 200)
+
+	// Draining fails readiness but not liveness
+	handler.Drain()
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/readyz", nil, ""), 503)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/healthz", nil, ""), 200)
+}
+
+// Test_RequestIDs tests that request IDs are accepted or assigned, echoed in
+// responses and subscription events, and included in the storage logs of
+// the request
+func Test_RequestIDs(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(defaultLogger)
+
+	handler, err := New("../storage/anyschema.json", "../nametotoken.json")
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	defer handler.Close()
+
+	request := func(method, url, body, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token1")
+		if id != "" {
+			req.Header.Set(handlers.RequestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("PUT", "http://localhost:3318/v1/db", "", "")
+	if len(w.Header().Get(handlers.RequestIDHeader)) == 0 {
+		t.Errorf("Expected a generated request ID")
+	}
+	w = request("PUT", "http://localhost:3318/v1/db/doc", `{"a":1}`, "abc-123")
+	if id := w.Header().Get(handlers.RequestIDHeader); id != "abc-123" {
+		t.Errorf("Expected the client's request ID to be echoed, got %q", id)
+	}
+	w = request("GET", "http://localhost:3318/v1/db/doc", "", "bad id\n")
+	if id := w.Header().Get(handlers.RequestIDHeader); id == "" || strings.ContainsAny(id, " \n") {
+		t.Errorf("Expected an invalid request ID to be replaced, got %q", id)
+	}
+
+	// Logs from the handler, storage and skiplist carry the request's ID and user
+	found := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]any
+		json.Unmarshal([]byte(line), &record)
+		if record["requestID"] == "abc-123" && record["username"] == "Brad" {
+			found[record["msg"].(string)] = true
+		}
+		// Validation runs before the user is known
+		if record["msg"] == "in requestvalid" && record["requestID"] == "abc-123" && record["level"] == "DEBUG" {
+			found["in requestvalid"] = true
+		}
+	}
+	for _, msg := range []string{"Request Valid", "in requestvalid", "PUT operation successful: new document created", "inserting node"} {
+		if !found[msg] {
+			t.Errorf("Expected log %q with the request ID and user", msg)
+		}
+	}
+
+	helper := NewTestHelper(handler, t)
+	stream := helper.Subscribe("http://localhost:3318/v1/db/doc?mode=subscribe", "token1", func() {
+		request("PUT", "http://localhost:3318/v1/db/doc", `{"a":2}`, "write-42")
+	})
+	if !strings.Contains(stream.Body.String(), ": request-id write-42\nevent: update\n") {
+		t.Errorf("Expected the writing request's ID in the event, got %s", stream.Body.String())
+	}
+}
+
+// Test_AccessLog tests that every request gets an access log line with its
+// user, status, size, duration and whether it was a subscription
+func Test_AccessLog(t *testing.T) {
+	var accessLog bytes.Buffer
+	handler, err := NewWithOptions(handlers.Options{
+		SchemaFile:      "../storage/anyschema.json",
+		TokenFile:       "../nametotoken.json",
+		AccessLog:       &accessLog,
+		AccessLogFormat: handlers.AccessLogJSON,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	defer handler.Close()
+
+	helper := NewTestHelper(handler, t)
+	helper.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, "token1")
+	w := helper.MakeRequest("GET", "http://localhost:3318/v1/db/", nil, "token1")
+	helper.MakeRequest("GET", "http://localhost:3318/v1/db/", nil, "badtoken")
+	helper.Subscribe("http://localhost:3318/v1/db/?mode=subscribe", "token1", func() {})
+
+	lines := strings.Split(strings.TrimSpace(accessLog.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 access log lines, got %d:\n%s", len(lines), accessLog.String())
+	}
+	var entries []map[string]any
+	for _, line := range lines {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Access log line is not JSON: %s", line)
+		}
+		entries = append(entries, entry)
+	}
+
+	if entries[0]["user"] != "Brad" || entries[0]["method"] != "PUT" || entries[0]["status"] != float64(http.StatusCreated) {
+		t.Errorf("Unexpected entry for PUT: %v", entries[0])
+	}
+	if entries[1]["bytes"] != float64(w.Body.Len()) || entries[1]["requestID"] != w.Header().Get(handlers.RequestIDHeader) {
+		t.Errorf("Expected GET entry to count %d bytes and carry the request ID, got %v", w.Body.Len(), entries[1])
+	}
+	if _, ok := entries[2]["user"]; ok || entries[2]["status"] != float64(http.StatusUnauthorized) {
+		t.Errorf("Expected unauthorized entry without a user, got %v", entries[2])
+	}
+	if entries[3]["subscription"] != true || entries[1]["subscription"] != false {
+		t.Errorf("Expected only the subscription to be marked, got %v and %v", entries[1], entries[3])
+	}
+	if entries[3]["durationSeconds"].(float64) < 0.05 {
+		t.Errorf("Expected subscription duration to span the subscription, got %v", entries[3]["durationSeconds"])
+	}
+
+	// Tokens given in the query, as WebSocket clients may, are not logged
+	accessLog.Reset()
+	helper.MakeRequest("GET", "http://localhost:3318/ws?token=token1&x=1", nil, "")
+	if strings.Contains(accessLog.String(), "token1") || !strings.Contains(accessLog.String(), `"path":"/ws?token=REDACTED\u0026x=1"`) {
+		t.Errorf("Expected the query token to be redacted, got %s", accessLog.String())
+	}
+
+	// The combined format quotes fields a client controls
+	accessLog.Reset()
+	handler, _ = NewWithOptions(handlers.Options{
+		SchemaFile:      "../storage/anyschema.json",
+		TokenFile:       "../nametotoken.json",
+		AccessLog:       &accessLog,
+		AccessLogFormat: handlers.AccessLogCombined,
+	})
+	defer handler.Close()
+	req := httptest.NewRequest("PUT", "http://localhost:3318/v1/db", nil)
+	req.Header.Set("Authorization", "Bearer token1")
+	req.Header.Set("User-Agent", `evil" agent`)
+	req.Header.Set(handlers.RequestIDHeader, "combined-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := accessLog.String()
+	if !strings.HasPrefix(line, "192.0.2.1 - Brad [") ||
+		!strings.Contains(line, `] "PUT /v1/db HTTP/1.1" 201 `) ||
+		!strings.Contains(line, ` "-" "evil\" agent" `) ||
+		!strings.HasSuffix(line, " subscription=false request_id=combined-1\n") {
+		t.Errorf("Unexpected combined access log line: %q", line)
+	}
+}
+
+// Test_ConfigAndCORS tests that the effective configuration is shown to
+// admins with secrets redacted, and that only configured origins are allowed
+func Test_ConfigAndCORS(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.json")
+	os.WriteFile(usersFile, []byte(`{"root": {"password": "secret", "admin": true}}`), 0600)
+	cfg := config.Default()
+	cfg.Schema = "../storage/anyschema.json"
+	cfg.Tokens = "../nametotoken.json"
+	cfg.Users = usersFile
+	cfg.TLS = config.TLS{Cert: "/etc/owldb/cert.pem", Key: "/etc/owldb/key.pem"}
+	cfg.CORS.Origins = []string{"https://app.example.com"}
+	opts, err := cfg.Options()
+	if err != nil {
+		t.Fatalf("Failed to build options: %v", err)
+	}
+	handler, err := NewWithOptions(opts)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	defer handler.Close()
+	helper := NewTestHelper(handler, t)
+
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/admin/config", nil, "token1"), http.StatusForbidden)
+	w := helper.Login(map[string]string{"username": "root", "password": "secret"})
+	var login map[string]string
+	helper.DecodeResponseBody(w, &login)
+	w = helper.MakeRequest("GET", "http://localhost:3318/admin/config", nil, login["token"])
+	helper.AssertStatusCode(w, http.StatusOK)
+	var shown config.Config
+	helper.DecodeResponseBody(w, &shown)
+	if shown.Port != 3318 || shown.Users != usersFile || shown.TLS.Cert != "/etc/owldb/cert.pem" {
+		t.Errorf("Unexpected effective config: %+v", shown)
+	}
+	if shown.TLS.Key != "[redacted]" || strings.Contains(w.Body.String(), "key.pem") {
+		t.Errorf("Expected the TLS key to be redacted, got %s", w.Body.String())
+	}
+
+	request := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", "http://localhost:3318/v1/db", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	if allowed := request("https://app.example.com").Header().Get("Access-Control-Allow-Origin"); allowed != "https://app.example.com" {
+		t.Errorf("Expected configured origin to be allowed, got %q", allowed)
+	}
+	if allowed := request("https://evil.example.com").Header().Get("Access-Control-Allow-Origin"); allowed != "" {
+		t.Errorf("Expected other origins not to be allowed, got %q", allowed)
+	}
+}
+
+// Test_Reload tests that the schema and token files are reloaded together
+// without dropping subscribers, and that a bad file leaves both unchanged
+func Test_Reload(t *testing.T) {
+	dir := t.TempDir()
+	schemaFile := filepath.Join(dir, "schema.json")
+	tokenFile := filepath.Join(dir, "tokens.json")
+	usersFile := filepath.Join(dir, "users.json")
+	os.WriteFile(schemaFile, []byte(`{}`), 0600)
+	os.WriteFile(tokenFile, []byte(`{"Brad": "token1"}`), 0600)
+	os.WriteFile(usersFile, []byte(`{"root": {"password": "secret", "admin": true}}`), 0600)
+	handler, err := NewWithOptions(handlers.Options{SchemaFile: schemaFile, TokenFile: tokenFile, UsersFile: usersFile})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	defer handler.Close()
+	helper := NewTestHelper(handler, t)
+
+	var login map[string]string
+	helper.DecodeResponseBody(helper.Login(map[string]string{"username": "root", "password": "secret"}), &login)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, "token1"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("POST", "http://localhost:3318/admin/reload", nil, "token1"), http.StatusForbidden)
+
+	// The subscription stays open across the reload and sees later writes
+	os.WriteFile(schemaFile, []byte(`{"type": "object", "required": ["name"]}`), 0600)
+	os.WriteFile(tokenFile, []byte(`{"Brad": "token1", "Ann": "token2"}`), 0600)
+	stream := helper.Subscribe("http://localhost:3318/v1/db/?mode=subscribe", "token1", func() {
+		w := helper.MakeRequest("POST", "http://localhost:3318/admin/reload", nil, login["token"])
+		helper.AssertStatusCode(w, http.StatusOK)
+		if !strings.Contains(w.Body.String(), `"tokens":2`) {
+			t.Errorf("Expected 2 tokens loaded, got %s", w.Body.String())
+		}
+		helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/doc", strings.NewReader(`{"name": "a"}`), "token2"), 201)
+	})
+	if !strings.Contains(stream.Body.String(), "event: update") {
+		t.Errorf("Expected the subscriber to see writes after the reload, got %s", stream.Body.String())
+	}
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/other", strings.NewReader(`{"a": 1}`), "token1"), 400)
+
+	// Neither file is replaced if one of them is invalid
+	os.WriteFile(schemaFile, []byte(`{}`), 0600)
+	os.WriteFile(tokenFile, []byte(`not json`), 0600)
+	w := helper.MakeRequest("POST", "http://localhost:3318/admin/reload", nil, login["token"])
+	helper.AssertStatusCode(w, http.StatusInternalServerError)
+	if !strings.Contains(w.Body.String(), "token file") {
+		t.Errorf("Expected the error to name the token file, got %s", w.Body.String())
+	}
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/other", strings.NewReader(`{"a": 1}`), "token2"), 400)
+
+	os.WriteFile(tokenFile, []byte(`{"Brad": "token1"}`), 0600)
+	if err := handler.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/other", strings.NewReader(`{"a": 1}`), "token1"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/other", nil, "token2"), http.StatusUnauthorized)
+}
+
+func Test_ClientCertAuth(t *testing.T) {
+	handler, err := NewWithOptions(handlers.Options{
+		SchemaFile:      "../storage/anyschema.json",
+		TokenFile:       "../nametotoken.json",
+		ClientCertAuth:  true,
+		ClientCertUsers: map[string]string{"CN=ci-runner,O=Example": "ci", "Ann": "Ann"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	defer handler.Close()
+	helper := NewTestHelper(handler, t)
+
+	// request sends a request over a connection with a verified client certificate
+	request := func(method string, url string, body string, subject pkix.Name) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		cert := &x509.Certificate{Raw: []byte(subject.String()), Subject: subject, NotAfter: time.Now().Add(time.Hour)}
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	runner := pkix.Name{CommonName: "ci-runner", Organization: []string{"Example"}}
+
+	helper.AssertStatusCode(request("PUT", "http://localhost:3318/v1/db", "", runner), 201)
+	helper.AssertStatusCode(request("PUT", "http://localhost:3318/v1/db/doc", `{"a": 1}`, runner), 201)
+	w := request("GET", "http://localhost:3318/v1/db/doc", "", pkix.Name{CommonName: "Ann"})
+	helper.AssertStatusCode(w, 200)
+	if !strings.Contains(w.Body.String(), `"createdBy":"ci"`) {
+		t.Errorf("Expected the document to be created by the mapped user, got %s", w.Body.String())
+	}
+	helper.AssertStatusCode(request("GET", "http://localhost:3318/v1/db/doc", "", pkix.Name{CommonName: "Mallory"}), http.StatusUnauthorized)
+
+	// A bearer token takes precedence over the certificate
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/doc", nil, "token1"), 200)
+}
+
+// Test_GracefulShutdown tests that draining ends open subscriptions with a
+// shutdown event, so the HTTP server shuts down without waiting out its
+// timeout, and that writes are refused while reads are still served
+func Test_GracefulShutdown(t *testing.T) {
+	handler, err := New("../storage/anyschema.json", "../nametotoken.json")
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	defer handler.Close()
+	helper := NewTestHelper(handler, t)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db", nil, "token1"), 201)
+	helper.AssertStatusCode(helper.MakeRequest("PUT", "http://localhost:3318/v1/db/doc", strings.NewReader(`{"a": 1}`), "token1"), 201)
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL+"/v1/db/?mode=subscribe", nil)
+	req.Header.Set("Authorization", "Bearer token1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+
+	handler.Drain()
+	stream := make(chan string)
+	go func() {
+		body, _ := io.ReadAll(resp.Body)
+		stream <- string(body)
+	}()
+	select {
+	case body := <-stream:
+		if !strings.Contains(body, "event: update") || !strings.Contains(body, "event: shutdown\ndata: {\"message\":\"server is shutting down\",\"retryAfter\":5}\nretry: 5000\n") {
+			t.Errorf("Expected the snapshot then a shutdown event, got %q", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the subscription to end when draining")
+	}
+
+	w := helper.MakeRequest("PUT", "http://localhost:3318/v1/db/doc", strings.NewReader(`{"a": 2}`), "token1")
+	helper.AssertStatusCode(w, http.StatusServiceUnavailable)
+	if w.Header().Get("Retry-After") != "5" {
+		t.Errorf("Expected a Retry-After header, got %q", w.Header().Get("Retry-After"))
+	}
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/doc", nil, "token1"), 200)
+	helper.AssertStatusCode(helper.MakeRequest("GET", "http://localhost:3318/v1/db/?mode=subscribe", nil, "token1"), http.StatusServiceUnavailable)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Config.Shutdown(ctx); err != nil {
+		t.Errorf("Expected shutdown to finish before the timeout, got %v", err)
+	}
+}
@@ -6,8 +6,40 @@ import (
 	"github.com/RICE-COMP318-FALL24/owldb-p1group35/handlers"
 )
 
-func New(schemaFile string, tokenFile string) (http.Handler, error) {
-	owldb, err := handlers.New(schemaFile, tokenFile)
+// Server routes requests to the OwlDB handlers and controls their lifecycle
+type Server struct {
+	http.Handler
+	startDraining func()
+	reload        func() (int, error)
+	close         func()
+}
+
+// Drain prepares for shutdown: the readiness probe fails so no new traffic
+// is sent, writes and new subscriptions are refused with 503, and open
+// subscriptions end with a shutdown event so the HTTP server can finish
+func (s *Server) Drain() {
+	s.startDraining()
+}
+
+// Reload recompiles the schema and rereads the token file, keeping the
+// running ones if either fails to load
+func (s *Server) Reload() error {
+	_, err := s.reload()
+	return err
+}
+
+// Close stops background work, closes WebSocket sessions and saves state
+// before closing open files
+func (s *Server) Close() {
+	s.close()
+}
+
+func New(schemaFile string, tokenFile string) (*Server, error) {
+	return NewWithOptions(handlers.Options{SchemaFile: schemaFile, TokenFile: tokenFile})
+}
+
+func NewWithOptions(opts handlers.Options) (*Server, error) {
+	owldb, err := handlers.NewWithOptions(opts)
 
 	if err != nil {
 		return nil, err
@@ -17,7 +49,31 @@ func New(schemaFile string, tokenFile string) (http.Handler, error) {
 
 	// Separate handlers for auth vs. data requests
 	mux.HandleFunc("/auth", owldb.HandleAuth)
+	mux.HandleFunc("/auth/refresh", owldb.HandleRefresh)
 	mux.HandleFunc("/v1/", owldb.HandleStorage)
+	// Only reads of _info are the info endpoint; creating a database of that
+	// name is refused by storage
+	mux.HandleFunc("GET /v1/_info", owldb.HandleInfo)
+	mux.HandleFunc("OPTIONS /v1/_info", owldb.HandleInfo)
+	mux.HandleFunc("/ws", owldb.HandleWebSocket)
+	mux.HandleFunc("/admin/users", owldb.HandleAdminUsers)
+	mux.HandleFunc("/admin/users/", owldb.HandleAdminUsers)
+	mux.HandleFunc("/admin/sessions", owldb.HandleAdminSessions)
+	mux.HandleFunc("/admin/sessions/", owldb.HandleAdminSessions)
+	mux.HandleFunc("/admin/tokens", owldb.HandleAdminTokens)
+	mux.HandleFunc("/admin/tokens/", owldb.HandleAdminTokens)
+	mux.HandleFunc("/admin/ratelimits", owldb.HandleAdminRateLimits)
+	mux.HandleFunc("/admin/limits", owldb.HandleAdminLimits)
+	mux.HandleFunc("/admin/config", owldb.HandleAdminConfig)
+	mux.HandleFunc("/admin/reload", owldb.HandleAdminReload)
+	mux.HandleFunc("/metrics", owldb.HandleMetrics)
+
+	// Probes for the orchestrator
+	mux.HandleFunc("/healthz", owldb.HandleHealth)
+	mux.HandleFunc("/readyz", owldb.HandleReady)
 
-	return mux, nil
+	// Every request gets an ID that ties its log messages together, and
+	// a line in the access log once it completes
+	handler := handlers.WithRequestID(handlers.WithAccessLog(mux, opts.AccessLog, opts.AccessLogFormat))
+	return &Server{Handler: handler, startDraining: owldb.StartDraining, reload: owldb.Reload, close: owldb.Close}, nil
 }
@@ -0,0 +1,172 @@
+// Package ratelimit implements token bucket rate limiting with one bucket per
+// key, such as a username or client address.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a sustained rate of requests per second and the burst allowed on
+// top of it. A zero Rate means unlimited.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// ParseLimit converts a limit written as "<rate>" or "<rate>:<burst>", in
+// requests per second, to a Limit. The burst defaults to the rate rounded up.
+// An empty string or "0" means unlimited.
+// Input: Limit (string)
+// Output: Limit, error if malformed
+func ParseLimit(limit string) (Limit, error) {
+	if limit == "" {
+		return Limit{}, nil
+	}
+	rateText, burstText, hasBurst := strings.Cut(limit, ":")
+	rate, err := strconv.ParseFloat(rateText, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return Limit{}, fmt.Errorf("invalid rate limit %q", limit)
+	}
+	burst := int(math.Ceil(rate))
+	if hasBurst {
+		burst, err = strconv.Atoi(burstText)
+		if err != nil || burst < 1 {
+			return Limit{}, fmt.Errorf("invalid rate limit %q", limit)
+		}
+	}
+	if rate > 0 && burst < 1 {
+		burst = 1
+	}
+	return Limit{Rate: rate, Burst: burst}, nil
+}
+
+// Unlimited reports whether the limit allows every request
+// Input: None
+// Output: Boolean
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+// String returns the limit in the form accepted by ParseLimit
+// Input: None
+// Output: Limit (string)
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "0"
+	}
+	return strconv.FormatFloat(l.Rate, 'f', -1, 64) + ":" + strconv.Itoa(l.Burst)
+}
+
+// bucket holds the tokens available to one key
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// BucketState describes one key's bucket.
+type BucketState struct {
+	Key    string  `json:"key"`
+	Tokens float64 `json:"tokens"`
+}
+
+// Limiter applies one Limit to many keys.
+type Limiter struct {
+	mu      sync.Mutex
+	limit   Limit
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+// New creates a limiter applying the given limit to each key
+// Input: Limit
+// Output: Pointer to Limiter
+func New(limit Limit) *Limiter {
+	return &Limiter{limit: limit, buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Limit returns the limit applied to each key
+// Input: None
+// Output: Limit
+func (l *Limiter) Limit() Limit {
+	return l.limit
+}
+
+// refill adds the tokens earned since the bucket was last used. Must be
+// called with l.mu held.
+// Input: Bucket, Current time (time.Time)
+// Output: None
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = min(float64(l.limit.Burst), b.tokens+elapsed*l.limit.Rate)
+	b.last = now
+}
+
+// Allow takes a token from the key's bucket if one is available
+// Input: Key (string)
+// Output: Boolean indicating if the request may proceed, and how long to wait otherwise
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.limit.Unlimited() {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// State describes every bucket, sorted by key
+// Input: None
+// Output: Slice of BucketState
+func (l *Limiter) State() []BucketState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	states := make([]BucketState, 0, len(l.buckets))
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		states = append(states, BucketState{Key: key, Tokens: math.Floor(b.tokens*100) / 100})
+	}
+	slices.SortFunc(states, func(a, b BucketState) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return states
+}
+
+// Prune forgets buckets that have refilled completely, which behave the
+// same as new ones
+// Input: None
+// Output: Number of buckets removed (int)
+func (l *Limiter) Prune() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	removed := 0
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock returns a limiter whose time only moves when advance is called
+func fakeClock(limit Limit) (*Limiter, func(time.Duration)) {
+	now := time.Unix(0, 0)
+	l := New(limit)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestAllow_Burst(t *testing.T) {
+	l, advance := fakeClock(Limit{Rate: 2, Burst: 3})
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("alice"); !ok {
+			t.Fatalf("Expected request %d within the burst to be allowed", i)
+		}
+	}
+	ok, wait := l.Allow("alice")
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, got %v %v", ok, wait)
+	}
+
+	// Other keys have their own bucket
+	if ok, _ := l.Allow("bob"); !ok {
+		t.Errorf("Expected bob to be allowed")
+	}
+
+	advance(500 * time.Millisecond)
+	if ok, _ := l.Allow("alice"); !ok {
+		t.Errorf("Expected a token after waiting")
+	}
+}
+
+func TestAllow_Unlimited(t *testing.T) {
+	l := New(Limit{})
+	for i := 0; i < 1000; i++ {
+		if ok, _ := l.Allow("alice"); !ok {
+			t.Fatal("Expected unlimited limiter to allow every request")
+		}
+	}
+}
+
+func TestStateAndPrune(t *testing.T) {
+	l, advance := fakeClock(Limit{Rate: 1, Burst: 2})
+	l.Allow("alice")
+	l.Allow("bob")
+	l.Allow("bob")
+
+	state := l.State()
+	if len(state) != 2 || state[0].Key != "alice" || state[0].Tokens != 1 || state[1].Tokens != 0 {
+		t.Errorf("Unexpected state %v", state)
+	}
+
+	advance(time.Second)
+	if removed := l.Prune(); removed != 1 {
+		t.Errorf("Expected only alice's full bucket to be pruned, removed %d", removed)
+	}
+	advance(time.Second)
+	if removed := l.Prune(); removed != 1 || len(l.State()) != 0 {
+		t.Errorf("Expected bob's bucket to be pruned once full")
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	cases := map[string]Limit{
+		"":     {},
+		"0":    {Rate: 0, Burst: 0},
+		"5":    {Rate: 5, Burst: 5},
+		"0.5":  {Rate: 0.5, Burst: 1},
+		"10:2": {Rate: 10, Burst: 2},
+	}
+	for text, expected := range cases {
+		limit, err := ParseLimit(text)
+		if err != nil || limit != expected {
+			t.Errorf("ParseLimit(%q) = %v, %v; expected %v", text, limit, err, expected)
+		}
+	}
+	for _, text := range []string{"fast", "-1", "5:0", "5:x"} {
+		if _, err := ParseLimit(text); err == nil {
+			t.Errorf("Expected ParseLimit(%q) to fail", text)
+		}
+	}
+}
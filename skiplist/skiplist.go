@@ -52,6 +52,9 @@ func NewSkipList[K cmp.Ordered, V any](maxLevel int, minKey K, maxKey K) *SkipLi
 // UpdateCheck defines a function signature for checking and updating values in the skip list.
 type UpdateCheck[K cmp.Ordered, V any] func(key K, currentValue *V, exists bool) (newValue *V, err error)
 
+// DeleteCheck defines a function signature for deciding whether a value may be deleted.
+type DeleteCheck[K cmp.Ordered, V any] func(key K, currentValue *V) error
+
 // CopyFunc defines a function signature for creating a deep copy of a value.
 type CopyFunc[K cmp.Ordered, V any] func(currentValue *V) (deepCopy *V, err error)
 
@@ -95,6 +98,14 @@ func (skipList *SkipList[K, V]) GetCopy(key K, copyFunction CopyFunc[K, V]) (dee
 // Input: Key (K), Update check function (UpdateCheck)
 // Output: Boolean indicating if updated (updated), error if any
 func (skipList *SkipList[K, V]) Upsert(key K, check UpdateCheck[K, V]) (updated bool, err error) {
+	return skipList.UpsertWithLogger(key, check, slog.Default())
+}
+
+// UpsertWithLogger is Upsert, logging its progress to the given logger so the
+// messages can be tied to the request that caused them.
+// Input: Key (K), Update check function (UpdateCheck), Logger (*slog.Logger)
+// Output: Boolean indicating if updated (updated), error if any
+func (skipList *SkipList[K, V]) UpsertWithLogger(key K, check UpdateCheck[K, V], logger *slog.Logger) (updated bool, err error) {
 	for {
 		if key <= skipList.minKey || key >= skipList.maxKey {
 			return false, fmt.Errorf("invalid key")
@@ -142,10 +153,10 @@ func (skipList *SkipList[K, V]) Upsert(key K, check UpdateCheck[K, V]) (updated
 			level++
 		}
 
-		slog.Info("Locked all predecessors")
+		logger.Debug("Locked all predecessors")
 
 		if !valid {
-			slog.Info("Another node locked predecessors")
+			logger.Debug("Another node locked predecessors")
 			for predecessor := range uniquePredecessorsLocked {
 				predecessor.mu.Unlock()
 			}
@@ -158,7 +169,7 @@ func (skipList *SkipList[K, V]) Upsert(key K, check UpdateCheck[K, V]) (updated
 		// Execute the update check function
 		returnValue, err := check(key, nodeValue, exists)
 
-		slog.Info("Got past check")
+		logger.Debug("Got past check")
 
 		if err != nil {
 			for predecessor := range uniquePredecessorsLocked {
@@ -173,10 +184,10 @@ func (skipList *SkipList[K, V]) Upsert(key K, check UpdateCheck[K, V]) (updated
 		updated = true
 		if returnValue != nil {
 			updated = false
-			slog.Info("creating new node")
+			logger.Debug("creating new node")
 			newNode := InitializeNode(key, returnValue, topLevel)
 
-			slog.Info("inserting node")
+			logger.Debug("inserting node")
 			level := 0
 			for level <= newNode.maxLevel {
 				newNode.nextNodes[level].Store(successors[level].Load())
@@ -191,7 +202,7 @@ func (skipList *SkipList[K, V]) Upsert(key K, check UpdateCheck[K, V]) (updated
 
 			newNode.isFullyLinked.Store(true)
 		} else {
-			slog.Info("updated node")
+			logger.Debug("updated node")
 			nodeFound.mu.Unlock()
 		}
 
@@ -270,6 +281,14 @@ func (skipList *SkipList[K, V]) QueryCopies(startKey K, endKey K, copyFunction C
 // Input: Key (K)
 // Output: Boolean indicating if deleted (bool), error if any
 func (skipList *SkipList[K, V]) Delete(key K) (bool, error) {
+	return skipList.DeleteIf(key, nil)
+}
+
+// DeleteIf removes the node with the specified key if the check allows it. The
+// check runs while the node is locked, so no update can happen in between.
+// Input: Key (K), Delete check function (DeleteCheck), nil to always delete
+// Output: Boolean indicating if deleted (bool), error returned by the check
+func (skipList *SkipList[K, V]) DeleteIf(key K, check DeleteCheck[K, V]) (bool, error) {
 	for {
 		levelFound, predecessors, successors := skipList.find(key)
 		if levelFound == -1 {
@@ -287,6 +306,13 @@ func (skipList *SkipList[K, V]) Delete(key K) (bool, error) {
 			return false, nil
 		}
 
+		if check != nil {
+			if err := check(key, nodeToRemove.nodeValue.Load()); err != nil {
+				nodeToRemove.mu.Unlock()
+				return false, err
+			}
+		}
+
 		// Lock unique predecessors
 		uniquePredecessorsLocked := make(map[*SkipNode[K, V]]bool, len(predecessors))
 		valid := true
@@ -429,6 +455,22 @@ func (skipList *SkipList[K, V]) Find(key K) (*V, bool) {
 	return foundNode.nodeValue.Load(), foundNode.isFullyLinked.Load() && !foundNode.isMarked.Load() && foundNode.maxLevel == foundLevel
 }
 
+// Len counts the entries in the SkipList. Entries added or removed during
+// the count may or may not be included.
+// Input: None
+// Output: Number of entries (int)
+func (skipList *SkipList[K, V]) Len() int {
+	count := 0
+	current := skipList.head.nextNodes[0].Load()
+	for current != skipList.tail {
+		if current.isFullyLinked.Load() && !current.isMarked.Load() {
+			count++
+		}
+		current = current.nextNodes[0].Load()
+	}
+	return count
+}
+
 // Visualize prints the entire SkipList structure.
 // Input: None
 // Output: None
@@ -250,6 +250,48 @@ func Test_SimpleUpsertRemove(t *testing.T) {
 	}
 }
 
+func Test_DeleteIfRejected(t *testing.T) {
+	skiplist := NewSkipList[string, int](10, "", "\U0010FFFF")
+
+	num := 20
+	skiplist.Upsert("ge", NewNoOverwriteCheck(&num))
+
+	keepEven := func(key string, value *int) error {
+		if *value%2 == 0 {
+			return fmt.Errorf("even values are kept")
+		}
+		return nil
+	}
+	removed, err := skiplist.DeleteIf("ge", keepEven)
+	if removed || err == nil {
+		t.Error("Expected the check to prevent removal")
+	}
+	if _, found := skiplist.Find("ge"); !found {
+		t.Error("Element removed despite failed check")
+	}
+
+	removed, err = skiplist.DeleteIf("ge", func(key string, value *int) error { return nil })
+	if !removed || err != nil {
+		t.Errorf("Expected removal, got %v %v", removed, err)
+	}
+}
+
+func Test_Len(t *testing.T) {
+	skiplist := NewSkipList[string, int](10, "", "\U0010FFFF")
+	if skiplist.Len() != 0 {
+		t.Errorf("Expected empty list, got %d entries", skiplist.Len())
+	}
+
+	for i := range 10 {
+		num := i
+		skiplist.Upsert(fmt.Sprintf("key%d", i), NewNoOverwriteCheck(&num))
+	}
+	skiplist.Delete("key3")
+	if skiplist.Len() != 9 {
+		t.Errorf("Expected 9 entries, got %d", skiplist.Len())
+	}
+}
+
 func Test_QueryMultipleKeys(t *testing.T) {
 	// "\U0010FFFF" is the highest value unicode character
 	skiplist := NewSkipList[string, int](10, "", "\U0010FFFF")
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
@@ -13,6 +14,7 @@ import (
 type Collection struct {
 	Path      string
 	Name      string
+	CreatedBy string
 	Documents *skiplist.SkipList[string, Document]
 }
 
@@ -33,14 +35,14 @@ func (c *Collection) GetName() string {
 // get retrieves a document by its name from the database.
 // Input: Start key (string), End key (string)
 // Output: Slice of DocumentContent, error if any
-func (c *Collection) get(startKey string, endKey string) (content []DocumentContent, err error) {
+func (c *Collection) get(startKey string, endKey string, logger *slog.Logger) (content []DocumentContent, err error) {
 	if endKey == "" {
 		startKey = ""
 		endKey = "\U0010FFFF"
 	}
 	docCopies, err := c.Documents.QueryCopies(startKey, endKey, CopyDoc)
 	if err != nil {
-		slog.Error("Failed to retrieve documents in ", "collection", c.GetName(), "error", err)
+		logger.Error("Failed to retrieve documents in ", "collection", c.GetName(), "error", err)
 		return nil, err // Return error if content retrieval fails
 	}
 
@@ -48,15 +50,15 @@ func (c *Collection) get(startKey string, endKey string) (content []DocumentCont
 	// Iterate over all documents in the database
 	for _, doc := range docCopies {
 		// Get the content of each document
-		content, err := doc.get() // Calls Document's Get_Content
+		content, err := doc.get(logger) // Calls Document's Get_Content
 		if err != nil {
-			slog.Error("Failed to retrieve document content", "document", doc, "error", err)
+			logger.Error("Failed to retrieve document content", "document", doc, "error", err)
 			return nil, err // Return error if content retrieval fails
 		}
 		contents = append(contents, content)
 	}
 
-	slog.Info("Retrieved contents of all documents", "document_count", len(contents))
+	logger.Info("Retrieved contents of all documents", "document_count", len(contents))
 	return contents, nil
 }
 
@@ -66,11 +68,8 @@ func (c *Collection) get(startKey string, endKey string) (content []DocumentCont
 func (col *Collection) GetChild(docName string) (IChildNode, error) {
 	// Search for document by name
 	if document, exists := col.Documents.Find(docName); exists {
-		slog.Info("Document found", "document name", docName)
 		return document, nil
 	}
-	// If not found, log and print error message
-	slog.Warn("Document not found", "document name", docName)
 	return nil, fmt.Errorf("Document '%s' not found", docName)
 }
 
@@ -105,7 +104,7 @@ func (c *Collection) Handle(req RequestPack) (content any, stat status) {
 	case "PATCH":
 		return c.HandlePatch(req)
 	default:
-		slog.Warn("Invalid HTTP request method", "method", request)
+		req.GetLogger().Warn("Invalid HTTP request method", "method", request)
 		return nil, status{"Bad Request", fmt.Errorf("invalid HTTP request")}
 	}
 }
@@ -115,13 +114,17 @@ func (c *Collection) Handle(req RequestPack) (content any, stat status) {
 // Output: Status (status)
 func (c *Collection) HandleDelete(req RequestPack) (stat status) {
 	childName := req.GetPath()[len(req.GetPath())-1]
-	removed, _ := c.Documents.Delete(childName)
+	removed, err := c.Documents.DeleteIf(childName, DocDeleteCheck(req.GetUsername(), req.GetOwnerOnly()))
+	if errors.Is(err, ErrNotOwner) {
+		req.GetLogger().Warn("DELETE operation refused: not the document owner", "document_name", childName, "username", req.GetUsername())
+		return status{"Forbidden", err}
+	}
 
 	if !removed {
-		slog.Warn("DELETE operation failed: document not found", "document_name", childName)
-		return status{"Does Not Exist", fmt.Errorf("Document does not exist " + childName + " not found")}
+		req.GetLogger().Warn("DELETE operation failed: document not found", "document_name", childName)
+		return status{"Does Not Exist", fmt.Errorf("Document does not exist %s not found", childName)}
 	} else {
-		slog.Info("DELETE operation successful", "document_name", childName)
+		req.GetLogger().Info("DELETE operation successful", "document_name", childName)
 		return status{"Deleted", nil}
 	}
 }
@@ -136,10 +139,10 @@ func (c *Collection) HandleGet(req RequestPack) (content any, stat status) {
 		return nil, status{"Does Not Exist", err}
 	}
 
-	slog.Info("Document found", "document name", childName)
-	response, err := childCopy.get()
+	req.GetLogger().Info("Document found", "document name", childName)
+	response, err := childCopy.get(req.GetLogger())
 	if err != nil {
-		slog.Error("Internal error retrieving documents", "child_name", childName, "error", err)
+		req.GetLogger().Error("Internal error retrieving documents", "child_name", childName, "error", err)
 		return nil, status{"Internal Error", fmt.Errorf("internal error retrieving documents")}
 	}
 	return response, status{"Get", nil}
@@ -152,21 +155,23 @@ func (c *Collection) HandlePut(req RequestPack) (content any, stat status) {
 	childName := req.GetPath()[len(req.GetPath())-1]
 	path := "/v1/" + strings.Join(req.GetPath(), "/")
 
-	doc, err := NewDocument(path, req.GetContent(), req.GetUsername(), req.GetValidator())
+	doc, err := NewDocument(path, req.GetContent(), req.GetUsername(), req.GetValidator(), req.GetDocumentLimits())
 	if err != nil {
-		return nil, status{"Bad Request", err}
+		return nil, documentStatus(err)
 	}
 
 	var putCheck skiplist.UpdateCheck[string, Document]
 	if req.GetNoOverwrite() {
 		putCheck = DocCheckNoOverwrite(doc)
 	} else {
-		putCheck = DocCheckOverwrite(doc)
+		putCheck = DocCheckOverwrite(doc, req.GetOwnerOnly())
 	}
 
 	var updated bool
-	updated, err = c.Documents.Upsert(childName, putCheck)
-	if err != nil {
+	updated, err = c.Documents.UpsertWithLogger(childName, putCheck, req.GetLogger())
+	if errors.Is(err, ErrNotOwner) {
+		return nil, status{status_class: "Forbidden", err: err}
+	} else if err != nil {
 		if updated {
 			return nil, status{status_class: "Document not overwritten", err: err}
 		} else {
@@ -180,10 +185,10 @@ func (c *Collection) HandlePut(req RequestPack) (content any, stat status) {
 
 	var statusInfo status
 	if updated {
-		slog.Info("PUT operation successful: document overwritten", "document_name", childName, "path", path)
+		req.GetLogger().Info("PUT operation successful: document overwritten", "document_name", childName, "path", path)
 		statusInfo = status{"Overwritten", nil}
 	} else {
-		slog.Info("PUT operation successful: new document created", "document_name", childName, "path", path)
+		req.GetLogger().Info("PUT operation successful: new document created", "document_name", childName, "path", path)
 		statusInfo = status{"Created", nil}
 	}
 
@@ -207,14 +212,14 @@ func (c *Collection) HandlePost(req RequestPack) (content any, stat status) {
 	newDocName := c.generateRandomDocName()
 	// Create the new document with the generated name
 	path := "/v1/" + c.GetName() + "/" + newDocName
-	doc, err := NewDocument(path, req.GetContent(), req.GetUsername(), req.GetValidator())
+	doc, err := NewDocument(path, req.GetContent(), req.GetUsername(), req.GetValidator(), req.GetDocumentLimits())
 	if err != nil {
-		slog.Error("POST operation failed: error creating new document", "error", err)
-		return nil, status{"Bad Request", err}
+		req.GetLogger().Error("POST operation failed: error creating new document", "error", err)
+		return nil, documentStatus(err)
 	}
 	putCheckNoOverwrite := DocCheckNoOverwrite(doc)
 
-	_, err = c.Documents.Upsert(newDocName, putCheckNoOverwrite)
+	_, err = c.Documents.UpsertWithLogger(newDocName, putCheckNoOverwrite, req.GetLogger())
 
 	// Keep trying to insert with new doc name until doc name is unique
 	for err != nil {
@@ -222,21 +227,21 @@ func (c *Collection) HandlePost(req RequestPack) (content any, stat status) {
 		newDocName = c.generateRandomDocName()
 		// Create the new document with the generated name
 		path = "/v1/" + c.GetName() + "/" + newDocName
-		doc, err = NewDocument(path, req.GetContent(), req.GetUsername(), req.GetValidator())
+		doc, err = NewDocument(path, req.GetContent(), req.GetUsername(), req.GetValidator(), req.GetDocumentLimits())
 		if err != nil {
-			slog.Error("POST operation failed: error creating new document", "error", err)
-			return nil, status{"Bad Request", err}
+			req.GetLogger().Error("POST operation failed: error creating new document", "error", err)
+			return nil, documentStatus(err)
 		}
 		putCheckNoOverwrite = DocCheckNoOverwrite(doc)
 
-		_, err = c.Documents.Upsert(newDocName, putCheckNoOverwrite)
+		_, err = c.Documents.UpsertWithLogger(newDocName, putCheckNoOverwrite, req.GetLogger())
 
 		if err != nil {
 			return nil, status{"Bad Request", err}
 		}
 	}
 
-	slog.Info("POST operation successful: new document created", "document_name", newDocName, "path", path)
+	req.GetLogger().Info("POST operation successful: new document created", "document_name", newDocName, "path", path)
 
 	// Prepare response indicating the new document's path
 	response := PutResponse{Path: path}
@@ -248,9 +253,15 @@ func (c *Collection) HandlePost(req RequestPack) (content any, stat status) {
 // Output: Content (any), Status (status)
 func (c *Collection) HandlePatch(req RequestPack) (content any, stat status) {
 	childName := req.GetPath()[len(req.GetPath())-1]
-	patchCheck := DocPatchCheck(req.GetContent(), req.GetValidator(), req.GetUsername())
-
-	_, err := c.Documents.Upsert(childName, patchCheck)
+	var version uint64
+	patchCheck := DocPatchCheck(req.GetContent(), req.GetValidator(), req.GetUsername(), &version, req.GetOwnerOnly(), req.GetDocumentLimits())
+
+	_, err := c.Documents.UpsertWithLogger(childName, patchCheck, req.GetLogger())
+	if errors.Is(err, ErrNotOwner) {
+		return nil, status{"Forbidden", err}
+	} else if errors.Is(err, ErrDocumentTooLarge) || errors.Is(err, ErrDocumentTooDeep) {
+		return nil, documentStatus(err)
+	}
 
 	response := PatchResponse{
 		Uri: "/v1/" + strings.Join(req.GetPath(), "/"),
@@ -262,6 +273,7 @@ func (c *Collection) HandlePatch(req RequestPack) (content any, stat status) {
 	} else {
 		response.PatchFailed = false
 		response.Message = "patches applied"
+		response.Version = version
 	}
 
 	return response, status{"Patched", nil}
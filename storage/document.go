@@ -2,6 +2,7 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
@@ -25,6 +26,7 @@ type Metadata struct {
 	CreatedAt      int64  `json:"createdAt"`
 	LastModifiedBy string `json:"lastModifiedBy"`
 	LastModifiedAt int64  `json:"lastModifiedAt"`
+	Version        uint64 `json:"version"`
 }
 
 type DocumentContent struct {
@@ -49,14 +51,14 @@ func (doc *Document) GetPath() string {
 // get retrieves the document content and metadata.
 // Input: None
 // Output: DocumentContent, error if any
-func (doc *Document) get() (DocumentContent, error) {
+func (doc *Document) get(logger *slog.Logger) (DocumentContent, error) {
 	// Create copy of the content and the metadata
 	contentCopy := make([]byte, len(doc.Contents))
 	copy(contentCopy, doc.Contents)
 
 	var contentJson map[string]interface{}
 	if err := json.Unmarshal(contentCopy, &contentJson); err != nil {
-		slog.Error("Failed to unmarshal document content", "path", doc.Path, "error", err)
+		logger.Error("Failed to unmarshal document content", "path", doc.Path, "error", err)
 		return DocumentContent{}, err
 	}
 
@@ -66,6 +68,7 @@ func (doc *Document) get() (DocumentContent, error) {
 		CreatedAt:      metadataCopy.CreatedAt,
 		LastModifiedBy: metadataCopy.LastModifiedBy,
 		LastModifiedAt: metadataCopy.LastModifiedAt,
+		Version:        metadataCopy.Version,
 	}
 
 	docJSON := DocumentContent{
@@ -82,11 +85,8 @@ func (doc *Document) get() (DocumentContent, error) {
 func (doc *Document) GetChild(colName string) (IChildNode, error) {
 	// Search for collection by name
 	if collection, exists := doc.Collections.Find(colName); exists {
-		slog.Info("Collection found", "collection name", colName)
 		return collection, nil
 	}
-	// If not found, log and print error message
-	slog.Warn("Collection not found", "collection name", colName)
 	return nil, fmt.Errorf("Collection '%s' not found", colName)
 }
 
@@ -107,9 +107,13 @@ func CopyDoc(doc *Document) (*Document, error) {
 }
 
 // NewDocument creates a new document, validates its contents, and returns the document.
-// Input: Path (string), Content ([]byte), CreatedBy (string), Validator (jsondata.Validator)
+// Input: Path (string), Content ([]byte), CreatedBy (string), Validator (jsondata.Validator), Limits (DocumentLimits)
 // Output: New Document (*Document), error if any
-func NewDocument(path string, content []byte, createdBy string, validator jsondata.Validator) (*Document, error) {
+func NewDocument(path string, content []byte, createdBy string, validator jsondata.Validator, limits DocumentLimits) (*Document, error) {
+	if err := limits.Check(content); err != nil {
+		return nil, err
+	}
+
 	// Validate the contents against the schema.
 	slog.Debug("Inside NewDoc:", "body", content)
 	var rawContent any
@@ -130,6 +134,7 @@ func NewDocument(path string, content []byte, createdBy string, validator jsonda
 		CreatedAt:      now,
 		LastModifiedBy: createdBy,
 		LastModifiedAt: now,
+		Version:        1,
 	}
 
 	// Create the document with path support.
@@ -143,12 +148,13 @@ func NewDocument(path string, content []byte, createdBy string, validator jsonda
 	return doc, nil
 }
 
-// Update updates the metadata of a document.
+// Update updates the metadata of a document and advances its version.
 // Input: ModifiedBy (string)
 // Output: None
 func (metadata *Metadata) Update(modifiedBy string) {
 	metadata.LastModifiedBy = modifiedBy
 	metadata.LastModifiedAt = time.Now().UnixMilli()
+	metadata.Version++
 }
 
 // DocCheckNoOverwrite checks if a document exists, and if not, returns the new document to be inserted.
@@ -165,16 +171,32 @@ func DocCheckNoOverwrite(newDoc *Document) skiplist.UpdateCheck[string, Document
 	return check
 }
 
+// ErrNotOwner is returned when the owner-only policy stops a user from changing
+// a document they did not create.
+var ErrNotOwner = errors.New("only the document creator may change this document")
+
+// checkOwner enforces the owner-only policy on an existing document
+// Input: Existing document (*Document), Username (string), Owner-only flag (bool)
+// Output: ErrNotOwner if the policy applies and the user is not the creator
+func checkOwner(currValue *Document, username string, ownerOnly bool) error {
+	if ownerOnly && currValue.Metadata.CreatedBy != username {
+		return ErrNotOwner
+	}
+	return nil
+}
+
 // DocCheckOverwrite checks if a document exists, and if it does, overwrites it.
-// Input: New document (*Document)
+// With ownerOnly set only the document's creator may overwrite it.
+// Input: New document (*Document), Owner-only flag (bool)
 // Output: Update check function (UpdateCheck)
-func DocCheckOverwrite(newDoc *Document) skiplist.UpdateCheck[string, Document] {
+func DocCheckOverwrite(newDoc *Document, ownerOnly bool) skiplist.UpdateCheck[string, Document] {
 	check := func(key string, currValue *Document, exists bool) (*Document, error) {
 		if exists {
-			currTime := time.Now()
-			currValue.Metadata.LastModifiedAt = currTime.UnixMilli()
+			if err := checkOwner(currValue, newDoc.Metadata.CreatedBy, ownerOnly); err != nil {
+				return nil, err
+			}
 			currValue.Contents = newDoc.Contents
-			currValue.Metadata.LastModifiedBy = newDoc.Metadata.CreatedBy
+			currValue.Metadata.Update(newDoc.Metadata.CreatedBy)
 			return nil, nil
 		} else {
 			return newDoc, nil
@@ -183,16 +205,22 @@ func DocCheckOverwrite(newDoc *Document) skiplist.UpdateCheck[string, Document]
 	return check
 }
 
-// DocPatchCheck validates and applies patch operations to a document.
-// Input: Content ([]byte), Validator (jsondata.Validator), Name (string)
+// DocPatchCheck validates and applies patch operations to a document, storing
+// the version the patches produced in version. With ownerOnly set only the
+// document's creator may patch it.
+// Input: Content ([]byte), Validator (jsondata.Validator), Name (string), Version (*uint64), Owner-only flag (bool)
 // Output: Update check function (UpdateCheck)
-func DocPatchCheck(content []byte, validator jsondata.Validator, name string) skiplist.UpdateCheck[string, Document] {
+func DocPatchCheck(content []byte, validator jsondata.Validator, name string, version *uint64, ownerOnly bool, limits DocumentLimits) skiplist.UpdateCheck[string, Document] {
 	check := func(key string, currValue *Document, exists bool) (*Document, error) {
 		if exists {
-			err := currValue.PatchRequest(content, validator, name)
+			if err := checkOwner(currValue, name, ownerOnly); err != nil {
+				return nil, err
+			}
+			err := currValue.PatchRequest(content, validator, name, limits)
 			if err != nil {
 				return nil, err
 			}
+			*version = currValue.Metadata.Version
 			return nil, nil
 		} else {
 			return nil, fmt.Errorf("object does not exist at this path")
@@ -201,6 +229,16 @@ func DocPatchCheck(content []byte, validator jsondata.Validator, name string) sk
 	return check
 }
 
+// DocDeleteCheck enforces the owner-only policy when deleting a document
+// Input: Username (string), Owner-only flag (bool)
+// Output: Delete check function (DeleteCheck)
+func DocDeleteCheck(username string, ownerOnly bool) skiplist.DeleteCheck[string, Document] {
+	check := func(key string, currValue *Document) error {
+		return checkOwner(currValue, username, ownerOnly)
+	}
+	return check
+}
+
 // Handle processes an HTTP request for the document.
 // Input: RequestPack (req)
 // Output: Content (any), Status (status)
@@ -214,7 +252,7 @@ func (doc *Document) Handle(req RequestPack) (content any, stat status) {
 	case "DELETE":
 		return doc.HandleDelete(req)
 	default:
-		slog.Warn("Invalid HTTP request method", "method", request)
+		req.GetLogger().Warn("Invalid HTTP request method", "method", request)
 		return nil, status{"Bad Request", fmt.Errorf("invalid HTTP request")}
 	}
 }
@@ -226,13 +264,13 @@ func (doc *Document) HandleGet(req RequestPack) (content any, stat status) {
 	childName := req.GetPath()[len(req.GetPath())-1]
 	col, exists := doc.Collections.Find(childName)
 	if !exists {
-		slog.Info("Collection %s does not exist", "collection_name", childName)
-		return nil, status{"Does Not Exist", fmt.Errorf("Collection does not exist " + childName + ": not found")}
+		req.GetLogger().Info("Collection %s does not exist", "collection_name", childName)
+		return nil, status{"Does Not Exist", fmt.Errorf("Collection does not exist %s: not found", childName)}
 	}
-	slog.Info("Collection found", "collection name", childName)
-	response, err := col.get(req.GetStartKey(), req.GetEndKey())
+	req.GetLogger().Info("Collection found", "collection name", childName)
+	response, err := col.get(req.GetStartKey(), req.GetEndKey(), req.GetLogger())
 	if err != nil {
-		slog.Error("Internal error retrieving documents", "child_name", childName, "error", err)
+		req.GetLogger().Error("Internal error retrieving documents", "child_name", childName, "error", err)
 		return nil, status{"Internal Error", fmt.Errorf("internal error retrieving documents")}
 	}
 	return response, status{"Get", nil}
@@ -243,14 +281,14 @@ func (doc *Document) HandleGet(req RequestPack) (content any, stat status) {
 // Output: Content (any), Status (status)
 func (doc *Document) HandleDelete(req RequestPack) (content any, stat status) {
 	childName := req.GetPath()[len(req.GetPath())-1]
-	slog.Info("Attempting to delete collection", "childname", childName)
+	req.GetLogger().Info("Attempting to delete collection", "childname", childName)
 	_, err := doc.Collections.Delete(childName)
 
 	if err != nil {
-		slog.Warn("DELETE operation failed: collection not found", "collection_name", childName)
-		return nil, status{"Does Not Exist", fmt.Errorf("Collection does not exist " + childName + ": not found")}
+		req.GetLogger().Warn("DELETE operation failed: collection not found", "collection_name", childName)
+		return nil, status{"Does Not Exist", fmt.Errorf("Collection does not exist %s: not found", childName)}
 	}
-	slog.Info("DELETE operation successful", "collection_name", childName)
+	req.GetLogger().Info("DELETE operation successful", "collection_name", childName)
 	return nil, status{"Deleted", nil}
 }
 
@@ -260,27 +298,28 @@ func (doc *Document) HandleDelete(req RequestPack) (content any, stat status) {
 func (doc *Document) HandlePut(req RequestPack) (content any, stat status) {
 	childName := req.GetPath()[len(req.GetPath())-1]
 	path := "/v1/" + strings.Join(req.GetPath(), "/")
-	newCollection := Collection{Documents: skiplist.NewSkipList[string, Document](10, "", "\U0010FFFF"), Path: path, Name: childName}
+	newCollection := Collection{Documents: skiplist.NewSkipList[string, Document](10, "", "\U0010FFFF"), Path: path, Name: childName, CreatedBy: req.GetUsername()}
 	putCheckNoOverwrite := CollectionCheckNoOverwrite(&newCollection)
-	_, err := doc.Collections.Upsert(childName, putCheckNoOverwrite)
+	_, err := doc.Collections.UpsertWithLogger(childName, putCheckNoOverwrite, req.GetLogger())
 
 	if err != nil {
-		slog.Warn("Collection already exists", "child_name", childName)
-		return nil, status{"Bad Request", fmt.Errorf("Collection already exists " + childName + ": exists")}
+		req.GetLogger().Warn("Collection already exists", "child_name", childName)
+		return nil, status{"Bad Request", fmt.Errorf("Collection already exists %s: exists", childName)}
 	}
 
 	response := PutResponse{
 		Path: path,
 	}
 
-	slog.Info("PUT operation successful", "child_name", childName, "path", path)
+	req.GetLogger().Info("PUT operation successful", "child_name", childName, "path", path)
 	return response, status{"Created", nil}
 }
 
 // PatchRequest applies a set of patch operations to the document's content and updates its metadata.
-// Input: New content ([]byte), JSON validator (jsonValidator), Author name (string)
+// The patched document must stay within the limits.
+// Input: New content ([]byte), JSON validator (jsonValidator), Author name (string), Limits (DocumentLimits)
 // Output: Error if any
-func (doc *Document) PatchRequest(newContent []byte, jsonValidator jsondata.Validator, authorName string) error {
+func (doc *Document) PatchRequest(newContent []byte, jsonValidator jsondata.Validator, authorName string, limits DocumentLimits) error {
 	// Step 1: Read Phase (with RLock)
 	docContentCopy := make([]byte, len(doc.Contents))
 	copy(docContentCopy, doc.Contents)
@@ -318,6 +357,9 @@ func (doc *Document) PatchRequest(newContent []byte, jsonValidator jsondata.Vali
 	if marshalErr != nil {
 		return fmt.Errorf("failed to marshal modified document")
 	}
+	if err := limits.Check(modifiedJSONContent); err != nil {
+		return err
+	}
 
 	// Step 2: Write Phase (with Lock)
 
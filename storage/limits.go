@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// DocumentLimits bounds the size in bytes and the nesting depth of document
+// contents. A zero limit is not enforced.
+type DocumentLimits struct {
+	MaxSize  int `json:"maxSize"`
+	MaxDepth int `json:"maxDepth"`
+}
+
+// ErrDocumentTooLarge is returned when a document is over the size limit
+var ErrDocumentTooLarge = errors.New("document too large")
+
+// ErrDocumentTooDeep is returned when a document is nested too deeply
+var ErrDocumentTooDeep = errors.New("document nested too deeply")
+
+// Check enforces the limits on the given document contents. Depth is counted
+// while tokenizing, before any value is built, so a deeply nested document
+// is rejected without being parsed. Malformed JSON is left to the parser.
+// Input: Document contents ([]byte)
+// Output: error wrapping ErrDocumentTooLarge or ErrDocumentTooDeep
+func (limits DocumentLimits) Check(content []byte) error {
+	if limits.MaxSize > 0 && len(content) > limits.MaxSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrDocumentTooLarge, len(content), limits.MaxSize)
+	}
+	if limits.MaxDepth <= 0 {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > limits.MaxDepth {
+				return fmt.Errorf("%w: limit is %d levels", ErrDocumentTooDeep, limits.MaxDepth)
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// documentStatus returns the status for a document that could not be created
+// or patched
+// Input: error
+// Output: Status, "Too Large" for oversized documents and "Bad Request" otherwise
+func documentStatus(err error) status {
+	if errors.Is(err, ErrDocumentTooLarge) {
+		return status{"Too Large", err}
+	}
+	return status{"Bad Request", err}
+}
@@ -2,13 +2,17 @@ package storage
 
 import (
 	"fmt"
-	"log/slog"
+	"slices"
 	"strings"
 	"sync"
 
 	"github.com/RICE-COMP318-FALL24/owldb-p1group35/skiplist"
 )
 
+// reservedDatabaseNames are used by server endpoints under /v1/, which would
+// hide a database of the same name
+var reservedDatabaseNames = []string{"_info"}
+
 // RootNode represents the root of the storage system, containing multiple databases.
 type RootNode struct {
 	Databases *skiplist.SkipList[string, Database]
@@ -37,11 +41,8 @@ func (root *RootNode) GetPath() string {
 func (root *RootNode) GetChild(dbName string) (IChildNode, error) {
 	// Search for database by name
 	if collection, exists := root.Databases.Find(dbName); exists {
-		slog.Info("Database found", "Database name", dbName)
 		return collection, nil
 	}
-	// If not found, log and print error message
-	slog.Warn("Database not found", "Database name", dbName)
 	return nil, fmt.Errorf("Database '%s' not found", dbName)
 }
 
@@ -58,7 +59,7 @@ func (root *RootNode) Handle(req RequestPack) (content any, stat status) {
 	case "DELETE":
 		return nil, root.HandleDelete(req)
 	default:
-		slog.Warn("Invalid HTTP request method", "method", request)
+		req.GetLogger().Warn("Invalid HTTP request method", "method", request)
 		return nil, status{"Bad Request", fmt.Errorf("invalid HTTP request")}
 	}
 }
@@ -70,16 +71,16 @@ func (root *RootNode) HandleGet(req RequestPack) (content any, stat status) {
 	childName := req.GetPath()[len(req.GetPath())-1]
 	db, exists := root.Databases.Find(childName)
 	if !exists {
-		slog.Info("Database %s does not exist", "database", childName)
-		return nil, status{"Does Not Exist", fmt.Errorf("Database does not exist " + childName + ": Not Found")}
+		req.GetLogger().Info("Database %s does not exist", "database", childName)
+		return nil, status{"Does Not Exist", fmt.Errorf("Database does not exist %s: Not Found", childName)}
 	}
-	slog.Info("Database found", "Database name", childName)
-	response, err := db.get(req.GetStartKey(), req.GetEndKey())
+	req.GetLogger().Info("Database found", "Database name", childName)
+	response, err := db.get(req.GetStartKey(), req.GetEndKey(), req.GetLogger())
 	if err != nil {
-		slog.Error("Internal error retrieving documents", "child_name", childName, "error", err)
+		req.GetLogger().Error("Internal error retrieving documents", "child_name", childName, "error", err)
 		return nil, status{"Internal Error", fmt.Errorf("internal error retrieving documents")}
 	}
-	slog.Info("GET operation successful", "child_name", childName)
+	req.GetLogger().Info("GET operation successful", "child_name", childName)
 	return response, status{"Get", nil}
 }
 
@@ -91,10 +92,10 @@ func (root *RootNode) HandleDelete(req RequestPack) (stat status) {
 	removed, _ := root.Databases.Delete(childName)
 
 	if !removed {
-		slog.Warn("DELETE operation failed: Database not found", "database_name", childName)
-		return status{"Does Not Exist", fmt.Errorf("Database does not exist " + childName + ": Not Found")}
+		req.GetLogger().Warn("DELETE operation failed: Database not found", "database_name", childName)
+		return status{"Does Not Exist", fmt.Errorf("Database does not exist %s: Not Found", childName)}
 	} else {
-		slog.Info("DELETE operation successful", "database_name", childName)
+		req.GetLogger().Info("DELETE operation successful", "database_name", childName)
 		return status{"Deleted", nil}
 	}
 }
@@ -107,20 +108,24 @@ func (root *RootNode) HandlePut(req RequestPack) (content any, stat status) {
 	defer root.mu.Unlock()
 
 	childName := req.GetPath()[len(req.GetPath())-1]
+	if slices.Contains(reservedDatabaseNames, childName) {
+		req.GetLogger().Warn("Database name is reserved", "child_name", childName)
+		return nil, status{"Bad Request", fmt.Errorf("Database name %s is reserved", childName)}
+	}
 	path := "/v1/" + strings.Join(req.GetPath(), "/")
-	newDatabase := Database{Documents: skiplist.NewSkipList[string, Document](10, "", "\U0010FFFF"), Path: path, Name: childName}
+	newDatabase := Database{Documents: skiplist.NewSkipList[string, Document](10, "", "\U0010FFFF"), Path: path, Name: childName, CreatedBy: req.GetUsername()}
 	putCheckNoOverwrite := DatabaseCheckNoOverwrite(&newDatabase)
-	_, err := root.Databases.Upsert(childName, putCheckNoOverwrite)
+	_, err := root.Databases.UpsertWithLogger(childName, putCheckNoOverwrite, req.GetLogger())
 
 	if err != nil {
-		slog.Warn("Database already exists", "child_name", childName)
-		return nil, status{"Bad Request", fmt.Errorf("Database already exists " + childName + ": already exists")}
+		req.GetLogger().Warn("Database already exists", "child_name", childName)
+		return nil, status{"Bad Request", fmt.Errorf("Database already exists %s: already exists", childName)}
 	}
 
 	response := PutResponse{
 		Path: path,
 	}
 
-	slog.Info("PUT operation successful", "child_name", childName, "path", path)
+	req.GetLogger().Info("PUT operation successful", "child_name", childName, "path", path)
 	return response, status{"Created", nil}
 }
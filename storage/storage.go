@@ -42,6 +42,9 @@ type RequestPack interface {
 	GetStartKey() string
 	GetEndKey() string
 	GetNoOverwrite() bool
+	GetOwnerOnly() bool
+	GetDocumentLimits() DocumentLimits
+	GetLogger() *slog.Logger
 }
 
 // PutResponse represents the response for a PUT operation.
@@ -54,6 +57,7 @@ type PatchResponse struct {
 	Uri         string `json:"uri"`
 	PatchFailed bool   `json:"patch_failed"`
 	Message     string `json:"message"`
+	Version     uint64 `json:"version,omitempty"`
 }
 
 // NewStorageTree creates and returns a new storage tree with an initialized root node.
@@ -66,9 +70,9 @@ func NewStorageTree() *Storage {
 }
 
 // GetParent retrieves the parent node based on the given path.
-// Input: Path ([]string)
+// Input: Path ([]string), Logger of the request (*slog.Logger)
 // Output: IChildNode, error if any
-func (tree *Storage) GetParent(path []string) (IChildNode, error) {
+func (tree *Storage) GetParent(path []string, logger *slog.Logger) (IChildNode, error) {
 	var currentObject IChildNode = tree.root
 
 	for i, key := range path {
@@ -80,25 +84,50 @@ func (tree *Storage) GetParent(path []string) (IChildNode, error) {
 		currentObject, err = currentObject.GetChild(key)
 
 		if err != nil {
-			slog.Error("Error getting child in path", "key", key, "error", err)
+			logger.Warn("Error getting child in path", "key", key, "error", err)
 			return nil, fmt.Errorf("containing collection/document does not exist")
 		}
+		logger.Debug("Found child in path", "key", key)
 	}
-	slog.Info("Parent object retrieved successfully", "path", path)
+	logger.Debug("Parent object retrieved successfully", "path", path)
 	// Return the object at the last position in the path
 	return currentObject, nil
 }
 
+// Creator returns the user who created the database, document or collection
+// at a path.
+// Input: Path ([]string)
+// Output: Username (string), error if the resource does not exist
+func (tree *Storage) Creator(path []string) (string, error) {
+	var node IChildNode = tree.root
+	for _, key := range path {
+		child, err := node.GetChild(key)
+		if err != nil {
+			return "", fmt.Errorf("resource does not exist")
+		}
+		node = child
+	}
+	switch node := node.(type) {
+	case *Database:
+		return node.CreatedBy, nil
+	case *Collection:
+		return node.CreatedBy, nil
+	case *Document:
+		return node.Metadata.CreatedBy, nil
+	}
+	return "", fmt.Errorf("resource does not exist")
+}
+
 // HandleOperation processes an operation request and returns the result.
 // Input: RequestPack (op_info)
 // Output: Content (any), Status (status)
 func (tree *Storage) HandleOperation(opInfo RequestPack) (content any, statInfo status) {
 	path := opInfo.GetPath()
 
-	parent, err := tree.GetParent(path)
+	parent, err := tree.GetParent(path, opInfo.GetLogger())
 
 	if err != nil {
-		slog.Warn("Failed to get parent object", "path", path, "error", err)
+		opInfo.GetLogger().Warn("Failed to get parent object", "path", path, "error", err)
 		statInfo := status{status_class: "Does Not Exist", err: err}
 		return nil, statInfo
 	}
@@ -109,7 +138,7 @@ func (tree *Storage) HandleOperation(opInfo RequestPack) (content any, statInfo
 		childName := path[len(path)-1]
 		child, err := parent.GetChild(childName)
 		if err != nil {
-			slog.Warn("Failed to get target child for POST operation", "child_name", childName, "error", err)
+			opInfo.GetLogger().Warn("Failed to get target child for POST operation", "child_name", childName, "error", err)
 			statInfo := status{status_class: "Does Not Exist", err: err}
 			return nil, statInfo
 		}
@@ -123,3 +152,15 @@ func (tree *Storage) HandleOperation(opInfo RequestPack) (content any, statInfo
 	info, status := parent.Handle(opInfo)
 	return info, status
 }
+
+// DatabaseSizes returns the number of documents directly in each database.
+// Input: None
+// Output: Map from database name to document count
+func (tree *Storage) DatabaseSizes() map[string]int {
+	sizes := make(map[string]int)
+	databases, _ := tree.root.Databases.Query("", "\U0010FFFF")
+	for _, db := range databases {
+		sizes[db.Name] = db.Documents.Len()
+	}
+	return sizes
+}
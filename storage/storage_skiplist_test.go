@@ -2,8 +2,11 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"math/rand/v2"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -87,6 +90,8 @@ type MockRequest struct {
 	min         string
 	max         string
 	NoOverwrite bool
+	OwnerOnly   bool
+	Limits      DocumentLimits
 }
 
 func (req MockRequest) GetType() string {
@@ -113,6 +118,18 @@ func (req MockRequest) GetNoOverwrite() bool {
 	return req.NoOverwrite
 }
 
+func (req MockRequest) GetOwnerOnly() bool {
+	return req.OwnerOnly
+}
+
+func (req MockRequest) GetLogger() *slog.Logger {
+	return slog.Default()
+}
+
+func (req MockRequest) GetDocumentLimits() DocumentLimits {
+	return req.Limits
+}
+
 func (req MockRequest) GetValidator() jsondata.Validator {
 	compiler := jsonschema.NewCompiler()
 	schema, err := compiler.Compile("./anyschema.json")
@@ -185,7 +202,7 @@ func Test_AddMultipleDocuments(t *testing.T) {
 	}
 
 	// Validate that all documents were inserted
-	fetchedDocs, _ := database.get("", "")
+	fetchedDocs, _ := database.get("", "", slog.Default())
 	fetchedContent := make([]map[string]interface{}, 0)
 	for _, doc := range fetchedDocs {
 		fetchedContent = append(fetchedContent, doc.Content)
@@ -227,7 +244,7 @@ func Test_RemoveMultipleDocuments(t *testing.T) {
 	}
 
 	// Verify all documents are removed
-	remainingDocs, _ := database.get("", "")
+	remainingDocs, _ := database.get("", "", slog.Default())
 	if len(remainingDocs) > 0 {
 		t.Error("Documents were not all deleted as expected.")
 	}
@@ -260,7 +277,7 @@ func Test_ConcurrentAddDocuments(t *testing.T) {
 	wg.Wait()
 
 	// Validate all documents were inserted concurrently
-	fetchedDocs, _ := database.get("", "")
+	fetchedDocs, _ := database.get("", "", slog.Default())
 	fetchedContent := make([]map[string]interface{}, 0)
 	for _, doc := range fetchedDocs {
 		fetchedContent = append(fetchedContent, doc.Content)
@@ -344,7 +361,7 @@ func Test_ConcurrentDeleteDocuments(t *testing.T) {
 	wg.Wait()
 
 	// Verify all documents are deleted
-	fetchedDocs, _ := database.get("", "")
+	fetchedDocs, _ := database.get("", "", slog.Default())
 	if len(fetchedDocs) > 0 {
 		t.Error("Not all documents were deleted concurrently.")
 	}
@@ -404,3 +421,75 @@ func Test_InsertDuplicateKeys(t *testing.T) {
 		t.Errorf("Duplicate key handling failed: Expected %v, got %v", expected, result)
 	}
 }
+
+// Test that the owner-only policy stops other users from changing a document
+func Test_OwnerOnlyPolicy(t *testing.T) {
+	skiplist := skiplist.NewSkipList[string, Document](10, "", "\U0010FFFF")
+	db := Database{Path: "/v1/hello", Documents: skiplist, Name: "hello"}
+	path_list := []string{"hello", "braddoc"}
+
+	db.Handle(MockRequest{Method: "PUT", URI: path_list, Data: []byte(`{"a": 1}`), User: "Brad", OwnerOnly: true})
+
+	_, stat := db.Handle(MockRequest{Method: "PUT", URI: path_list, Data: []byte(`{"a": 2}`), User: "Eve", OwnerOnly: true})
+	if stat.GetClass() != "Forbidden" {
+		t.Errorf("Expected overwrite by another user to be forbidden, got %v", stat)
+	}
+	_, stat = db.Handle(MockRequest{Method: "PATCH", URI: path_list, Data: []byte(`[{"op": "ObjectAdd", "path": "/b", "value": 1}]`), User: "Eve", OwnerOnly: true})
+	if stat.GetClass() != "Forbidden" {
+		t.Errorf("Expected patch by another user to be forbidden, got %v", stat)
+	}
+	_, stat = db.Handle(MockRequest{Method: "DELETE", URI: path_list, User: "Eve", OwnerOnly: true})
+	if stat.GetClass() != "Forbidden" {
+		t.Errorf("Expected delete by another user to be forbidden, got %v", stat)
+	}
+
+	content, _ := db.Handle(MockRequest{Method: "GET", URI: path_list, User: "Eve"})
+	if content.(DocumentContent).Metadata.Version != 1 {
+		t.Errorf("Document changed despite the policy")
+	}
+
+	// Without the policy, or for the creator, changes are allowed
+	_, stat = db.Handle(MockRequest{Method: "PUT", URI: path_list, Data: []byte(`{"a": 2}`), User: "Brad", OwnerOnly: true})
+	if stat.GetClass() != "Overwritten" {
+		t.Errorf("Expected creator to overwrite, got %v", stat)
+	}
+	_, stat = db.Handle(MockRequest{Method: "DELETE", URI: path_list, User: "Eve"})
+	if stat.GetClass() != "Deleted" {
+		t.Errorf("Expected delete without the policy to succeed, got %v", stat)
+	}
+}
+
+// Test for size and depth limits on new and patched documents
+func Test_DocumentLimits(t *testing.T) {
+	skiplist := skiplist.NewSkipList[string, Document](10, "", "\U0010FFFF")
+	db := Database{Path: "/v1/hello", Documents: skiplist, Name: "hello"}
+	path_list := []string{"hello", "doc"}
+	limits := DocumentLimits{MaxSize: 32, MaxDepth: 2}
+
+	_, stat := db.Handle(MockRequest{Method: "PUT", URI: path_list, Data: []byte(`{"a": "` + strings.Repeat("x", 40) + `"}`), User: "Brad", Limits: limits})
+	if stat.GetClass() != "Too Large" || !errors.Is(stat.GetError(), ErrDocumentTooLarge) {
+		t.Errorf("Expected oversized document to be too large, got %v", stat)
+	}
+	_, stat = db.Handle(MockRequest{Method: "PUT", URI: path_list, Data: []byte(`{"a": {"b": [1]}}`), User: "Brad", Limits: limits})
+	if stat.GetClass() != "Bad Request" || !errors.Is(stat.GetError(), ErrDocumentTooDeep) {
+		t.Errorf("Expected deeply nested document to be rejected, got %v", stat)
+	}
+	_, stat = db.Handle(MockRequest{Method: "PUT", URI: path_list, Data: []byte(`{"a": {"b": 1}}`), User: "Brad", Limits: limits})
+	if stat.GetClass() != "Created" {
+		t.Errorf("Expected document within limits to be created, got %v", stat)
+	}
+
+	// Patches may not grow a document past the limits
+	_, stat = db.Handle(MockRequest{Method: "PATCH", URI: path_list, Data: []byte(`[{"op": "ObjectAdd", "path": "/c", "value": "` + strings.Repeat("x", 40) + `"}]`), User: "Brad", Limits: limits})
+	if stat.GetClass() != "Too Large" {
+		t.Errorf("Expected patch past the size limit to be too large, got %v", stat)
+	}
+	_, stat = db.Handle(MockRequest{Method: "PATCH", URI: path_list, Data: []byte(`[{"op": "ObjectAdd", "path": "/a/c", "value": [1]}]`), User: "Brad", Limits: limits})
+	if stat.GetClass() != "Bad Request" {
+		t.Errorf("Expected patch past the depth limit to be rejected, got %v", stat)
+	}
+	content, _ := db.Handle(MockRequest{Method: "GET", URI: path_list, User: "Brad"})
+	if content.(DocumentContent).Metadata.Version != 1 {
+		t.Errorf("Document changed by a rejected patch")
+	}
+}
@@ -0,0 +1,67 @@
+package subscription
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// UpdateMode selects how a subscriber receives update events caused by PATCH.
+type UpdateMode int
+
+const (
+	// FullUpdates sends the full document after every change.
+	FullUpdates UpdateMode = iota
+	// PatchUpdates sends only the applied patch operations and new version.
+	PatchUpdates
+	// FullAndPatchUpdates sends the patch operations alongside the full document.
+	FullAndPatchUpdates
+)
+
+// ParseUpdateMode converts an update mode name to an UpdateMode. The empty
+// string selects FullUpdates.
+// Input: Update mode name (string)
+// Output: UpdateMode, error if the name is unknown
+func ParseUpdateMode(name string) (UpdateMode, error) {
+	switch name {
+	case "", "full":
+		return FullUpdates, nil
+	case "patch":
+		return PatchUpdates, nil
+	case "both":
+		return FullAndPatchUpdates, nil
+	default:
+		return FullUpdates, fmt.Errorf("unknown update mode %q", name)
+	}
+}
+
+// PatchDelta describes the patch operations that turned a document into the
+// given version.
+type PatchDelta struct {
+	Path    string          `json:"path"`
+	Version uint64          `json:"version"`
+	Patch   json.RawMessage `json:"patch"`
+	Doc     json.RawMessage `json:"doc,omitempty"`
+}
+
+// ForMode returns the event with its data encoded for the given update mode.
+// Events without a delta are always sent with their full data.
+// Input: Update mode (UpdateMode)
+// Output: Event
+func (e Event) ForMode(mode UpdateMode) Event {
+	if e.Delta == nil || mode == FullUpdates {
+		return e
+	}
+
+	delta := *e.Delta
+	if mode == FullAndPatchUpdates {
+		delta.Doc = e.Data
+	}
+	encoded, err := json.Marshal(delta)
+	if err != nil {
+		slog.Error("Failed to encode patch delta, sending full update", "path", e.Path, "error", err)
+		return e
+	}
+	e.Data = encoded
+	return e
+}
@@ -0,0 +1,284 @@
+package subscription
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Policy decides what happens to events that arrive while a subscriber's
+// buffer is full.
+type Policy int
+
+const (
+	// DropOldest discards the oldest pending event to make room.
+	DropOldest Policy = iota
+	// Disconnect closes the subscription, which then ends with an overflow event.
+	Disconnect
+	// Coalesce keeps only the latest pending event per path, falling back to
+	// dropping the oldest event when every pending event is for a distinct path.
+	Coalesce
+)
+
+// Buffer sizes accepted for a subscriber.
+const (
+	DefaultBufferSize = 10
+	MaxBufferSize     = 1000
+)
+
+// ParsePolicy converts a policy name to a Policy. The empty string selects
+// DropOldest.
+// Input: Policy name (string)
+// Output: Policy, error if the name is unknown
+func ParsePolicy(name string) (Policy, error) {
+	switch name {
+	case "", "drop-oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	case "coalesce":
+		return Coalesce, nil
+	default:
+		return DropOldest, fmt.Errorf("unknown overflow policy %q", name)
+	}
+}
+
+// String returns the name of the policy.
+// Input: None
+// Output: Policy name (string)
+func (p Policy) String() string {
+	switch p {
+	case Disconnect:
+		return "disconnect"
+	case Coalesce:
+		return "coalesce"
+	default:
+		return "drop-oldest"
+	}
+}
+
+// Subscriber is a bounded queue of events for one client. Pushing never
+// blocks, so a slow client cannot stall the writers dispatching to it.
+type Subscriber struct {
+	mu        sync.Mutex
+	pending   []Event
+	size      int
+	policy    Policy
+	mode      UpdateMode
+	authorize func() error
+	filter    func(Event) bool
+	dropped   uint64
+	closed    bool
+	final     Event
+	ready     chan struct{}
+	done      chan struct{}
+	lastSeq   uint64
+}
+
+// NewSubscriber creates a subscriber with the given buffer size, overflow
+// policy and update mode.
+// Input: Buffer size (int), Overflow policy (Policy), Update mode (UpdateMode)
+// Output: New Subscriber (*Subscriber), error if the buffer size is out of range
+func NewSubscriber(bufferSize int, policy Policy, mode UpdateMode) (*Subscriber, error) {
+	if bufferSize < 1 || bufferSize > MaxBufferSize {
+		return nil, fmt.Errorf("buffer size must be between 1 and %d", MaxBufferSize)
+	}
+	return &Subscriber{
+		pending: make([]Event, 0, bufferSize),
+		size:    bufferSize,
+		policy:  policy,
+		mode:    mode,
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// SetAuthorizer sets the check run before every event is queued. Once the
+// check fails the subscriber is closed with an auth-expired event.
+// Input: Authorization check (func() error)
+// Output: None
+func (s *Subscriber) SetAuthorizer(authorize func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.authorize = authorize
+}
+
+// SetFilter sets the check that decides whether an event is delivered.
+// Events the filter rejects are skipped without closing the subscriber.
+// Input: Filter (func(Event) bool)
+// Output: None
+func (s *Subscriber) SetFilter(filter func(Event) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.filter = filter
+}
+
+// closeWith discards pending events and closes the subscriber, leaving the
+// given event to be sent last. Must be called with s.mu held.
+// Input: Final event (Event)
+// Output: None
+func (s *Subscriber) closeWith(event Event) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.dropped += uint64(len(s.pending))
+	s.pending = nil
+	s.final = event
+	close(s.done)
+}
+
+// authExpired closes the subscriber because its authorization no longer
+// holds. Must be called with s.mu held.
+// Input: Reason (error)
+// Output: None
+func (s *Subscriber) authExpired(reason error) {
+	data := fmt.Sprintf(`{"message":%q}`, reason.Error())
+	s.closeWith(Event{Type: "auth-expired", Data: []byte(data), Sequence: s.lastSeq})
+}
+
+// shutdown closes the subscriber because the server is shutting down. Unlike
+// other closes the pending events are kept, so they are delivered before
+// the shutdown event.
+// Input: Retry hint (time.Duration)
+// Output: None
+func (s *Subscriber) shutdown(retry time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	data := fmt.Sprintf(`{"message":"server is shutting down","retryAfter":%d}`, int(math.Ceil(retry.Seconds())))
+	s.closed = true
+	s.final = Event{Type: "shutdown", Data: []byte(data), Sequence: s.lastSeq, Retry: retry}
+	close(s.done)
+}
+
+// Recheck runs the authorization check without an event, closing the
+// subscriber if it fails.
+// Input: None
+// Output: Boolean indicating if the subscriber is still open
+func (s *Subscriber) Recheck() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.authorize != nil {
+		if err := s.authorize(); err != nil {
+			s.authExpired(err)
+			return false
+		}
+	}
+	return true
+}
+
+// push queues an event, applying the overflow policy if the buffer is full.
+// Input: Event
+// Output: None
+func (s *Subscriber) push(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.lastSeq = event.Sequence
+
+	if s.authorize != nil {
+		if err := s.authorize(); err != nil {
+			s.authExpired(err)
+			return
+		}
+	}
+	if s.filter != nil && !s.filter(event) {
+		return
+	}
+
+	if s.policy == Coalesce {
+		for i, queued := range s.pending {
+			if queued.Path == event.Path {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				s.dropped++
+				break
+			}
+		}
+	}
+
+	if len(s.pending) >= s.size {
+		if s.policy == Disconnect {
+			s.dropped++
+			data := fmt.Sprintf(`{"message":"subscriber buffer overflowed","dropped":%d}`, s.dropped+uint64(len(s.pending)))
+			s.closeWith(Event{Type: "overflow", Data: []byte(data), Sequence: s.lastSeq})
+			return
+		}
+		s.pending = s.pending[1:]
+		s.dropped++
+	}
+	s.pending = append(s.pending, event)
+
+	// Wake the reader without blocking if it has already been woken
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready returns a channel that receives a value whenever events are pending.
+// Input: None
+// Output: Ready channel (<-chan struct{})
+func (s *Subscriber) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Done returns a channel that is closed when the subscriber is disconnected,
+// because its buffer overflowed, its authorization expired or the server is
+// shutting down. Events still pending should be drained before the final
+// event is sent.
+// Input: None
+// Output: Done channel (<-chan struct{})
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+// Drain removes and returns all pending events in order, encoded for the
+// subscriber's update mode.
+// Input: None
+// Output: Pending events ([]Event)
+func (s *Subscriber) Drain() []Event {
+	s.mu.Lock()
+	events := s.pending
+	s.pending = make([]Event, 0, s.size)
+	s.mu.Unlock()
+
+	for i := range events {
+		events[i] = events[i].ForMode(s.mode)
+	}
+	return events
+}
+
+// Dropped returns the number of events discarded by the overflow policy.
+// Input: None
+// Output: Dropped event count (uint64)
+func (s *Subscriber) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+// FinalEvent returns the event to send after the subscriber is disconnected,
+// tagged with the sequence number of the last event it missed.
+// Input: None
+// Output: Final event (Event)
+func (s *Subscriber) FinalEvent() Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.final
+}
@@ -0,0 +1,190 @@
+package subscription
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pushAll queues events for the given paths with increasing sequence numbers
+func pushAll(s *Subscriber, paths ...string) {
+	for i, path := range paths {
+		s.push(Event{Type: "update", Path: path, Data: []byte(fmt.Sprintf("%d", i)), Sequence: uint64(i + 1)})
+	}
+}
+
+// Test_DropOldest checks that a full buffer keeps the newest events
+func Test_DropOldest(t *testing.T) {
+	s, _ := NewSubscriber(2, DropOldest, FullUpdates)
+	pushAll(s, "/a", "/b", "/c")
+
+	events := s.Drain()
+	if len(events) != 2 || events[0].Path != "/b" || events[1].Path != "/c" {
+		t.Errorf("Expected the two newest events, got %v", events)
+	}
+	if s.Dropped() != 1 {
+		t.Errorf("Expected one dropped event, got %d", s.Dropped())
+	}
+}
+
+// Test_Disconnect checks that overflowing closes the subscriber
+func Test_Disconnect(t *testing.T) {
+	s, _ := NewSubscriber(2, Disconnect, FullUpdates)
+	pushAll(s, "/a", "/b", "/c")
+
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("Expected subscriber to be disconnected")
+	}
+	if events := s.Drain(); len(events) != 0 {
+		t.Errorf("Expected no pending events after disconnect, got %v", events)
+	}
+	if event := s.FinalEvent(); event.Type != "overflow" || event.Sequence != 3 {
+		t.Errorf("Unexpected overflow event %v", event)
+	}
+}
+
+// Test_Coalesce checks that only the latest event per path is kept
+func Test_Coalesce(t *testing.T) {
+	s, _ := NewSubscriber(2, Coalesce, FullUpdates)
+	pushAll(s, "/a", "/b", "/a", "/a")
+
+	events := s.Drain()
+	if len(events) != 2 || events[0].Path != "/b" || events[1].Path != "/a" || events[1].Sequence != 4 {
+		t.Errorf("Expected /b then the latest /a, got %v", events)
+	}
+}
+
+// Test_DispatchDoesNotBlock checks that dispatching to a subscriber that never reads returns
+func Test_DispatchDoesNotBlock(t *testing.T) {
+	h := NewHandler()
+	s, _ := NewSubscriber(1, DropOldest, FullUpdates)
+	h.Register("/v1/db/doc", s)
+
+	for i := 0; i < 100; i++ {
+		h.Dispatch("/v1/db/doc", Event{Type: "update", Path: "/v1/db/doc", Data: []byte("{}")}, true)
+	}
+	if events := s.Drain(); len(events) != 1 || events[0].Sequence != 100 {
+		t.Errorf("Expected only the latest event, got %v", events)
+	}
+}
+
+// Test_AuthExpired checks that a subscriber is closed once its authorization fails
+func Test_AuthExpired(t *testing.T) {
+	h := NewHandler()
+	s, _ := NewSubscriber(10, DropOldest, FullUpdates)
+	valid := true
+	s.SetAuthorizer(func() error {
+		if !valid {
+			return fmt.Errorf("missing or invalid bearer token")
+		}
+		return nil
+	})
+	h.Register("/v1/db/doc", s)
+
+	h.Dispatch("/v1/db/doc", Event{Type: "update", Path: "/v1/db/doc"}, true)
+	if h.Recheck() != 0 {
+		t.Fatal("Subscriber should still be authorized")
+	}
+
+	valid = false
+	h.Dispatch("/v1/db/doc", Event{Type: "update", Path: "/v1/db/doc"}, true)
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("Expected subscriber to be closed")
+	}
+	if event := s.FinalEvent(); event.Type != "auth-expired" || event.Sequence != 2 {
+		t.Errorf("Unexpected final event %v", event)
+	}
+	if events := s.Drain(); len(events) != 0 {
+		t.Errorf("Expected no events after expiry, got %v", events)
+	}
+}
+
+// Test_Shutdown checks that shutdown keeps pending events, ends with a
+// shutdown event carrying the retry hint and refuses new subscribers
+func Test_Shutdown(t *testing.T) {
+	h := NewHandler()
+	s, _ := NewSubscriber(10, DropOldest, FullUpdates)
+	h.Register("/v1/db/doc", s)
+	h.Dispatch("/v1/db/doc", Event{Type: "update", Path: "/v1/db/doc", Data: []byte("{}")}, true)
+
+	if closed := h.Shutdown(3 * time.Second); closed != 1 {
+		t.Errorf("Expected one subscriber closed, got %d", closed)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("Expected subscriber to be closed")
+	}
+	if events := s.Drain(); len(events) != 1 {
+		t.Errorf("Expected the pending event to be kept, got %v", events)
+	}
+	event := s.FinalEvent()
+	if event.Type != "shutdown" || event.Sequence != 1 || !strings.Contains(event.Format(), "retry: 3000\n") {
+		t.Errorf("Unexpected shutdown event %q", event.Format())
+	}
+
+	other, _ := NewSubscriber(10, DropOldest, FullUpdates)
+	if err := h.Register("/v1/db/doc", other); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("Expected new subscribers to be refused, got %v", err)
+	}
+}
+
+// Test_Filter checks that filtered events are skipped without closing the subscriber
+func Test_Filter(t *testing.T) {
+	s, _ := NewSubscriber(5, DropOldest, FullUpdates)
+	s.SetFilter(func(event Event) bool { return event.Path != "/secret" })
+	pushAll(s, "/a", "/secret", "/b")
+
+	events := s.Drain()
+	if len(events) != 2 || events[0].Path != "/a" || events[1].Path != "/b" {
+		t.Errorf("Expected /a then /b, got %v", events)
+	}
+	select {
+	case <-s.Done():
+		t.Error("Expected subscriber to stay open")
+	default:
+	}
+}
+
+// Test_InvalidBufferSize checks the buffer size bounds
+func Test_InvalidBufferSize(t *testing.T) {
+	if _, err := NewSubscriber(0, DropOldest, FullUpdates); err == nil {
+		t.Error("Expected error for empty buffer")
+	}
+	if _, err := NewSubscriber(MaxBufferSize+1, DropOldest, FullUpdates); err == nil {
+		t.Error("Expected error for oversized buffer")
+	}
+	if _, err := ParsePolicy("block"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+// Test_PatchUpdates checks that patch subscribers receive the delta instead of the document
+func Test_PatchUpdates(t *testing.T) {
+	event := Event{
+		Type:  "update",
+		Path:  "/v1/db/doc",
+		Data:  []byte(`{"path":"/v1/db/doc","doc":{"a":1}}`),
+		Delta: &PatchDelta{Path: "/v1/db/doc", Version: 2, Patch: []byte(`[{"op":"ObjectAdd","path":"/a","value":1}]`)},
+	}
+
+	if full := event.ForMode(FullUpdates); string(full.Data) != string(event.Data) {
+		t.Errorf("Full mode should keep the document, got %s", full.Data)
+	}
+	patch := event.ForMode(PatchUpdates)
+	expected := `{"path":"/v1/db/doc","version":2,"patch":[{"op":"ObjectAdd","path":"/a","value":1}]}`
+	if string(patch.Data) != expected {
+		t.Errorf("Expected %s, got %s", expected, patch.Data)
+	}
+	both := event.ForMode(FullAndPatchUpdates)
+	expected = `{"path":"/v1/db/doc","version":2,"patch":[{"op":"ObjectAdd","path":"/a","value":1}],"doc":{"path":"/v1/db/doc","doc":{"a":1}}}`
+	if string(both.Data) != expected {
+		t.Errorf("Expected %s, got %s", expected, both.Data)
+	}
+}
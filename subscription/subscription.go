@@ -5,14 +5,35 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
 	"time"
 )
 
-// SubscriberHandler manages subscriptions and client channels for resources.
+// ErrShuttingDown is returned by Register once the handler has been shut down
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// Event is a notification delivered to the subscribers of a resource. Path
+// is the resource the event concerns. Delta is set for updates made by PATCH.
+// RequestID is the ID of the request that caused the event, if any. Retry,
+// if set, tells the client how long to wait before reconnecting.
+type Event struct {
+	Type      string
+	Path      string
+	Data      []byte
+	Delta     *PatchDelta
+	Sequence  uint64
+	RequestID string
+	Retry     time.Duration
+}
+
+// SubscriberHandler manages subscriptions and subscribers for resources.
 type SubscriberHandler struct {
 	lock        sync.RWMutex
-	clientChans map[string][]chan string
+	dispatchMu  sync.Mutex
+	subscribers map[string][]*Subscriber
+	sequence    uint64
+	shutdown    bool
 }
 
 // NewHandler initializes a new SubscriberHandler.
@@ -20,81 +41,98 @@ type SubscriberHandler struct {
 // Output: New SubscriberHandler (*SubscriberHandler)
 func NewHandler() *SubscriberHandler {
 	return &SubscriberHandler{
-		clientChans: make(map[string][]chan string),
+		subscribers: make(map[string][]*Subscriber),
 	}
 }
 
-// Register adds a client channel to a resource's subscription list.
-// Input: Resource ID (string), Client channel (chan string)
-// Output: Error if the channel is already registered
-func (h *SubscriberHandler) Register(resourceID string, clientChan chan string) error {
+// Register adds a subscriber to a resource's subscription list.
+// Input: Resource ID (string), Subscriber (*Subscriber)
+// Output: Error if the subscriber is already registered, ErrShuttingDown
+// after Shutdown
+func (h *SubscriberHandler) Register(resourceID string, subscriber *Subscriber) error {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
-	slog.Info("Registering channel", "resource", resourceID)
+	slog.Info("Registering subscriber", "resource", resourceID)
+	if h.shutdown {
+		return ErrShuttingDown
+	}
 
-	// Check if the channel is already registered
-	if clients, ok := h.clientChans[resourceID]; ok {
-		for _, client := range clients {
-			if client == clientChan {
-				slog.Error("Channel already registered", "resource", resourceID)
-				return errors.New("channel already registered")
-			}
-		}
+	// Check if the subscriber is already registered
+	if slices.Contains(h.subscribers[resourceID], subscriber) {
+		slog.Error("Subscriber already registered", "resource", resourceID)
+		return errors.New("subscriber already registered")
 	}
-	// Add the channel to the resource's subscription list
-	h.clientChans[resourceID] = append(h.clientChans[resourceID], clientChan)
-	slog.Info("Channel registered successfully", "resource", resourceID, "client_count", len(h.clientChans[resourceID]))
+	// Add the subscriber to the resource's subscription list
+	h.subscribers[resourceID] = append(h.subscribers[resourceID], subscriber)
+	slog.Info("Subscriber registered successfully", "resource", resourceID, "client_count", len(h.subscribers[resourceID]))
 	return nil
 }
 
-// Dispatch sends event messages to all subscribers of a specific resource.
-// Input: Resource ID (string), Event path (string), Event type (string)
-// Output: Error if message dispatch fails to some clients
-func (h *SubscriberHandler) Dispatch(resourceID string, eventData []byte, sameLevel bool, eventType string) error {
-	h.lock.Lock()
-	defer h.lock.Unlock()
+// Dispatch sends an event to all subscribers of a specific resource. Events
+// are queued without blocking, and the subscription list is only locked long
+// enough to copy it.
+// Input: Resource ID (string), Event (Event), Same level (bool)
+// Output: Error if there are no subscribers
+func (h *SubscriberHandler) Dispatch(resourceID string, event Event, sameLevel bool) error {
+	// Serialize dispatches so every subscriber sees events in sequence order
+	h.dispatchMu.Lock()
+	defer h.dispatchMu.Unlock()
 
 	slog.Info("Dispatching event", "resource", resourceID)
 
-	subscribers, ok := h.clientChans[resourceID]
-	if !ok || len(subscribers) == 0 {
+	h.lock.Lock()
+	subscribers := slices.Clone(h.subscribers[resourceID])
+	// Clean up subscribers if the resource is deleted
+	if event.Type == "delete" && sameLevel {
+		delete(h.subscribers, resourceID)
+		slog.Info("Resource deleted, subscribers cleaned", "resource", resourceID)
+	}
+	h.sequence++
+	event.Sequence = h.sequence
+	h.lock.Unlock()
+
+	if len(subscribers) == 0 {
 		slog.Warn("No clients to notify", "resource", resourceID)
 		return errors.New("no clients to notify")
 	}
 
-	// Construct the event message
-	var buffer bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("event: %s\n", eventType))
-	buffer.WriteString(fmt.Sprintf("data: %s\n", string(eventData)))
-	buffer.WriteString(fmt.Sprintf("id: %d\n\n", time.Now().UnixNano()))
-	message := buffer.String()
-
-	failed := 0
-	// Send the message to all subscribers
-	for _, client := range subscribers {
-		select {
-		case client <- message:
-			slog.Info("Message dispatched", "client", client, "message", message)
-		default:
-			slog.Warn("Failed to dispatch message", "resource", resourceID)
-			failed++
-		}
+	// Queue the event for all subscribers
+	for _, subscriber := range subscribers {
+		subscriber.push(event)
 	}
 
-	// Clean up channels if the resource is deleted
-	if eventType == "delete" && sameLevel {
-		delete(h.clientChans, resourceID)
-		slog.Info("Resource deleted, channels cleaned", "resource", resourceID)
-	}
+	slog.Info("Event dispatched to all clients successfully", "resource", resourceID, "event_type", event.Type)
+	return nil
+}
 
-	if failed > 0 {
-		slog.Error("Some channels failed to receive message", "resource", resourceID, "failed_count", failed)
-		return errors.New("message dispatch failed to some clients")
-	}
+// Sequence returns the sequence number of the most recently dispatched event.
+// Input: None
+// Output: Sequence number (uint64)
+func (h *SubscriberHandler) Sequence() uint64 {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
 
-	slog.Info("Event dispatched to all clients successfully", "resource", resourceID, "event_type", eventType)
-	return nil
+	return h.sequence
+}
+
+// Format encodes the event as a server-sent event message. The ID of the
+// request that caused the event is sent as a comment, which EventSource
+// clients ignore, and the retry hint in milliseconds as the retry field.
+// Input: None
+// Output: Event message (string)
+func (e Event) Format() string {
+	var buffer bytes.Buffer
+	if e.RequestID != "" {
+		buffer.WriteString(fmt.Sprintf(": request-id %s\n", e.RequestID))
+	}
+	buffer.WriteString(fmt.Sprintf("event: %s\n", e.Type))
+	buffer.WriteString(fmt.Sprintf("data: %s\n", string(e.Data)))
+	if e.Retry > 0 {
+		buffer.WriteString(fmt.Sprintf("retry: %d\n", e.Retry.Milliseconds()))
+	}
+	buffer.WriteString(fmt.Sprintf("id: %d\n\n", e.Sequence))
+	return buffer.String()
 }
 
 // HasClients checks if a resource has active subscribers.
@@ -104,31 +142,85 @@ func (h *SubscriberHandler) HasClients(resourceID string) bool {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
 
-	clients, exists := h.clientChans[resourceID]
-	slog.Info("in HasClients", "resourceID", resourceID, "clients", clients, "exists", exists)
+	clients, exists := h.subscribers[resourceID]
+	slog.Debug("in HasClients", "resourceID", resourceID, "clients", len(clients), "exists", exists)
 	return exists && len(clients) > 0
 }
 
-// Unregister removes a client channel from a resource's subscription list.
-// Input: Resource ID (string), Client channel (chan string)
+// Count returns the number of active subscribers across all resources.
+// Input: None
+// Output: Number of subscribers (int)
+func (h *SubscriberHandler) Count() int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	count := 0
+	for _, clients := range h.subscribers {
+		count += len(clients)
+	}
+	return count
+}
+
+// Recheck runs the authorization check of every subscriber, closing those
+// whose authorization no longer holds.
+// Input: None
+// Output: Number of subscribers closed (int)
+func (h *SubscriberHandler) Recheck() int {
+	h.lock.RLock()
+	subscribers := make([]*Subscriber, 0)
+	for _, clients := range h.subscribers {
+		subscribers = append(subscribers, clients...)
+	}
+	h.lock.RUnlock()
+
+	closed := 0
+	for _, subscriber := range subscribers {
+		if !subscriber.Recheck() {
+			closed++
+		}
+	}
+	slog.Info("Rechecked subscriber authorization", "subscribers", len(subscribers), "closed", closed)
+	return closed
+}
+
+// Shutdown closes every subscriber with a shutdown event carrying the retry
+// hint, after the events already queued for it, and refuses new subscribers
+// from then on.
+// Input: Retry hint (time.Duration)
+// Output: Number of subscribers closed (int)
+func (h *SubscriberHandler) Shutdown(retry time.Duration) int {
+	h.lock.Lock()
+	h.shutdown = true
+	subscribers := make([]*Subscriber, 0)
+	for _, clients := range h.subscribers {
+		subscribers = append(subscribers, clients...)
+	}
+	h.lock.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber.shutdown(retry)
+	}
+	slog.Info("Closed subscribers for shutdown", "subscribers", len(subscribers))
+	return len(subscribers)
+}
+
+// Unregister removes a subscriber from a resource's subscription list.
+// Input: Resource ID (string), Subscriber (*Subscriber)
 // Output: None
-func (h *SubscriberHandler) Unregister(resourceID string, clientChan chan string) {
+func (h *SubscriberHandler) Unregister(resourceID string, subscriber *Subscriber) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
-	// Find and remove the client channel from the resource's list
-	if clients, ok := h.clientChans[resourceID]; ok {
-		for i, client := range clients {
-			if client == clientChan {
-				h.clientChans[resourceID] = append(clients[:i], clients[i+1:]...)
-				slog.Info("Channel unregistered", "resource", resourceID)
-				break
-			}
+	// Find and remove the subscriber from the resource's list
+	if clients, ok := h.subscribers[resourceID]; ok {
+		if i := slices.Index(clients, subscriber); i != -1 {
+			h.subscribers[resourceID] = slices.Delete(clients, i, i+1)
+			slog.Info("Subscriber unregistered", "resource", resourceID)
 		}
 
 		// Clean up if no clients are left for the resource
-		if len(h.clientChans[resourceID]) == 0 {
-			delete(h.clientChans, resourceID)
+		if len(h.subscribers[resourceID]) == 0 {
+			delete(h.subscribers, resourceID)
 			slog.Info("No remaining clients, resource cleaned", "resource", resourceID)
 		}
 	}
@@ -0,0 +1,372 @@
+// Package websocket implements the WebSocket protocol (RFC 6455) on top of
+// net/http using only the standard library.  Servers upgrade an incoming
+// request with Upgrade; Dial provides a minimal client.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Message and control frame opcodes.
+const (
+	continuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	CloseMessage      = 8
+	PingMessage       = 9
+	PongMessage       = 10
+)
+
+// DefaultMaxMessageSize is the largest message a connection accepts by default.
+const DefaultMaxMessageSize = 1 << 20
+
+// DefaultWriteTimeout is how long a frame write may block on a peer that is
+// not reading before the connection is closed.
+const DefaultWriteTimeout = 10 * time.Second
+
+// acceptGUID is the fixed GUID used to compute the Sec-WebSocket-Accept key.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrClosed is returned when reading from or writing to a closed connection.
+var ErrClosed = errors.New("websocket: connection closed")
+
+// Conn is a WebSocket connection.  Reads must come from a single goroutine,
+// writes may come from any number of goroutines.
+type Conn struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	writeMu  sync.Mutex
+	isServer bool
+	maxSize  int64
+	timeout  time.Duration
+	closed   atomic.Bool
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept value for a client key.
+// Input: Sec-WebSocket-Key header value (string)
+// Output: Accept key (string)
+func AcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// headerContains reports whether a comma separated header contains a token,
+// ignoring case.
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade performs the opening handshake and takes over the connection.  On
+// error nothing has been written to w, so the caller can still respond.
+// Input: HTTP response writer and request
+// Output: WebSocket connection, error if the request is not a valid handshake
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != "GET" {
+		return nil, fmt.Errorf("websocket handshake must use GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("missing websocket upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("missing websocket key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("connection does not support hijacking")
+	}
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(response); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	slog.Info("WebSocket connection upgraded", "remote", netConn.RemoteAddr().String())
+	return &Conn{conn: netConn, reader: rw.Reader, isServer: true, maxSize: DefaultMaxMessageSize, timeout: DefaultWriteTimeout}, nil
+}
+
+// Dial opens a client connection to a ws:// URL with the given extra headers.
+// Input: URL (string), Extra request headers (http.Header)
+// Output: WebSocket connection, error if the handshake fails
+func Dial(rawURL string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	netConn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	var request strings.Builder
+	request.WriteString(fmt.Sprintf("GET %s HTTP/1.1\r\n", u.RequestURI()))
+	request.WriteString(fmt.Sprintf("Host: %s\r\n", u.Host))
+	request.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	request.WriteString(fmt.Sprintf("Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n", key))
+	for name, values := range header {
+		for _, value := range values {
+			request.WriteString(fmt.Sprintf("%s: %s\r\n", name, value))
+		}
+	}
+	request.WriteString("\r\n")
+	if _, err := netConn.Write([]byte(request.String())); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != AcceptKey(key) {
+		netConn.Close()
+		return nil, fmt.Errorf("websocket handshake failed with status %d", resp.StatusCode)
+	}
+	return &Conn{conn: netConn, reader: reader, isServer: false, maxSize: DefaultMaxMessageSize, timeout: DefaultWriteTimeout}, nil
+}
+
+// SetMaxMessageSize sets the largest message the connection will read.
+// Input: Size in bytes (int64)
+// Output: None
+func (c *Conn) SetMaxMessageSize(size int64) {
+	c.maxSize = size
+}
+
+// SetWriteTimeout sets how long a frame write may block before the
+// connection is closed.
+// Input: Timeout (time.Duration)
+// Output: None
+func (c *Conn) SetWriteTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// RemoteAddr returns the address of the peer.
+// Input: None
+// Output: Remote address (net.Addr)
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// readFrame reads a single frame from the connection and unmasks its payload.
+// Input: None
+// Output: Final fragment flag, opcode, payload, error if any
+func (c *Conn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = int(header[0] & 0x0f)
+	masked := header[1]&0x80 != 0
+
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(extended))
+	}
+
+	// Clients must mask every frame, servers must never mask
+	if masked != c.isServer {
+		return false, 0, nil, fmt.Errorf("websocket frame has invalid masking")
+	}
+	if length < 0 || length > c.maxSize {
+		return false, 0, nil, fmt.Errorf("websocket frame too large")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// ReadMessage reads the next text or binary message, reassembling fragments
+// and answering control frames along the way.
+// Input: None
+// Output: Message type (int), Message data ([]byte), error if any
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	message := make([]byte, 0)
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			c.Close()
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case PingMessage:
+			c.writeFrame(PongMessage, payload)
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			// Echo the close code back and shut down
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(CloseMessage, payload)
+			c.closed.Store(true)
+			c.conn.Close()
+			return 0, nil, ErrClosed
+		case continuationFrame:
+			if messageType == 0 {
+				c.Close()
+				return 0, nil, fmt.Errorf("unexpected continuation frame")
+			}
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				c.Close()
+				return 0, nil, fmt.Errorf("expected continuation frame")
+			}
+			messageType = opcode
+		default:
+			c.Close()
+			return 0, nil, fmt.Errorf("unknown websocket opcode %d", opcode)
+		}
+
+		message = append(message, payload...)
+		if int64(len(message)) > c.maxSize {
+			c.Close()
+			return 0, nil, fmt.Errorf("websocket message too large")
+		}
+		if fin {
+			return messageType, message, nil
+		}
+	}
+}
+
+// writeFrame writes a single unfragmented frame, masking it on client
+// connections.  A write that times out leaves a partial frame behind, so the
+// connection is closed.
+// Input: Opcode (int), Payload ([]byte)
+// Output: Error if any
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	if c.closed.Load() {
+		return ErrClosed
+	}
+
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|byte(opcode))
+
+	maskBit := byte(0)
+	if !c.isServer {
+		maskBit = 0x80
+	}
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if c.isServer {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(frame)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && !c.closed.Swap(true) {
+		c.conn.Close()
+	}
+	return err
+}
+
+// WriteMessage sends a message of the given type.
+// Input: Message type (int), Message data ([]byte)
+// Output: Error if any
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	return c.writeFrame(messageType, data)
+}
+
+// Close sends a normal closure frame and closes the underlying connection.
+// Input: None
+// Output: Error if any
+func (c *Conn) Close() error {
+	c.writeFrame(CloseMessage, []byte{0x03, 0xe8})
+	if c.closed.Swap(true) {
+		return nil
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,120 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEchoServer starts a server that echoes every message it receives
+func newEchoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(messageType, data)
+		}
+	}))
+}
+
+// Test_AcceptKey checks the accept key against the example in RFC 6455
+func Test_AcceptKey(t *testing.T) {
+	if key := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept key %s", key)
+	}
+}
+
+// Test_EchoMessages sends small and large messages through an echo server
+func Test_EchoMessages(t *testing.T) {
+	server := newEchoServer(t)
+	defer server.Close()
+
+	conn, err := Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	for _, size := range []int{0, 10, 200, 70000} {
+		payload := bytes.Repeat([]byte("a"), size)
+		if err := conn.WriteMessage(TextMessage, payload); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if messageType != TextMessage || !bytes.Equal(data, payload) {
+			t.Errorf("Echo mismatch for message of size %d", size)
+		}
+	}
+}
+
+// Test_PingIsAnswered checks that the server answers pings while reading
+func Test_PingIsAnswered(t *testing.T) {
+	server := newEchoServer(t)
+	defer server.Close()
+
+	conn, err := Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	conn.writeFrame(PingMessage, []byte("ping"))
+	conn.WriteMessage(TextMessage, []byte("after ping"))
+
+	// The pong is consumed by ReadMessage, leaving the echoed message
+	_, data, err := conn.ReadMessage()
+	if err != nil || string(data) != "after ping" {
+		t.Errorf("Expected echoed message after ping, got %q (%v)", data, err)
+	}
+}
+
+// Test_RejectsPlainRequest checks that a request without upgrade headers is refused
+func Test_RejectsPlainRequest(t *testing.T) {
+	server := newEchoServer(t)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", resp.StatusCode)
+	}
+}
+
+// Test_WriteTimeout checks that a write to a peer that stops reading times
+// out and closes the connection
+func Test_WriteTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &Conn{conn: server, reader: bufio.NewReader(server), isServer: true, maxSize: DefaultMaxMessageSize}
+	conn.SetWriteTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := conn.WriteMessage(TextMessage, []byte("never read")); err == nil {
+		t.Fatal("Expected the write to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the write to give up after the timeout, took %v", elapsed)
+	}
+	if err := conn.WriteMessage(TextMessage, []byte("again")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}